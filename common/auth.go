@@ -0,0 +1,391 @@
+package common
+
+import (
+	"bytes"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// defaultIdentityFiles are tried, in order, when ssh_config doesn't name any identity files.
+var defaultIdentityFiles = []string{
+	"~/.ssh/id_ed25519",
+	"~/.ssh/id_ecdsa",
+	"~/.ssh/id_rsa",
+}
+
+// identity is a key read from an identity file. Only the public half is known for keys
+// that could not be decrypted.
+type identity struct {
+	path      string
+	publicKey ssh.PublicKey
+	signer    ssh.Signer
+}
+
+func loadIdentity(path string) (*identity, error) {
+	privateKeyBytes, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(privateKeyBytes)
+
+	var passphraseErr *ssh.PassphraseMissingError
+
+	if errors.As(err, &passphraseErr) {
+		publicKey := passphraseErr.PublicKey
+
+		// Older key formats don't embed the public key, but there is usually a .pub file.
+		if publicKey == nil {
+			if publicKeyBytes, err := os.ReadFile(path + ".pub"); err == nil {
+				publicKey, _, _, _, _ = ssh.ParseAuthorizedKey(publicKeyBytes)
+			}
+		}
+
+		return &identity{path: path, publicKey: publicKey}, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &identity{path: path, publicKey: signer.PublicKey(), signer: signer}, nil
+}
+
+// passphraseAttempts is how many times we ask for a passphrase or password before giving up.
+const passphraseAttempts = 3
+
+// encryptedSigner decrypts a passphrase protected identity the first time it is used.
+// Servers are asked whether they would accept the public key before anything is signed,
+// so the user is only prompted for keys that can actually log them in.
+type encryptedSigner struct {
+	identity *identity
+	prompter Prompter
+
+	once   sync.Once
+	signer ssh.AlgorithmSigner
+	err    error
+}
+
+func (e *encryptedSigner) unlock() error {
+	e.once.Do(func() {
+		privateKeyBytes, err := os.ReadFile(e.identity.path)
+
+		if err != nil {
+			e.err = err
+			return
+		}
+
+		for i := 0; i < passphraseAttempts; i++ {
+			passphrase, err := e.prompter.Prompt(fmt.Sprintf("Enter passphrase for key '%s': ", e.identity.path), false)
+
+			if err != nil {
+				e.err = err
+				return
+			}
+
+			signer, err := ssh.ParsePrivateKeyWithPassphrase(privateKeyBytes, []byte(passphrase))
+
+			if errors.Is(err, x509.IncorrectPasswordError) {
+				e.err = fmt.Errorf("incorrect passphrase for %s", e.identity.path)
+				continue
+			}
+
+			if err != nil {
+				e.err = err
+				return
+			}
+
+			algorithmSigner, ok := signer.(ssh.AlgorithmSigner)
+
+			if !ok {
+				e.err = fmt.Errorf("unsupported key type %s", signer.PublicKey().Type())
+				return
+			}
+
+			e.signer, e.err = algorithmSigner, nil
+			return
+		}
+	})
+
+	return e.err
+}
+
+func (e *encryptedSigner) PublicKey() ssh.PublicKey {
+	return e.identity.publicKey
+}
+
+func (e *encryptedSigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	if err := e.unlock(); err != nil {
+		return nil, err
+	}
+
+	return e.signer.Sign(rand, data)
+}
+
+func (e *encryptedSigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	if err := e.unlock(); err != nil {
+		return nil, err
+	}
+
+	return e.signer.SignWithAlgorithm(rand, data, algorithm)
+}
+
+// sameKey reports whether two public keys are the same, looking through certificates.
+func sameKey(a, b ssh.PublicKey) bool {
+	if cert, ok := a.(*ssh.Certificate); ok {
+		a = cert.Key
+	}
+
+	if cert, ok := b.(*ssh.Certificate); ok {
+		b = cert.Key
+	}
+
+	return a != nil && b != nil && bytes.Equal(a.Marshal(), b.Marshal())
+}
+
+func loadCertificate(path string) (*ssh.Certificate, error) {
+	certBytes, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(certBytes)
+
+	if err != nil {
+		return nil, err
+	}
+
+	cert, ok := publicKey.(*ssh.Certificate)
+
+	if !ok {
+		return nil, fmt.Errorf("%s is not a certificate", path)
+	}
+
+	return cert, nil
+}
+
+// loadCertificates reads the explicitly configured certificate files along with the
+// <key>-cert.pub file next to each identity file, if there is one.
+func loadCertificates(info ConnectionInfo) []*ssh.Certificate {
+	var certs []*ssh.Certificate
+
+	paths := append([]string{}, info.CertificateFiles...)
+
+	for _, path := range info.IdentityFiles {
+		paths = append(paths, path+"-cert.pub")
+	}
+
+	for _, path := range paths {
+		cert, err := loadCertificate(path)
+
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping certificate %s: %v\n", path, err)
+			continue
+		}
+
+		certs = append(certs, cert)
+	}
+
+	return certs
+}
+
+// withCertificates puts a certificate signer in front of every signer that has a
+// matching certificate, so that certificates are offered before the plain keys.
+func withCertificates(signers []ssh.Signer, certs []*ssh.Certificate) []ssh.Signer {
+	var out []ssh.Signer
+
+	for _, signer := range signers {
+		// Agents can hold certificates themselves.
+		if _, ok := signer.PublicKey().(*ssh.Certificate); ok {
+			out = append(out, signer)
+			continue
+		}
+
+		for _, cert := range certs {
+			if !sameKey(cert.Key, signer.PublicKey()) {
+				continue
+			}
+
+			certSigner, err := ssh.NewCertSigner(cert, signer)
+
+			if err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Skipping certificate %s: %v\n", cert.KeyId, err)
+				continue
+			}
+
+			out = append(out, certSigner)
+		}
+
+		out = append(out, signer)
+	}
+
+	return out
+}
+
+// loadAgentSigners returns the keys held by the agent listening on socket. The returned
+// function closes the agent connection.
+func loadAgentSigners(socket string) ([]ssh.Signer, func(), error) {
+	if socket == "" || socket == "none" {
+		return nil, func() {}, nil
+	}
+
+	conn, err := net.Dial("unix", socket)
+
+	if err != nil {
+		return nil, func() {}, fmt.Errorf("connect to agent: %w", err)
+	}
+
+	signers, err := agent.NewClient(conn).Signers()
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, func() {}, fmt.Errorf("list agent keys: %w", err)
+	}
+
+	return signers, func() { _ = conn.Close() }, nil
+}
+
+// loadSigners collects every key we may authenticate with, in the order OpenSSH would
+// offer them: agent keys matching an identity file, any other agent keys (unless
+// IdentitiesOnly is set), then the identity files themselves. Keys with a certificate
+// are offered with the certificate first. The returned function must be called once
+// authentication is over.
+func loadSigners(info ConnectionInfo) ([]ssh.Signer, func(), error) {
+	var identities []*identity
+
+	for _, path := range info.IdentityFiles {
+		id, err := loadIdentity(path)
+
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping identity %s: %v\n", path, err)
+			continue
+		}
+
+		identities = append(identities, id)
+	}
+
+	agentSigners, closeAgent, err := loadAgentSigners(info.IdentityAgent)
+
+	if err != nil {
+		// A stale SSH_AUTH_SOCK shouldn't stop us from using identity files.
+		_, _ = fmt.Fprintf(os.Stderr, "Not using agent: %v\n", err)
+	}
+
+	var signers []ssh.Signer
+	var otherAgentSigners []ssh.Signer
+	fromAgent := make([]bool, len(identities))
+
+	for _, agentSigner := range agentSigners {
+		matched := false
+
+		for i, id := range identities {
+			if sameKey(agentSigner.PublicKey(), id.publicKey) {
+				matched = true
+				fromAgent[i] = true
+			}
+		}
+
+		if matched {
+			signers = append(signers, agentSigner)
+		} else if !info.IdentitiesOnly {
+			otherAgentSigners = append(otherAgentSigners, agentSigner)
+		}
+	}
+
+	signers = append(signers, otherAgentSigners...)
+
+	for i, id := range identities {
+		if fromAgent[i] {
+			continue
+		}
+
+		if id.signer != nil {
+			signers = append(signers, id.signer)
+		} else if id.publicKey != nil && info.Prompter != nil {
+			signers = append(signers, &encryptedSigner{identity: id, prompter: info.Prompter})
+		} else {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping identity %s: key is passphrase protected\n", id.path)
+		}
+	}
+
+	return withCertificates(signers, loadCertificates(info)), closeAgent, nil
+}
+
+// authMethods returns the authentication methods to try, in the order OpenSSH prefers them.
+// Methods that need to ask the user something are left out when there is no prompter, and
+// those that send a secret fail once hostKeyChanged is set, see newHostKeyCallback.
+func authMethods(info ConnectionInfo, signers []ssh.Signer, hostKeyChanged *bool) []ssh.AuthMethod {
+	methods := []ssh.AuthMethod{
+		ssh.PublicKeys(signers...),
+	}
+
+	if info.Prompter == nil {
+		return methods
+	}
+
+	if info.KbdInteractiveAuthentication {
+		methods = append(methods, ssh.RetryableAuthMethod(ssh.KeyboardInteractive(func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			if *hostKeyChanged {
+				return nil, fmt.Errorf("%w, so keyboard-interactive authentication is disabled", ErrHostKeyMismatch)
+			}
+
+			// The name and instruction are shown along with the first question.
+			var preamble string
+
+			for _, line := range []string{name, instruction} {
+				if line != "" {
+					preamble += line + "\n"
+				}
+			}
+
+			answers := make([]string, len(questions))
+
+			for i, question := range questions {
+				if i == 0 {
+					question = preamble + question
+				}
+
+				answer, err := info.Prompter.Prompt(question, echos[i])
+
+				if err != nil {
+					return nil, err
+				}
+
+				answers[i] = answer
+			}
+
+			return answers, nil
+		}), passphraseAttempts))
+	}
+
+	if info.PasswordAuthentication {
+		methods = append(methods, ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			if *hostKeyChanged {
+				return "", fmt.Errorf("%w, so password authentication is disabled", ErrHostKeyMismatch)
+			}
+
+			return info.Prompter.Prompt(fmt.Sprintf("%s@%s's password: ", info.Username, info.Hostname), false)
+		}), passphraseAttempts))
+	}
+
+	return methods
+}
@@ -13,16 +13,53 @@ import (
 	"strings"
 
 	sshConfig "github.com/kevinburke/ssh_config"
+	"github.com/l-donovan/qcp/protocol"
 	"golang.org/x/crypto/ssh"
 )
 
 type RunHandler func(stdin io.WriteCloser, stdout, stderr io.Reader) error
 
 type ConnectionInfo struct {
-	Username       string
-	PrivateKeyPath string
-	Hostname       string
-	Port           int
+	Username string
+	Hostname string
+	Port     int
+
+	// Authentication settings, see auth.go.
+	IdentityFiles  []string
+	IdentitiesOnly bool
+	IdentityAgent  string
+
+	// CertificateFiles are used in addition to the <key>-cert.pub files found next to
+	// each identity file.
+	CertificateFiles []string
+
+	PasswordAuthentication       bool
+	KbdInteractiveAuthentication bool
+
+	// Proxy settings, see proxy.go. ProxyJump takes precedence over ProxyCommand.
+	ProxyJump    []string
+	ProxyCommand string
+
+	// Prompter is used for passphrases, passwords and host key confirmation. Nothing is
+	// asked when it is nil.
+	Prompter Prompter
+
+	// Host key verification settings, see hostkeys.go.
+	KnownHostsFiles       []string
+	StrictHostKeyChecking string
+	HostKeyAlias          string
+	HashKnownHosts        bool
+}
+
+// expandHome expands a leading ~ in a path from ssh_config to the user's home directory.
+func expandHome(val string, homeDir string) string {
+	if val == "~" {
+		return homeDir
+	} else if strings.HasPrefix(val, "~/") {
+		return filepath.Join(homeDir, val[2:])
+	}
+
+	return val
 }
 
 func ParseConnectionString(connection string) (*ConnectionInfo, error) {
@@ -43,7 +80,6 @@ func ParseConnectionString(connection string) (*ConnectionInfo, error) {
 	username := currentUser.Username
 	port := 22
 	hostname := groups[2]
-	privateKeyPath := ""
 
 	// Check config file for User
 	if val := sshConfig.Get(hostname, "User"); val != "" {
@@ -77,21 +113,57 @@ func ParseConnectionString(connection string) (*ConnectionInfo, error) {
 		port = tempPort
 	}
 
-	// Check config file for IdentityFile(s)
-	if vals := sshConfig.GetAll(hostname, "IdentityFile"); vals != nil {
-		var path string
+	// Check config file for IdentityFile(s). When none are configured, ssh_config only
+	// reports its built-in default and we fall back to the usual key names instead.
+	var identityFiles []string
+
+	vals := sshConfig.GetAll(hostname, "IdentityFile")
+
+	if len(vals) == 0 || (len(vals) == 1 && vals[0] == sshConfig.Default("IdentityFile")) {
+		vals = defaultIdentityFiles
+	}
+
+	for _, val := range vals {
+		identityFiles = append(identityFiles, expandHome(val, currentUser.HomeDir))
+	}
 
-		val := vals[len(vals)-1]
+	var certificateFiles []string
 
-		if val == "~" {
-			path = currentUser.HomeDir
-		} else if strings.HasPrefix(val, "~/") {
-			path = filepath.Join(currentUser.HomeDir, val[2:])
-		} else {
-			path = val
+	for _, val := range sshConfig.GetAll(hostname, "CertificateFile") {
+		certificateFiles = append(certificateFiles, expandHome(val, currentUser.HomeDir))
+	}
+
+	identitiesOnly := sshConfig.Get(hostname, "IdentitiesOnly") == "yes"
+	identityAgent := sshConfig.Get(hostname, "IdentityAgent")
+
+	if identityAgent == "" || identityAgent == "SSH_AUTH_SOCK" {
+		identityAgent = os.Getenv("SSH_AUTH_SOCK")
+	} else if identityAgent != "none" {
+		identityAgent = expandHome(identityAgent, currentUser.HomeDir)
+	}
+
+	passwordAuthentication := sshConfig.Get(hostname, "PasswordAuthentication") != "no"
+	kbdInteractiveAuthentication := sshConfig.Get(hostname, "KbdInteractiveAuthentication") != "no"
+
+	// Check config file for known_hosts files. User files come first so that newly
+	// accepted keys are written there.
+	var knownHostsFiles []string
+
+	for _, key := range []string{"UserKnownHostsFile", "GlobalKnownHostsFile"} {
+		for _, val := range strings.Fields(sshConfig.Get(hostname, key)) {
+			knownHostsFiles = append(knownHostsFiles, expandHome(val, currentUser.HomeDir))
 		}
+	}
+
+	strictHostKeyChecking := normalizeStrictHostKeyChecking(sshConfig.Get(hostname, "StrictHostKeyChecking"))
+	hostKeyAlias := sshConfig.Get(hostname, "HostKeyAlias")
+	hashKnownHosts := sshConfig.Get(hostname, "HashKnownHosts") == "yes"
+
+	proxyJump := ParseJumpHosts(sshConfig.Get(hostname, "ProxyJump"))
+	proxyCommand := sshConfig.Get(hostname, "ProxyCommand")
 
-		privateKeyPath = path
+	if proxyCommand == "none" {
+		proxyCommand = ""
 	}
 
 	// We do this last, otherwise config lookups by hostname might not work!
@@ -100,47 +172,110 @@ func ParseConnectionString(connection string) (*ConnectionInfo, error) {
 	}
 
 	info := ConnectionInfo{
-		Username:       username,
-		PrivateKeyPath: privateKeyPath,
-		Hostname:       hostname,
-		Port:           port,
+		Username: username,
+		Hostname: hostname,
+		Port:     port,
+
+		IdentityFiles:  identityFiles,
+		IdentitiesOnly: identitiesOnly,
+		IdentityAgent:  identityAgent,
+
+		CertificateFiles: certificateFiles,
+
+		PasswordAuthentication:       passwordAuthentication,
+		KbdInteractiveAuthentication: kbdInteractiveAuthentication,
+
+		KnownHostsFiles:       knownHostsFiles,
+		StrictHostKeyChecking: strictHostKeyChecking,
+		HostKeyAlias:          hostKeyAlias,
+		HashKnownHosts:        hashKnownHosts,
+
+		ProxyJump:    proxyJump,
+		ProxyCommand: proxyCommand,
 	}
 
 	return &info, nil
 }
 
+// CreateClient connects to the host described by info, through its jump hosts or proxy
+// command if it has any.
 func CreateClient(info ConnectionInfo) (*ssh.Client, error) {
-	privateKeyBytes, err := os.ReadFile(info.PrivateKeyPath)
+	if len(info.ProxyJump) > 0 {
+		jumpClient, err := dialJumpHosts(info.ProxyJump, info.Prompter)
+
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := createClientVia(jumpClient, info)
+
+		if err != nil {
+			_ = jumpClient.Close()
+			return nil, err
+		}
+
+		return client, nil
+	}
+
+	var conn net.Conn
+	var err error
+
+	if info.ProxyCommand != "" {
+		conn, err = dialCommand(expandProxyCommand(info.ProxyCommand, info))
+	} else {
+		conn, err = net.Dial("tcp", net.JoinHostPort(info.Hostname, strconv.Itoa(info.Port)))
+	}
 
 	if err != nil {
 		return nil, err
 	}
 
-	signer, err := ssh.ParsePrivateKey(privateKeyBytes)
+	client, err := newClient(conn, info)
 
 	if err != nil {
+		_ = conn.Close()
 		return nil, err
 	}
 
+	return client, nil
+}
+
+// newClient authenticates with the host described by info over an established connection.
+func newClient(conn net.Conn, info ConnectionInfo) (*ssh.Client, error) {
+	signers, closeAgent, err := loadSigners(info)
+
+	if err != nil {
+		return nil, fmt.Errorf("load identities: %w", err)
+	}
+
+	// The agent has to stay reachable until authentication is done.
+	defer closeAgent()
+
+	// A host key that changed but was accepted anyway rules out authentication that
+	// would give a man in the middle a password.
+	var hostKeyChanged bool
+
+	hostKeyCallback, hostKeyAlgorithms, err := newHostKeyCallback(info, &hostKeyChanged)
+
+	if err != nil {
+		return nil, fmt.Errorf("load known hosts: %w", err)
+	}
+
 	config := &ssh.ClientConfig{
-		User: info.Username,
-		Auth: []ssh.AuthMethod{
-			ssh.PublicKeys(signer),
-		},
-		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-			// use OpenSSH's known_hosts file if you care about host validation
-			return nil
-		},
+		User:              info.Username,
+		Auth:              authMethods(info, signers, &hostKeyChanged),
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
 	}
 
 	connectionString := fmt.Sprintf("%s:%d", info.Hostname, info.Port)
-	client, err := ssh.Dial("tcp", connectionString, config)
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, connectionString, config)
 
 	if err != nil {
 		return nil, err
 	}
 
-	return client, nil
+	return ssh.NewClient(clientConn, chans, reqs), nil
 }
 
 func FindExecutable(client *ssh.Client, name string) (string, error) {
@@ -159,11 +294,44 @@ func FindExecutable(client *ssh.Client, name string) (string, error) {
 	return strings.TrimSpace(string(out)), nil
 }
 
-func logErrors(stderr io.Reader) {
+// remoteErrors holds the first error frame sent by the remote qcp process.
+type remoteErrors struct {
+	done chan struct{}
+	err  error
+}
+
+// logErrors prints the remote process's stderr until it's closed. Error frames are kept
+// rather than printed, so that they can be returned as errors.
+func logErrors(stderr io.Reader, errs *remoteErrors) {
+	defer close(errs.done)
+
 	stderrReader := bufio.NewReader(stderr)
 
 	for {
-		out, err := stderrReader.ReadString('\n')
+		next, err := stderrReader.Peek(1)
+
+		if err == nil && next[0] == protocol.ErrorFrame {
+			var frame string
+			frame, err = stderrReader.ReadString(protocol.EndTransmission)
+
+			if err == nil {
+				remoteErr, parseErr := protocol.ParseErrorFrame(frame)
+
+				if parseErr != nil {
+					_, _ = fmt.Fprintf(os.Stderr, "error when parsing error frame from remote host: %v\n", parseErr)
+				} else if errs.err == nil {
+					errs.err = remoteErr
+				}
+
+				continue
+			}
+		}
+
+		var out string
+
+		if err == nil {
+			out, err = stderrReader.ReadString('\n')
+		}
 
 		if err == io.EOF {
 			break
@@ -185,6 +353,24 @@ type Session struct {
 	Stdin   io.WriteCloser
 	Stdout  io.Reader
 	Stderr  io.Reader
+
+	errs *remoteErrors
+}
+
+// RemoteError waits for the remote process to close its stderr and returns the error
+// frame it sent, if any. Errors sent as plain text have already been printed.
+func (s Session) RemoteError() error {
+	if s.errs == nil {
+		return nil
+	}
+
+	<-s.errs.done
+
+	if s.errs.err == nil {
+		return nil
+	}
+
+	return s.errs.err
 }
 
 func Start(client *ssh.Client, cmd string) (Session, error) {
@@ -216,7 +402,11 @@ func Start(client *ssh.Client, cmd string) (Session, error) {
 		return Session{}, fmt.Errorf("start command: %w", err)
 	}
 
-	return Session{session, stdin, stdout, stderr}, nil
+	errs := &remoteErrors{done: make(chan struct{})}
+
+	go logErrors(stderr, errs)
+
+	return Session{session, stdin, stdout, stderr, errs}, nil
 }
 
 func RunWithPipes(client *ssh.Client, cmd string, handle RunHandler) error {
@@ -232,8 +422,6 @@ func RunWithPipes(client *ssh.Client, cmd string, handle RunHandler) error {
 		}
 	}()
 
-	go logErrors(session.Stderr)
-
 	if err := handle(session.Stdin, session.Stdout, session.Stderr); err != nil {
 		return fmt.Errorf("run handler: %w", err)
 	}
@@ -244,6 +432,10 @@ func RunWithPipes(client *ssh.Client, cmd string, handle RunHandler) error {
 	}
 
 	if err := session.Session.Wait(); err != nil {
+		if remoteErr := session.RemoteError(); remoteErr != nil {
+			return remoteErr
+		}
+
 		return fmt.Errorf("wait for command: %w", err)
 	}
 
@@ -0,0 +1,375 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Supported values for the StrictHostKeyChecking option, mirroring OpenSSH.
+const (
+	StrictHostKeyCheckingYes       = "yes"
+	StrictHostKeyCheckingAsk       = "ask"
+	StrictHostKeyCheckingAcceptNew = "accept-new"
+	StrictHostKeyCheckingNo        = "no"
+)
+
+var (
+	ErrHostKeyMismatch = errors.New("remote host identification has changed")
+	ErrHostKeyUnknown  = errors.New("host key is not known")
+	ErrHostKeyRevoked  = errors.New("host key is revoked")
+)
+
+func normalizeStrictHostKeyChecking(val string) string {
+	switch strings.ToLower(val) {
+	case "yes", "true":
+		return StrictHostKeyCheckingYes
+	case "accept-new":
+		return StrictHostKeyCheckingAcceptNew
+	case "no", "off", "false":
+		return StrictHostKeyCheckingNo
+	default:
+		return StrictHostKeyCheckingAsk
+	}
+}
+
+// probeKey is a public key that can never appear in a known_hosts file. Checking it
+// against the database tells us which keys are known for a host without accepting
+// anything.
+type probeKey struct{}
+
+func (probeKey) Type() string                            { return "qcp-probe" }
+func (probeKey) Marshal() []byte                         { return []byte("qcp-probe") }
+func (probeKey) Verify(_ []byte, _ *ssh.Signature) error { return errors.New("probe key") }
+
+// probeAddr is the placeholder remote address used alongside probeKey.
+var probeAddr = &net.TCPAddr{IP: net.IPv4zero}
+
+// certAlgorithms are preferred when a known_hosts @cert-authority entry covers the host.
+var certAlgorithms = []string{
+	ssh.CertAlgoED25519v01,
+	ssh.CertAlgoECDSA256v01,
+	ssh.CertAlgoECDSA384v01,
+	ssh.CertAlgoECDSA521v01,
+	ssh.CertAlgoRSASHA512v01,
+	ssh.CertAlgoRSASHA256v01,
+}
+
+// plainAlgorithms are offered after certAlgorithms when no plain key is known for the host.
+var plainAlgorithms = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+	ssh.KeyAlgoRSASHA512,
+	ssh.KeyAlgoRSASHA256,
+}
+
+// matchWildcard matches a known_hosts pattern containing * and ? wildcards.
+func matchWildcard(pattern, str string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for i := len(str); i >= 0; i-- {
+				if matchWildcard(pattern[1:], str[i:]) {
+					return true
+				}
+			}
+
+			return false
+		case '?':
+			if len(str) == 0 {
+				return false
+			}
+		default:
+			if len(str) == 0 || pattern[0] != str[0] {
+				return false
+			}
+		}
+
+		pattern = pattern[1:]
+		str = str[1:]
+	}
+
+	return len(str) == 0
+}
+
+// matchHashedHost matches a hashed known_hosts entry of the form |1|salt|hash.
+func matchHashedHost(pattern, host string) bool {
+	parts := strings.Split(pattern, "|")
+
+	if len(parts) != 4 || parts[1] != "1" {
+		return false
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return false
+	}
+
+	hash, err := base64.StdEncoding.DecodeString(parts[3])
+
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(sha1.New, salt)
+	mac.Write([]byte(host))
+
+	return hmac.Equal(mac.Sum(nil), hash)
+}
+
+// matchHosts reports whether the host patterns of a known_hosts line match host, which
+// must be normalized the way known_hosts stores it.
+func matchHosts(patterns []string, host string) bool {
+	matched := false
+
+	for _, pattern := range patterns {
+		negate := strings.HasPrefix(pattern, "!")
+		pattern = strings.TrimPrefix(pattern, "!")
+
+		var ok bool
+
+		if strings.HasPrefix(pattern, "|") {
+			ok = matchHashedHost(pattern, host)
+		} else {
+			ok = matchWildcard(pattern, host)
+		}
+
+		if ok && negate {
+			return false
+		}
+
+		matched = matched || ok
+	}
+
+	return matched
+}
+
+// hasCertAuthority reports whether any @cert-authority entry in files covers address.
+func hasCertAuthority(files []string, address string) bool {
+	host := knownhosts.Normalize(address)
+
+	for _, filename := range files {
+		contents, err := os.ReadFile(filename)
+
+		if err != nil {
+			continue
+		}
+
+		for len(contents) > 0 {
+			marker, hosts, _, _, rest, err := ssh.ParseKnownHosts(contents)
+
+			if err != nil {
+				break
+			}
+
+			if marker == "cert-authority" && matchHosts(hosts, host) {
+				return true
+			}
+
+			contents = rest
+		}
+	}
+
+	return false
+}
+
+// hostKeyAlgorithms returns the algorithms for the keys we already know for the host,
+// so that the server presents a key we can actually verify. Certificates come first if
+// a certificate authority is trusted for the host. If nothing is known, nil is returned
+// and the library defaults are used.
+func hostKeyAlgorithms(check ssh.HostKeyCallback, files []string, address string) []string {
+	var algorithms []string
+
+	if hasCertAuthority(files, address) {
+		algorithms = append(algorithms, certAlgorithms...)
+	}
+
+	var keyErr *knownhosts.KeyError
+
+	if err := check(address, probeAddr, probeKey{}); !errors.As(err, &keyErr) || len(keyErr.Want) == 0 {
+		if len(algorithms) > 0 {
+			algorithms = append(algorithms, plainAlgorithms...)
+		}
+
+		return algorithms
+	}
+
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+
+	return algorithms
+}
+
+// addKnownHost appends a host key to the given known_hosts file.
+func addKnownHost(filename string, address string, key ssh.PublicKey, hash bool) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o700); err != nil {
+		return fmt.Errorf("create directory %s: %w", filepath.Dir(filename), err)
+	}
+
+	fp, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+
+	if err != nil {
+		return fmt.Errorf("open %s: %w", filename, err)
+	}
+
+	defer func() {
+		_ = fp.Close()
+	}()
+
+	line := knownhosts.Line([]string{address}, key)
+
+	if hash {
+		line = knownhosts.HashHostname(knownhosts.Normalize(address)) + " " + strings.SplitN(line, " ", 2)[1]
+	}
+
+	if _, err := fmt.Fprintln(fp, line); err != nil {
+		return fmt.Errorf("write %s: %w", filename, err)
+	}
+
+	return fp.Close()
+}
+
+// newHostKeyCallback builds a host key callback that verifies keys against the known_hosts
+// files in info, following its StrictHostKeyChecking mode. It also returns the host key
+// algorithms to prefer during the handshake. Like OpenSSH, it accepts a key that doesn't
+// match the known one only with StrictHostKeyChecking set to no, and then sets changed.
+func newHostKeyCallback(info ConnectionInfo, changed *bool) (ssh.HostKeyCallback, []string, error) {
+	var files []string
+
+	for _, filename := range info.KnownHostsFiles {
+		if _, err := os.Stat(filename); err == nil {
+			files = append(files, filename)
+		}
+	}
+
+	// Without any files, every host is unknown.
+	check := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		return &knownhosts.KeyError{}
+	}
+
+	if len(files) > 0 {
+		db, err := knownhosts.New(files...)
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		check = db
+	}
+
+	// Keys are looked up under the alias if one has been configured.
+	lookupHost := info.Hostname
+
+	if info.HostKeyAlias != "" {
+		lookupHost = info.HostKeyAlias
+	}
+
+	address := net.JoinHostPort(lookupHost, strconv.Itoa(info.Port))
+
+	callback := func(_ string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(address, remote, key)
+
+		if err == nil {
+			return nil
+		}
+
+		fingerprint := ssh.FingerprintSHA256(key)
+
+		var revokedErr *knownhosts.RevokedError
+
+		if errors.As(err, &revokedErr) {
+			return fmt.Errorf("%w: %s key %s for %s (%s)", ErrHostKeyRevoked, key.Type(), fingerprint, lookupHost, revokedErr.Revoked.String())
+		}
+
+		var keyErr *knownhosts.KeyError
+
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+
+		if len(keyErr.Want) > 0 {
+			var expected []string
+
+			for _, known := range keyErr.Want {
+				expected = append(expected, fmt.Sprintf("%s %s (%s:%d)", known.Key.Type(), ssh.FingerprintSHA256(known.Key), known.Filename, known.Line))
+			}
+
+			mismatchErr := fmt.Errorf("%w: %s offered %s key %s, expected %s", ErrHostKeyMismatch, lookupHost, key.Type(), fingerprint, strings.Join(expected, ", "))
+
+			if info.StrictHostKeyChecking == StrictHostKeyCheckingNo {
+				_, _ = fmt.Fprintf(os.Stderr, "WARNING: %v\nPassword and keyboard-interactive authentication are disabled to avoid man-in-the-middle attacks.\n", mismatchErr)
+				*changed = true
+				return nil
+			}
+
+			return mismatchErr
+		}
+
+		accept := false
+
+		switch info.StrictHostKeyChecking {
+		case StrictHostKeyCheckingAcceptNew, StrictHostKeyCheckingNo:
+			accept = true
+		case StrictHostKeyCheckingAsk:
+			if info.Prompter == nil {
+				break
+			}
+
+			question := fmt.Sprintf("The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\nAre you sure you want to continue connecting (yes/no)? ", knownhosts.Normalize(address), key.Type(), fingerprint)
+
+			for {
+				answer, err := confirm(info.Prompter, question)
+
+				if err != nil {
+					return fmt.Errorf("confirm host key: %w", err)
+				}
+
+				answer = strings.ToLower(strings.TrimSpace(answer))
+
+				if answer == "yes" || answer == "no" {
+					accept = answer == "yes"
+					break
+				}
+
+				question = "Please type 'yes' or 'no': "
+			}
+		}
+
+		if !accept {
+			return fmt.Errorf("%w: %s key %s for %s, add it to your known_hosts file or set StrictHostKeyChecking to accept-new", ErrHostKeyUnknown, key.Type(), fingerprint, knownhosts.Normalize(address))
+		}
+
+		if len(info.KnownHostsFiles) == 0 {
+			return nil
+		}
+
+		if err := addKnownHost(info.KnownHostsFiles[0], address, key, info.HashKnownHosts); err != nil {
+			return fmt.Errorf("add known host: %w", err)
+		}
+
+		_, _ = fmt.Fprintf(os.Stderr, "Permanently added '%s' (%s) to the list of known hosts.\n", knownhosts.Normalize(address), key.Type())
+
+		return nil
+	}
+
+	return callback, hostKeyAlgorithms(check, files, address), nil
+}
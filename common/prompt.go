@@ -0,0 +1,129 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+var ErrNoPrompter = errors.New("cannot ask for input in non-interactive mode")
+
+// Prompter asks the user for the answers needed to connect to a host, such as key
+// passphrases, passwords and one-time codes.
+type Prompter interface {
+	// Prompt shows message to the user and returns their answer. Answers to prompts
+	// with echo set to false are secrets and must not be displayed.
+	Prompt(message string, echo bool) (string, error)
+}
+
+// TerminalPrompter prompts on the controlling terminal.
+type TerminalPrompter struct{}
+
+func (TerminalPrompter) Prompt(message string, echo bool) (string, error) {
+	fd := int(os.Stdin.Fd())
+
+	if !term.IsTerminal(fd) {
+		return "", ErrNoPrompter
+	}
+
+	_, _ = fmt.Fprint(os.Stderr, message)
+
+	if !echo {
+		answer, err := term.ReadPassword(fd)
+		_, _ = fmt.Fprintln(os.Stderr)
+
+		if err != nil {
+			return "", fmt.Errorf("read answer: %w", err)
+		}
+
+		return string(answer), nil
+	}
+
+	answer, err := bufio.NewReader(os.Stdin).ReadString('\n')
+
+	if err != nil {
+		return "", fmt.Errorf("read answer: %w", err)
+	}
+
+	return strings.TrimRight(answer, "\r\n"), nil
+}
+
+// AskpassPrompter runs an SSH_ASKPASS-style program with the prompt as its only argument
+// and uses whatever it prints as the answer.
+type AskpassPrompter struct {
+	Program string
+}
+
+func (a AskpassPrompter) Prompt(message string, echo bool) (string, error) {
+	cmd := exec.Command(a.Program, message)
+	cmd.Stderr = os.Stderr
+
+	out, err := cmd.Output()
+
+	if err != nil {
+		return "", fmt.Errorf("run %s: %w", a.Program, err)
+	}
+
+	return strings.TrimRight(string(out), "\r\n"), nil
+}
+
+// Confirm asks a yes or no question. SSH_ASKPASS_PROMPT=confirm has the program offer
+// just that, and programs that then print nothing answer yes by exiting successfully
+// and no otherwise.
+func (a AskpassPrompter) Confirm(message string) (string, error) {
+	cmd := exec.Command(a.Program, message)
+	cmd.Stderr = os.Stderr
+	cmd.Env = append(os.Environ(), "SSH_ASKPASS_PROMPT=confirm")
+
+	out, err := cmd.Output()
+
+	if errors.As(err, new(*exec.ExitError)) {
+		return "no", nil
+	}
+
+	if err != nil {
+		return "", fmt.Errorf("run %s: %w", a.Program, err)
+	}
+
+	if answer := strings.TrimRight(string(out), "\r\n"); answer != "" {
+		return answer, nil
+	}
+
+	return "yes", nil
+}
+
+// confirmer is a Prompter that asks yes or no questions differently from others.
+type confirmer interface {
+	Confirm(message string) (string, error)
+}
+
+// confirm asks p a yes or no question, which only some prompters tell apart from
+// others, see AskpassPrompter.Confirm.
+func confirm(p Prompter, message string) (string, error) {
+	if c, ok := p.(confirmer); ok {
+		return c.Confirm(message)
+	}
+
+	return p.Prompt(message, true)
+}
+
+// DefaultPrompter picks a prompter the way OpenSSH does: the terminal when interactive,
+// otherwise $SSH_ASKPASS if it is set. It returns nil if there is no way to prompt.
+func DefaultPrompter(interactive bool) Prompter {
+	program := os.Getenv("SSH_ASKPASS")
+
+	if program != "" && (!interactive || os.Getenv("SSH_ASKPASS_REQUIRE") == "force") {
+		return AskpassPrompter{program}
+	}
+
+	if interactive {
+		return TerminalPrompter{}
+	}
+
+	return nil
+}
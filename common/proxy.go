@@ -0,0 +1,172 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ParseJumpHosts splits a ProxyJump value such as "bastion,user@inner:2222" into the
+// connection strings of its hops. "none" disables jumping entirely.
+func ParseJumpHosts(val string) []string {
+	var hops []string
+
+	if val == "" || val == "none" {
+		return nil
+	}
+
+	for _, hop := range strings.Split(val, ",") {
+		if hop = strings.TrimSpace(hop); hop != "" {
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
+
+// expandProxyCommand substitutes the %h, %p, %r and %% tokens in a ProxyCommand.
+func expandProxyCommand(command string, info ConnectionInfo) string {
+	replacer := strings.NewReplacer(
+		"%%", "%",
+		"%h", info.Hostname,
+		"%p", strconv.Itoa(info.Port),
+		"%r", info.Username,
+	)
+
+	return replacer.Replace(command)
+}
+
+// commandConn is a net.Conn backed by the standard input and output of a ProxyCommand.
+type commandConn struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+}
+
+func dialCommand(command string) (net.Conn, error) {
+	var cmd *exec.Cmd
+
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", command)
+	} else {
+		cmd = exec.Command("/bin/sh", "-c", "exec "+command)
+	}
+
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+
+	if err != nil {
+		return nil, fmt.Errorf("get stdin pipe: %w", err)
+	}
+
+	stdout, err := cmd.StdoutPipe()
+
+	if err != nil {
+		return nil, fmt.Errorf("get stdout pipe: %w", err)
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start proxy command: %w", err)
+	}
+
+	return &commandConn{cmd, stdin, stdout}, nil
+}
+
+func (c *commandConn) Read(b []byte) (int, error) {
+	return c.stdout.Read(b)
+}
+
+func (c *commandConn) Write(b []byte) (int, error) {
+	return c.stdin.Write(b)
+}
+
+func (c *commandConn) Close() error {
+	_ = c.stdin.Close()
+	_ = c.cmd.Process.Kill()
+
+	// The command was killed, so its exit status tells us nothing.
+	_ = c.cmd.Wait()
+
+	return nil
+}
+
+// The host key is checked against the hostname rather than the remote address, so a
+// placeholder address is fine here.
+func (c *commandConn) LocalAddr() net.Addr                { return &net.TCPAddr{IP: net.IPv4zero} }
+func (c *commandConn) RemoteAddr() net.Addr               { return &net.TCPAddr{IP: net.IPv4zero} }
+func (c *commandConn) SetDeadline(_ time.Time) error      { return nil }
+func (c *commandConn) SetReadDeadline(_ time.Time) error  { return nil }
+func (c *commandConn) SetWriteDeadline(_ time.Time) error { return nil }
+
+// dialJumpHosts connects to each hop in turn, tunnelling every connection through the
+// previous one, and returns the client for the last hop.
+func dialJumpHosts(hops []string, prompter Prompter) (*ssh.Client, error) {
+	var client *ssh.Client
+
+	for _, hop := range hops {
+		info, err := ParseConnectionString(hop)
+
+		if err != nil {
+			return nil, fmt.Errorf("parse jump host %s: %w", hop, err)
+		}
+
+		// The chain is given explicitly, so the hops' own ProxyJump settings don't apply.
+		// This also keeps a "Host *" ProxyJump from recursing forever.
+		info.ProxyJump = nil
+		info.Prompter = prompter
+
+		var next *ssh.Client
+
+		if client == nil {
+			next, err = CreateClient(*info)
+		} else {
+			next, err = createClientVia(client, *info)
+		}
+
+		if err != nil {
+			if client != nil {
+				_ = client.Close()
+			}
+
+			return nil, fmt.Errorf("connect to jump host %s: %w", hop, err)
+		}
+
+		client = next
+	}
+
+	return client, nil
+}
+
+// createClientVia connects to the host described by info through an existing client.
+// The existing client is closed along with the new one.
+func createClientVia(via *ssh.Client, info ConnectionInfo) (*ssh.Client, error) {
+	address := net.JoinHostPort(info.Hostname, strconv.Itoa(info.Port))
+	conn, err := via.Dial("tcp", address)
+
+	if err != nil {
+		return nil, fmt.Errorf("dial %s: %w", address, err)
+	}
+
+	client, err := newClient(conn, info)
+
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	go func() {
+		_ = client.Wait()
+		_ = via.Close()
+	}()
+
+	return client, nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"path"
+	"strconv"
 	"strings"
 )
 
@@ -75,3 +76,30 @@ func PrettifySpeed(speedBitsPerSecond int64) string {
 
 	return fmt.Sprintf("%.2f %s", flSpeed, units[i])
 }
+
+var sizeUnits = map[string]int64{
+	"":  1,
+	"k": 1 << 10,
+	"m": 1 << 20,
+	"g": 1 << 30,
+	"t": 1 << 40,
+}
+
+// ParseSize parses a size like 512, 100k, 1.5M or 2GiB. Units are powers of 1024, like
+// PrettifySize's.
+func ParseSize(s string) (int64, error) {
+	number := strings.TrimRight(strings.TrimSpace(s), "BbIi")
+	unit := ""
+
+	if number != "" && strings.ContainsAny(number[len(number)-1:], "kKmMgGtT") {
+		number, unit = number[:len(number)-1], strings.ToLower(number[len(number)-1:])
+	}
+
+	value, err := strconv.ParseFloat(number, 64)
+
+	if err != nil || strings.Trim(number, "0123456789.") != "" {
+		return 0, fmt.Errorf("invalid size %s", s)
+	}
+
+	return int64(value * float64(sizeUnits[unit])), nil
+}
@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
+	"slices"
 	"strconv"
+	"time"
 
 	"github.com/l-donovan/qcp/common"
 	"github.com/l-donovan/qcp/protocol"
@@ -12,6 +17,7 @@ import (
 	"github.com/l-donovan/qcp/sessions"
 	"github.com/l-donovan/qcp/sideload"
 	"github.com/l-donovan/qcp/web"
+	"golang.org/x/crypto/ssh"
 )
 
 func exitWithMessage(format string, a ...any) {
@@ -23,22 +29,251 @@ func exitWithError(err error) {
 	exitWithMessage("%v", err)
 }
 
+// exitWithFrame reports an error from a server mode, as an error frame if the client
+// negotiated them.
+func exitWithFrame(features protocol.Features, err error) {
+	if !features.Has(protocol.CapErrorFrames) {
+		exitWithError(err)
+	}
+
+	_, _ = fmt.Fprint(os.Stderr, protocol.NewRemoteError(err).Frame())
+	os.Exit(1)
+}
+
+func compressionOptions(args map[string]any) (string, int, error) {
+	compression := args["compress"].(string)
+
+	if compression != protocol.CompressionAuto && !slices.Contains(protocol.LocalFeatures().Compression, compression) {
+		return "", 0, fmt.Errorf("unknown compression %s", compression)
+	}
+
+	level, err := strconv.Atoi(args["level"].(string))
+
+	if err != nil || level < 0 {
+		return "", 0, fmt.Errorf("invalid compression level %s", args["level"].(string))
+	}
+
+	return compression, level, nil
+}
+
+func conflictPolicy(args map[string]any) (string, error) {
+	policy := args["on-conflict"].(string)
+
+	if policy != "" && !slices.Contains(serve.ConflictPolicies, policy) {
+		return "", fmt.Errorf("unknown conflict policy %s", policy)
+	}
+
+	return policy, nil
+}
+
+// transferFilters builds filters from --exclude-from, --exclude and --include, each
+// taking precedence over the ones before, --respect-gitignore and the limits on size,
+// age and depth.
+func transferFilters(args map[string]any) (serve.Filters, error) {
+	filters := serve.Filters{Gitignore: args["respect-gitignore"].(bool)}
+
+	if excludeFrom := args["exclude-from"].(string); excludeFrom != "" {
+		rules, err := serve.ReadFilterRules(excludeFrom)
+
+		if err != nil {
+			return filters, fmt.Errorf("read filters: %w", err)
+		}
+
+		filters.Rules = rules
+	}
+
+	filters.Exclude(serve.SplitPatterns(args["exclude"].(string))...)
+	filters.Include(serve.SplitPatterns(args["include"].(string))...)
+
+	var err error
+
+	if value := args["min-size"].(string); value != "" {
+		filters.MinSize, err = common.ParseSize(value)
+
+		if err != nil {
+			return filters, err
+		}
+	}
+
+	if value := args["max-size"].(string); value != "" {
+		filters.MaxSize, err = common.ParseSize(value)
+
+		if err != nil || filters.MaxSize == 0 {
+			return filters, fmt.Errorf("invalid maximum size %s", value)
+		}
+	}
+
+	if value := args["newer-than"].(string); value != "" {
+		filters.NewerThan, err = serve.ParseTimeLimit(value)
+
+		if err != nil {
+			return filters, err
+		}
+	}
+
+	if value := args["older-than"].(string); value != "" {
+		filters.OlderThan, err = serve.ParseTimeLimit(value)
+
+		if err != nil {
+			return filters, err
+		}
+	}
+
+	if value := args["max-depth"].(string); value != "" {
+		filters.MaxDepth, err = strconv.Atoi(value)
+
+		if err != nil || filters.MaxDepth < 1 {
+			return filters, fmt.Errorf("invalid depth %s", value)
+		}
+	}
+
+	return filters, nil
+}
+
+// transferLimit returns the bandwidth limit asked for by the --limit flags.
+func transferLimit(args map[string]any) (serve.Limit, error) {
+	var limit serve.Limit
+	var err error
+
+	if value := args["limit"].(string); value != "" {
+		limit.Rate, err = serve.ParseRate(value)
+
+		if err != nil {
+			return limit, err
+		}
+	}
+
+	if value := args["limit-schedule"].(string); value != "" {
+		if limit.Empty() {
+			return limit, errors.New("--limit-schedule needs --limit")
+		}
+
+		limit.Schedule, err = serve.ParseSchedule(value)
+
+		if err != nil {
+			return limit, err
+		}
+
+		// The schedule is in local time, wherever the other side is.
+		limit.Location = serve.LocalZone()
+		_, limit.Zone = time.Now().Zone()
+	}
+
+	return limit, nil
+}
+
+func transferOptions(args map[string]any) (sessions.TransferOptions, error) {
+	compression, level, err := compressionOptions(args)
+
+	if err != nil {
+		return sessions.TransferOptions{}, err
+	}
+
+	streams, err := strconv.Atoi(args["streams"].(string))
+
+	if err != nil || streams < 1 {
+		return sessions.TransferOptions{}, fmt.Errorf("invalid number of streams %s", args["streams"].(string))
+	}
+
+	delta := args["delta"].(bool)
+
+	if delta && streams > 1 {
+		return sessions.TransferOptions{}, errors.New("--delta can't be combined with more than one stream")
+	}
+
+	preserve := args["preserve"].(bool)
+
+	if preserve && streams > 1 {
+		return sessions.TransferOptions{}, errors.New("--preserve can't be combined with more than one stream")
+	}
+
+	atomic := args["atomic"].(bool)
+
+	if atomic && streams > 1 {
+		return sessions.TransferOptions{}, errors.New("--atomic can't be combined with more than one stream")
+	}
+
+	onConflict, err := conflictPolicy(args)
+
+	if err != nil {
+		return sessions.TransferOptions{}, err
+	}
+
+	if onConflict != "" && (delta || streams > 1) {
+		return sessions.TransferOptions{}, errors.New("--on-conflict can't be combined with --delta or more than one stream")
+	}
+
+	if args["dereference"].(bool) && args["no-dereference"].(bool) {
+		return sessions.TransferOptions{}, errors.New("-L and -P can't be combined")
+	}
+
+	filters, err := transferFilters(args)
+
+	if err != nil {
+		return sessions.TransferOptions{}, err
+	}
+
+	limit, err := transferLimit(args)
+
+	if err != nil {
+		return sessions.TransferOptions{}, err
+	}
+
+	// Like cp -a, preserving implies not following links unless told otherwise.
+	noDereference := args["no-dereference"].(bool) || (preserve && !args["dereference"].(bool))
+
+	return sessions.TransferOptions{
+		Verify:      args["verify"].(bool),
+		Compression: compression,
+		Level:       level,
+		Streams:     streams,
+		Delta:       delta,
+
+		Preserve:      preserve,
+		NoDereference: noDereference,
+		Dereference:   args["dereference"].(bool),
+		Xattrs:        args["xattrs"].(bool),
+		Atomic:        atomic,
+		OnConflict:    onConflict,
+		Filters:       filters,
+		Limit:         limit,
+	}, nil
+}
+
+func createClient(connectionString string, jumpHosts string, prompter common.Prompter) (*ssh.Client, error) {
+	info, err := common.ParseConnectionString(connectionString)
+
+	if err != nil {
+		return nil, fmt.Errorf("parse connection string: %w", err)
+	}
+
+	// Jump hosts given on the command line take precedence over ssh_config.
+	if jumpHosts != "" {
+		info.ProxyJump = common.ParseJumpHosts(jumpHosts)
+	}
+
+	info.Prompter = prompter
+
+	remoteClient, err := common.CreateClient(*info)
+
+	if err != nil {
+		return nil, fmt.Errorf("create client: %w", err)
+	}
+
+	return remoteClient, nil
+}
+
 func main() {
 	args := protocol.Parser.MustParseArgs()
 
 	switch args["mode"].(string) {
 	case "download":
 		connectionString := args["hostname"].(string)
+		jumpHosts := args["jump"].(string)
 		srcFilePaths := args["sources"].([]string)
 		dstFilePath := args["destination"].(string)
 
-		info, err := common.ParseConnectionString(connectionString)
-
-		if err != nil {
-			exitWithError(err)
-		}
-
-		remoteClient, err := common.CreateClient(*info)
+		remoteClient, err := createClient(connectionString, jumpHosts, common.DefaultPrompter(true))
 
 		if err != nil {
 			exitWithError(err)
@@ -50,10 +285,28 @@ func main() {
 			}
 		}()
 
-		if err := sessions.Download(remoteClient, srcFilePaths, dstFilePath); err != nil {
+		options, err := transferOptions(args)
+
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if err := sessions.Download(remoteClient, srcFilePaths, dstFilePath, options); err != nil {
+			exitWithError(err)
+		}
+	case "hello":
+		if _, err := protocol.ParseFeatures(args["features"].(string)); err != nil {
 			exitWithError(err)
 		}
+
+		fmt.Println(protocol.LocalFeatures().String())
 	case "serve":
+		features, err := protocol.Accept(args["features"].(string))
+
+		if err != nil {
+			exitWithError(err)
+		}
+
 		srcFilePaths := args["sources"].([]string)
 		offsetFile := args["offset-file"].(string)
 		offsetPosStr := args["offset-pos"].(string)
@@ -61,7 +314,7 @@ func main() {
 		offsetPos, err := strconv.ParseInt(offsetPosStr, 10, 64)
 
 		if err != nil {
-			exitWithError(err)
+			exitWithFrame(features, err)
 		}
 
 		// TODO: We get different output here depending on if we use ./my_file or just my_file.
@@ -74,23 +327,212 @@ func main() {
 			// These values may be irrelevant, depending on the input.
 			OffsetFile: offsetFile,
 			OffsetPos:  offsetPos,
+
+			Checksum: features.Checksum(),
+
+			Stream:  features.Stream,
+			Streams: features.Streams,
+		}
+
+		uploadInfo.Compression, uploadInfo.AutoCompression = features.SelectedCompression()
+		uploadInfo.Level = features.CompressionLevel
+		uploadInfo.Preserve = args["preserve"].(bool)
+		uploadInfo.NoDereference = args["no-dereference"].(bool)
+		uploadInfo.Dereference = args["dereference"].(bool)
+		uploadInfo.Xattrs = args["xattrs"].(bool)
+		uploadInfo.Sparse = features.Has(protocol.CapSparse)
+		uploadInfo.SendTotals = features.Has(protocol.CapTotals)
+		uploadInfo.SendPlan = features.Has(protocol.CapPlan)
+		uploadInfo.TrailingChecksums = features.Has(protocol.CapTrailers) && !args["verify"].(bool)
+
+		// Paths, filters, the resume state and signatures share stdin, so nothing may be
+		// read ahead of any of them.
+		stdin := bufio.NewReader(os.Stdin)
+
+		if args["only"].(bool) {
+			paths, err := serve.ReadPaths(stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
+
+			uploadInfo.Only = map[string]bool{}
+
+			for _, p := range paths {
+				uploadInfo.Only[p] = true
+			}
+		}
+
+		if args["filters"].(bool) {
+			uploadInfo.Filters, err = serve.ReadFilters(stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
+		}
+
+		if args["limit"].(bool) {
+			limit, err := serve.ReadLimit(stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
+
+			uploadInfo.Throttle = serve.NewThrottle(limit)
+		}
+
+		if args["resume"].(bool) {
+			uploadInfo.Resume, err = serve.ReadResumeState(stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
+		}
+
+		if args["delta"].(bool) {
+			uploadInfo.Signatures, err = serve.ReadSignatures(stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
 		}
 
 		if err := uploadInfo.Serve(); err != nil {
-			exitWithError(err)
+			exitWithFrame(features, err)
 		}
 	case "upload":
 		srcFilePath := args["source"].(string)
 		connectionString := args["hostname"].(string)
+		jumpHosts := args["jump"].(string)
+		dstFilePath := args["destination"].(string)
+
+		remoteClient, err := createClient(connectionString, jumpHosts, common.DefaultPrompter(true))
+
+		if err != nil {
+			exitWithError(err)
+		}
+
+		defer func() {
+			if err := remoteClient.Close(); err != nil {
+				exitWithMessage("error when closing remote client: %v\n", err)
+			}
+		}()
+
+		options, err := transferOptions(args)
+
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if err := sessions.Upload(remoteClient, srcFilePath, dstFilePath, options); err != nil {
+			exitWithError(err)
+		}
+	case "receive":
+		features, err := protocol.Accept(args["features"].(string))
+
+		if err != nil {
+			exitWithError(err)
+		}
+
 		dstFilePath := args["destination"].(string)
 
-		info, err := common.ParseConnectionString(connectionString)
+		// The conflict policy, the limit, the signature or existing file exchange and the
+		// tarball share stdin, so nothing may be read ahead of any of them.
+		stdin := bufio.NewReader(os.Stdin)
+
+		// The conflict policy comes first.
+		var onConflict string
+
+		if args["conflicts"].(bool) {
+			onConflict, err = serve.ReadConflictPolicy(stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
+		}
+
+		var limit serve.Limit
+
+		if args["limit"].(bool) {
+			limit, err = serve.ReadLimit(stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
+		}
+
+		if args["delta"].(bool) {
+			if err := serve.ExchangeSignatures(dstFilePath, stdin, os.Stdout); err != nil {
+				exitWithFrame(features, err)
+			}
+		}
+
+		if args["existing"].(bool) {
+			if err := serve.ExchangeExisting(dstFilePath, stdin, os.Stdout); err != nil {
+				exitWithFrame(features, err)
+			}
+		}
+
+		downloadInfo, err := sessions.GetDownloadInfo(dstFilePath, stdin)
+
+		if err != nil {
+			exitWithFrame(features, err)
+		}
+
+		downloadInfo.Verify = args["verify"].(bool)
+		downloadInfo.PreserveTimes = args["times"].(bool)
+		downloadInfo.Preserve = args["preserve"].(bool)
+		downloadInfo.Links = args["links"].(bool)
+		downloadInfo.Xattrs = args["xattrs"].(bool)
+		downloadInfo.Atomic = args["atomic"].(bool)
+		downloadInfo.OnConflict = onConflict
+		downloadInfo.Throttle = serve.NewThrottle(limit)
+
+		if !args["resumable"].(bool) {
+			if err := downloadInfo.Receive(nil); err != nil {
+				exitWithFrame(features, err)
+			}
+
+			break
+		}
+
+		// The journal tells the next upload what this one got done, see the resume mode.
+		if err := os.MkdirAll(dstFilePath, 0o775); err != nil {
+			exitWithFrame(features, fmt.Errorf("create directory %s: %w", dstFilePath, err))
+		}
+
+		journal, err := serve.OpenJournal(filepath.Join(dstFilePath, serve.UploadJournalName))
+
+		if err != nil {
+			exitWithFrame(features, err)
+		}
+
+		if err := downloadInfo.Receive(journal); err != nil {
+			exitWithFrame(features, err)
+		}
+
+		if err := journal.Remove(); err != nil {
+			exitWithFrame(features, err)
+		}
+	case "sync":
+		connectionString := args["hostname"].(string)
+		jumpHosts := args["jump"].(string)
+		remoteDir := args["remote"].(string)
+		localDir := args["local"].(string)
+
+		compression, level, err := compressionOptions(args)
+
+		if err != nil {
+			exitWithError(err)
+		}
+
+		filters, err := transferFilters(args)
 
 		if err != nil {
 			exitWithError(err)
 		}
 
-		remoteClient, err := common.CreateClient(*info)
+		remoteClient, err := createClient(connectionString, jumpHosts, common.DefaultPrompter(true))
 
 		if err != nil {
 			exitWithError(err)
@@ -102,37 +544,95 @@ func main() {
 			}
 		}()
 
-		if err := sessions.Upload(remoteClient, srcFilePath, dstFilePath); err != nil {
+		options := sessions.SyncOptions{
+			Push:        args["push"].(bool),
+			Delete:      args["delete"].(bool),
+			DryRun:      args["dry-run"].(bool),
+			Checksum:    args["checksum"].(bool),
+			Compression: compression,
+			Level:       level,
+			Filters:     filters,
+		}
+
+		if err := sessions.Sync(remoteClient, remoteDir, localDir, options); err != nil {
 			exitWithError(err)
 		}
-	case "receive":
-		dstFilePath := args["destination"].(string)
+	case "manifest":
+		features, err := protocol.Accept(args["features"].(string))
+
+		if err != nil {
+			exitWithError(err)
+		}
+
+		checksum := ""
+
+		if args["checksum"].(bool) {
+			checksum = features.Checksum()
+		}
+
+		var filters serve.Filters
+
+		if args["filters"].(bool) {
+			filters, err = serve.ReadFilters(os.Stdin)
+
+			if err != nil {
+				exitWithFrame(features, err)
+			}
+		}
 
-		downloadInfo, err := sessions.GetDownloadInfo(dstFilePath, os.Stdin)
+		manifest, err := serve.BuildManifest(args["location"].(string), checksum, filters)
+
+		if err != nil {
+			exitWithFrame(features, err)
+		}
+
+		if err := serve.WriteManifest(os.Stdout, manifest); err != nil {
+			exitWithFrame(features, err)
+		}
+	case "resume":
+		features, err := protocol.Accept(args["features"].(string))
 
 		if err != nil {
 			exitWithError(err)
 		}
 
-		// TODO: Partial uploads?
-		// Could be tricky because the client initiating the upload would first need to check
-		// with the remote to see if there are is a .progress file.
-		// It would then use that to determine offset parameters before serving.
+		state, err := serve.UploadResumeState(args["destination"].(string))
+
+		if err != nil {
+			exitWithFrame(features, err)
+		}
+
+		if err := serve.WriteResumeState(os.Stdout, state); err != nil {
+			exitWithFrame(features, err)
+		}
+	case "remove":
+		features, err := protocol.Accept(args["features"].(string))
 
-		if err := downloadInfo.Receive(nil); err != nil {
+		if err != nil {
 			exitWithError(err)
 		}
+
+		paths, err := serve.ReadPaths(os.Stdin)
+
+		if err != nil {
+			exitWithFrame(features, err)
+		}
+
+		if err := serve.RemovePaths(args["location"].(string), paths); err != nil {
+			exitWithFrame(features, err)
+		}
 	case "pick":
 		connectionString := args["hostname"].(string)
+		jumpHosts := args["jump"].(string)
 		location := args["location"].(string)
 
-		info, err := common.ParseConnectionString(connectionString)
+		onConflict, err := conflictPolicy(args)
 
 		if err != nil {
 			exitWithError(err)
 		}
 
-		remoteClient, err := common.CreateClient(*info)
+		remoteClient, err := createClient(connectionString, jumpHosts, common.DefaultPrompter(true))
 
 		if err != nil {
 			exitWithError(err)
@@ -144,33 +644,35 @@ func main() {
 			}
 		}()
 
-		if err := sessions.Pick(remoteClient, location); err != nil {
+		if err := sessions.Pick(remoteClient, location, onConflict); err != nil {
 			exitWithError(err)
 		}
 	case "present":
+		features, err := protocol.Accept(args["features"].(string))
+
+		if err != nil {
+			exitWithError(err)
+		}
+
 		location := args["location"].(string)
 
 		browseInfo := serve.BrowseInfo{
 			Location:    location,
 			Source:      os.Stdin,
 			Destination: os.Stdout,
+			Features:    features,
 		}
 
 		if err := browseInfo.Present(); err != nil {
-			exitWithMessage("present: %v", err)
+			exitWithFrame(features, fmt.Errorf("present: %w", err))
 		}
 	case "sideload":
 		connectionString := args["hostname"].(string)
+		jumpHosts := args["jump"].(string)
 		release := args["release"].(string)
 		location := args["location"].(string)
 
-		info, err := common.ParseConnectionString(connectionString)
-
-		if err != nil {
-			exitWithError(err)
-		}
-
-		remoteClient, err := common.CreateClient(*info)
+		remoteClient, err := createClient(connectionString, jumpHosts, common.DefaultPrompter(true))
 
 		if err != nil {
 			exitWithError(err)
@@ -190,7 +692,7 @@ func main() {
 
 		fmt.Printf("Successfully installed \"%s\" on %s at %s\n", release, connectionString, location)
 	case "web":
-		handler := web.NewHandler()
+		handler := web.NewHandler(args["jump"].(string))
 
 		server := &http.Server{
 			Addr:    ":8543",
@@ -204,8 +706,32 @@ func main() {
 		}
 	case "share":
 		connectionString := args["hostname"].(string)
+		jumpHosts := args["jump"].(string)
 		srcFilePaths := args["sources"].([]string)
 		quiet := args["quiet"].(bool)
+		dstFilePath := args["destination"].(string)
+
+		policy, err := conflictPolicy(args)
+
+		if err != nil {
+			exitWithError(err)
+		}
+
+		if policy != "" && dstFilePath == "" {
+			exitWithError(errors.New("--on-conflict needs --destination, as browsers decide where shared files go"))
+		}
+
+		filters, err := transferFilters(args)
+
+		if err != nil {
+			exitWithError(err)
+		}
+
+		limit, err := transferLimit(args)
+
+		if err != nil {
+			exitWithError(err)
+		}
 
 		filename := common.CreateIdentifier(srcFilePaths)
 
@@ -224,6 +750,9 @@ func main() {
 			uploadInfo := serve.UploadInfo{
 				Filenames:   srcFilePaths,
 				Destination: writeEnd,
+				Filters:     filters,
+				SendTotals:  true,
+				Throttle:    serve.NewThrottle(limit),
 			}
 
 			go func() {
@@ -244,13 +773,7 @@ func main() {
 
 			downloadInfo = dlInfo
 		} else {
-			info, err := common.ParseConnectionString(connectionString)
-
-			if err != nil {
-				exitWithError(err)
-			}
-
-			remoteClient, err := common.CreateClient(*info)
+			remoteClient, err := createClient(connectionString, jumpHosts, common.DefaultPrompter(!quiet))
 
 			if err != nil {
 				exitWithError(err)
@@ -262,7 +785,13 @@ func main() {
 				}
 			}()
 
-			downloadSession, err := sessions.StartDownload(remoteClient, srcFilePaths, "", 0)
+			// Browsers can open gzipped tarballs but not the alternatives.
+			downloadSession, err := sessions.StartDownload(remoteClient, srcFilePaths, "", 0, sessions.TransferOptions{
+				Compression: protocol.CompressionGzip,
+				Filters:     filters,
+				Limit:       limit,
+				ForBrowser:  true,
+			})
 
 			if err != nil {
 				exitWithError(err)
@@ -276,11 +805,32 @@ func main() {
 				exitWithError(err)
 			}
 
+			dlInfo.Throttle = serve.NewThrottle(limit)
 			downloadInfo = dlInfo
 		}
 
+		// Shares saved to a directory are received like downloads rather than served.
+		if dstFilePath != "" {
+			downloadInfo.Filename = dstFilePath
+			downloadInfo.OnConflict = policy
+			downloadInfo.Prompter = common.DefaultPrompter(!quiet)
+
+			if !quiet {
+				downloadInfo.Progress = serve.NewProgress("received")
+				downloadInfo.Progress.Expect(downloadInfo.Totals)
+			}
+
+			if err := downloadInfo.Receive(nil); err != nil {
+				downloadInfo.Progress.Clear()
+				exitWithError(fmt.Errorf("receive %v: %w", srcFilePaths, err))
+			}
+
+			return
+		}
+
 		if !quiet {
-			go downloadInfo.PrintProgressBar()
+			downloadInfo.Progress = serve.NewProgress("sent")
+			downloadInfo.Progress.Expect(downloadInfo.Totals)
 		}
 
 		ip, err := common.GetOutboundIP()
@@ -0,0 +1,78 @@
+package protocol
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+)
+
+// Checksum algorithms, in order of preference.
+const (
+	ChecksumSHA256 = "sha256"
+)
+
+// PAX records qcp adds to tar headers.
+const (
+	// PAXChecksumPrefix is followed by the checksum algorithm. The record holds the hex
+	// digest of the whole file, even if only part of it is sent.
+	PAXChecksumPrefix = "QCP."
+
+	// PAXTrailer holds the checksum algorithm of a file whose digest isn't in its header
+	// but in a TypeTrailer entry right after its contents, so that the sender only has
+	// to read the file once.
+	PAXTrailer = "QCP.trailer"
+
+	// PAXOffset holds the offset at which a resumed file's contents start.
+	PAXOffset = "QCP.offset"
+
+	// PAXSize marks a chunk of a file sent over several streams and holds the size of
+	// the whole file. The chunk starts at PAXOffset and its checksum only covers the
+	// chunk.
+	PAXSize = "QCP.size"
+
+	// PAXDelta marks a file sent as a delta against the receiver's copy and holds the
+	// block size of the signature it was computed from. An empty delta means the file
+	// hasn't changed.
+	PAXDelta = "QCP.delta"
+
+	// PAXSparseMap marks a sparse file sent without its holes and holds the offset and
+	// length of each range of data, as "offset,length,offset,length". PAXSparseSize
+	// holds the size of the whole file.
+	PAXSparseMap  = "QCP.sparse.map"
+	PAXSparseSize = "QCP.sparse.size"
+
+	// PAXConflict holds what the user answered when asked about a file that already
+	// exists at the destination, one of the conflict policies other than ask.
+	PAXConflict = "QCP.conflict"
+
+	// PAXXattrPrefix is followed by the name of an extended attribute, as GNU tar and
+	// star do. POSIX ACLs and file capabilities are sent as extended attributes too.
+	PAXXattrPrefix = "SCHILY.xattr."
+)
+
+// TypeTrailer is the type of the entry that follows the contents of a file sent with
+// PAXTrailer. It has the file's name and no contents, and holds the file's digest in a
+// PAXChecksumPrefix record like a header would.
+const TypeTrailer = 'Q'
+
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// NewHash returns a hash for the given checksum algorithm, or nil if it isn't supported.
+func NewHash(algorithm string) hash.Hash {
+	switch algorithm {
+	case ChecksumSHA256:
+		return sha256.New()
+	}
+
+	return nil
+}
+
+// Checksum returns the negotiated checksum algorithm, or an empty string if files are
+// sent without checksums.
+func (f Features) Checksum() string {
+	if len(f.Checksums) == 0 {
+		return ""
+	}
+
+	return f.Checksums[0]
+}
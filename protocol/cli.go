@@ -15,47 +15,179 @@ func init() {
 			s.AddParameter("hostname", "connection string, in the format [username@]hostname[:port]")
 			s.SetListParameter("sources", "files/directories to download", 1)
 			s.AddValueFlag("destination", 'd', "location of downloaded file", "PATH", "")
+			s.AddValueFlag("jump", 'J', "jump hosts to connect through, in the format [username@]hostname[:port][,...]", "HOSTS", "")
+			s.AddFlag("verify", 'V', "rehash resumed files and files skipped because they already exist", false)
+			s.AddValueFlag("compress", 'c', "compression to use: auto, zstd, gzip or none", "ALGORITHM", "auto")
+			s.AddValueFlag("level", 'l', "compression level, 0 for the default", "LEVEL", "0")
+			s.AddValueFlag("streams", 'n', "number of SSH sessions to transfer over in parallel, which disables resuming", "N", "1")
+			s.AddFlag("delta", 'D', "send only the parts of files that differ from the copies already at the destination", false)
+			s.AddFlag("preserve", 'p', "preserve times, owners, links, FIFOs and device nodes, which implies -P", false)
+			s.AddFlag("dereference", 'L', "follow symbolic links to directories too. By default, only links to files are followed, and none with --preserve", false)
+			s.AddFlag("no-dereference", 'P', "send symbolic links as links", false)
+			s.AddFlag("xattrs", 'X', "preserve extended attributes, including POSIX ACLs and file capabilities", false)
+			s.AddFlag("atomic", 'A', "write files under a temporary name and move them into place once complete", false)
+			s.AddValueFlag("on-conflict", 'C', "what to do with files that already exist: overwrite, skip, newer, rename, fail or ask. By default, files of the same size are skipped and the rest overwritten", "POLICY", "")
+			s.AddValueFlag("exclude", 'x', "comma separated patterns of files to leave out, as in .gitignore", "PATTERNS", "")
+			s.AddValueFlag("include", 'i', "comma separated patterns of files to send even if excluded", "PATTERNS", "")
+			s.AddValueFlag("exclude-from", 'F', "file of patterns of files to leave out, one per line, as in .gitignore", "FILE", "")
+			s.AddFlag("respect-gitignore", 'g', "leave out files ignored by .gitignore files, and .git directories", false)
+			s.AddValueFlag("min-size", 'm', "leave out files smaller than this, such as 100k", "SIZE", "")
+			s.AddValueFlag("max-size", 'M', "leave out files larger than this, such as 10M", "SIZE", "")
+			s.AddValueFlag("newer-than", 'N', "leave out files last modified before this time, or longer ago than this age, such as 2h or 3d", "TIME", "")
+			s.AddValueFlag("older-than", 'O', "leave out files last modified after this time, or more recently than this age", "TIME", "")
+			s.AddValueFlag("max-depth", 'E', "leave out what's more than this many levels below the sources", "N", "")
+			s.AddValueFlag("limit", 'r', "bandwidth to keep to, such as 20MiB/s", "RATE", "")
+			s.AddValueFlag("limit-schedule", 'w', "times of day the limit applies in, such as 09:00-17:00,22:00-06:00. By default, it always applies", "WINDOWS", "")
 		},
 		"_serve": func(s *goparse.Parser) {
 			// Server mode (hidden)
 			s.SetListParameter("sources", "files/directories to serve", 1)
 			s.AddValueFlag("offset-file", 'o', "file from which to begin serving, used for resuming partial downloads", "file", "")
 			s.AddValueFlag("offset-pos", 'o', "offset from which to begin serving in the file, used for resuming partial downloads", "pos", "0")
+			s.AddValueFlag("features", 'f', "features negotiated during the handshake", "features", "")
+			s.AddFlag("delta", 'D', "read signatures of the receiver's files from stdin and send deltas against them", false)
+			s.AddFlag("only", 'O', "read the paths in the tarball to serve from stdin and leave out everything else", false)
+			s.AddFlag("preserve", 'p', "send hard links, FIFOs and device nodes as such", false)
+			s.AddFlag("no-dereference", 'P', "send symbolic links as links", false)
+			s.AddFlag("dereference", 'l', "follow symbolic links to directories too", false)
+			s.AddFlag("xattrs", 'X', "send extended attributes, including POSIX ACLs and file capabilities", false)
+			s.AddFlag("verify", 'V', "send checksums ahead of files rather than after them, so that the receiver can check what it already has", false)
+			s.AddFlag("resume", 'R', "read what the receiver has from an interrupted transfer from stdin, then skip or resume it", false)
+			s.AddFlag("filters", 'F', "read filters from stdin and leave out what they exclude", false)
+			s.AddFlag("limit", 'L', "read a bandwidth limit from stdin and keep to it", false)
 		},
 		"upload": func(s *goparse.Parser) {
 			// Client mode
 			s.AddParameter("source", "file to upload")
 			s.AddParameter("hostname", "connection string, in the format [username@]hostname[:port]")
 			s.AddParameter("destination", "location of uploaded file")
+			s.AddValueFlag("jump", 'J', "jump hosts to connect through, in the format [username@]hostname[:port][,...]", "HOSTS", "")
+			s.AddFlag("verify", 'V', "rehash resumed files and files skipped because they already exist", false)
+			s.AddValueFlag("compress", 'c', "compression to use: auto, zstd, gzip or none", "ALGORITHM", "auto")
+			s.AddValueFlag("level", 'l', "compression level, 0 for the default", "LEVEL", "0")
+			s.AddValueFlag("streams", 'n', "number of SSH sessions to transfer over in parallel, which disables resuming", "N", "1")
+			s.AddFlag("delta", 'D', "send only the parts of files that differ from the copies already at the destination", false)
+			s.AddFlag("preserve", 'p', "preserve times, owners, links, FIFOs and device nodes, which implies -P", false)
+			s.AddFlag("dereference", 'L', "follow symbolic links to directories too. By default, only links to files are followed, and none with --preserve", false)
+			s.AddFlag("no-dereference", 'P', "send symbolic links as links", false)
+			s.AddFlag("xattrs", 'X', "preserve extended attributes, including POSIX ACLs and file capabilities", false)
+			s.AddFlag("atomic", 'A', "write files under a temporary name and move them into place once complete", false)
+			s.AddValueFlag("on-conflict", 'C', "what to do with files that already exist: overwrite, skip, newer, rename, fail or ask. By default, files of the same size are skipped and the rest overwritten", "POLICY", "")
+			s.AddValueFlag("exclude", 'x', "comma separated patterns of files to leave out, as in .gitignore", "PATTERNS", "")
+			s.AddValueFlag("include", 'i', "comma separated patterns of files to send even if excluded", "PATTERNS", "")
+			s.AddValueFlag("exclude-from", 'F', "file of patterns of files to leave out, one per line, as in .gitignore", "FILE", "")
+			s.AddFlag("respect-gitignore", 'g', "leave out files ignored by .gitignore files, and .git directories", false)
+			s.AddValueFlag("min-size", 'm', "leave out files smaller than this, such as 100k", "SIZE", "")
+			s.AddValueFlag("max-size", 'M', "leave out files larger than this, such as 10M", "SIZE", "")
+			s.AddValueFlag("newer-than", 'N', "leave out files last modified before this time, or longer ago than this age, such as 2h or 3d", "TIME", "")
+			s.AddValueFlag("older-than", 'O', "leave out files last modified after this time, or more recently than this age", "TIME", "")
+			s.AddValueFlag("max-depth", 'E', "leave out what's more than this many levels below the sources", "N", "")
+			s.AddValueFlag("limit", 'r', "bandwidth to keep to, such as 20MiB/s", "RATE", "")
+			s.AddValueFlag("limit-schedule", 'w', "times of day the limit applies in, such as 09:00-17:00,22:00-06:00. By default, it always applies", "WINDOWS", "")
 		},
 		"_receive": func(s *goparse.Parser) {
 			// Server mode (hidden)
 			s.AddParameter("destination", "file to receive")
+			s.AddValueFlag("features", 'f', "features negotiated during the handshake", "features", "")
+			s.AddFlag("verify", 'V', "rehash files skipped because they already exist", false)
+			s.AddFlag("delta", 'D', "exchange signatures of existing files over stdin and stdout before receiving", false)
+			s.AddFlag("times", 'T', "set modification times of received files", false)
+			s.AddFlag("preserve", 'p', "preserve times, owners and modes of received files and directories, and recreate links, FIFOs and device nodes", false)
+			s.AddFlag("links", 'P', "recreate symbolic links sent as links", false)
+			s.AddFlag("xattrs", 'X', "apply extended attributes sent with files", false)
+			s.AddFlag("atomic", 'A', "write files under a temporary name and move them into place once complete", false)
+			s.AddFlag("conflicts", 'C', "read a conflict policy from stdin before anything else", false)
+			s.AddFlag("existing", 'E', "exchange the files that already exist over stdin and stdout before receiving, for the sender to ask about", false)
+			s.AddFlag("resumable", 'R', "keep a journal in the destination so that an interrupted upload can be resumed", false)
+			s.AddFlag("limit", 'L', "read a bandwidth limit from stdin after the conflict policy and keep to it", false)
+		},
+		"sync": func(s *goparse.Parser) {
+			// Client mode
+			s.AddParameter("hostname", "connection string, in the format [username@]hostname[:port]")
+			s.AddParameter("remote", "directory on the remote host")
+			s.AddParameter("local", "local directory")
+			s.AddValueFlag("jump", 'J', "jump hosts to connect through, in the format [username@]hostname[:port][,...]", "HOSTS", "")
+			// Short flags that download and upload use for something else are left alone.
+			s.AddFlag("push", 'u', "make the remote directory match the local one, instead of the reverse", false)
+			s.AddFlag("delete", 'R', "delete files that aren't in the source directory", false)
+			s.AddFlag("dry-run", 'y', "print what would be transferred and deleted without doing it", false)
+			s.AddFlag("checksum", 'V', "compare the contents of files of the same size instead of their modification times", false)
+			s.AddValueFlag("compress", 'c', "compression to use: auto, zstd, gzip or none", "ALGORITHM", "auto")
+			s.AddValueFlag("level", 'l', "compression level, 0 for the default", "LEVEL", "0")
+			s.AddValueFlag("exclude", 'x', "comma separated patterns of files to leave out, as in .gitignore", "PATTERNS", "")
+			s.AddValueFlag("include", 'i', "comma separated patterns of files to send even if excluded", "PATTERNS", "")
+			s.AddValueFlag("exclude-from", 'F', "file of patterns of files to leave out, one per line, as in .gitignore", "FILE", "")
+			s.AddFlag("respect-gitignore", 'g', "leave out files ignored by .gitignore files, and .git directories", false)
+			s.AddValueFlag("min-size", 'm', "leave out files smaller than this, such as 100k", "SIZE", "")
+			s.AddValueFlag("max-size", 'M', "leave out files larger than this, such as 10M", "SIZE", "")
+			s.AddValueFlag("newer-than", 'N', "leave out files last modified before this time, or longer ago than this age, such as 2h or 3d", "TIME", "")
+			s.AddValueFlag("older-than", 'O', "leave out files last modified after this time, or more recently than this age", "TIME", "")
+			s.AddValueFlag("max-depth", 'E', "leave out what's more than this many levels below the sources", "N", "")
+		},
+		"_manifest": func(s *goparse.Parser) {
+			// Server mode (hidden)
+			s.AddParameter("location", "directory to list")
+			s.AddValueFlag("features", 'f', "features negotiated during the handshake", "features", "")
+			s.AddFlag("checksum", 'C', "checksum every file", false)
+			s.AddFlag("filters", 'F', "read filters from stdin and leave out what they exclude", false)
+		},
+		"_resume": func(s *goparse.Parser) {
+			// Server mode (hidden)
+			s.AddParameter("destination", "destination of the upload to resume")
+			s.AddValueFlag("features", 'f', "features negotiated during the handshake", "features", "")
+		},
+		"_remove": func(s *goparse.Parser) {
+			// Server mode (hidden)
+			s.AddParameter("location", "directory to remove the paths read from stdin from")
+			s.AddValueFlag("features", 'f', "features negotiated during the handshake", "features", "")
 		},
 		"pick": func(s *goparse.Parser) {
 			// Client mode
 			s.AddParameter("hostname", "connection string, in the format [username@]hostname[:port]")
 			s.AddValueFlag("location", 'l', "", "path", "$HOME")
+			s.AddValueFlag("jump", 'J', "jump hosts to connect through, in the format [username@]hostname[:port][,...]", "HOSTS", "")
+			s.AddValueFlag("on-conflict", 'C', "what to do with files that already exist: overwrite, skip, newer, rename, fail or ask", "POLICY", "")
 		},
 		"_present": func(s *goparse.Parser) {
 			// Server mode (hidden)
 			s.AddParameter("location", "")
+			s.AddValueFlag("features", 'f', "features negotiated during the handshake", "features", "")
+		},
+		"_hello": func(s *goparse.Parser) {
+			// Handshake mode (hidden)
+			s.AddValueFlag("features", 'f', "features supported by the client", "features", "")
 		},
 		"sideload": func(s *goparse.Parser) {
 			// Client mode
 			s.AddParameter("hostname", "connection string, in the format [username@]hostname[:port]")
 			s.AddValueFlag("release", 'r', "qcp release to sideload", "version", "latest")
 			s.AddValueFlag("location", 'l', "target location for qcp executable on host", "path", "$HOME/bin/qcp")
+			s.AddValueFlag("jump", 'J', "jump hosts to connect through, in the format [username@]hostname[:port][,...]", "HOSTS", "")
 		},
 		"web": func(s *goparse.Parser) {
 			// Web interface mode
 			s.AddValueFlag("hostname", 's', "hostname for web interface", "address", ":8543")
+			s.AddValueFlag("jump", 'J', "jump hosts to connect through, in the format [username@]hostname[:port][,...]", "HOSTS", "")
 		},
 		"share": func(s *goparse.Parser) {
 			// Link sharing mode
 			s.AddValueFlag("hostname", 's', "connection string, in the format [username@]hostname[:port]", "HOST", "")
 			s.SetListParameter("sources", "files/directories to serve", 1)
 			s.AddFlag("quiet", 'q', "progress information will not be printed", false)
+			s.AddValueFlag("destination", 'd', "local directory to save the files to instead of serving a download link", "PATH", "")
+			s.AddValueFlag("on-conflict", 'C', "what to do with files that already exist in --destination: overwrite, skip, newer, rename, fail or ask. By default, files of the same size are skipped and the rest overwritten", "POLICY", "")
+			s.AddValueFlag("jump", 'J', "jump hosts to connect through, in the format [username@]hostname[:port][,...]", "HOSTS", "")
+			s.AddValueFlag("exclude", 'x', "comma separated patterns of files to leave out, as in .gitignore", "PATTERNS", "")
+			s.AddValueFlag("include", 'i', "comma separated patterns of files to send even if excluded", "PATTERNS", "")
+			s.AddValueFlag("exclude-from", 'F', "file of patterns of files to leave out, one per line, as in .gitignore", "FILE", "")
+			s.AddFlag("respect-gitignore", 'g', "leave out files ignored by .gitignore files, and .git directories", false)
+			s.AddValueFlag("min-size", 'm', "leave out files smaller than this, such as 100k", "SIZE", "")
+			s.AddValueFlag("max-size", 'M', "leave out files larger than this, such as 10M", "SIZE", "")
+			s.AddValueFlag("newer-than", 'N', "leave out files last modified before this time, or longer ago than this age, such as 2h or 3d", "TIME", "")
+			s.AddValueFlag("older-than", 'O', "leave out files last modified after this time, or more recently than this age", "TIME", "")
+			s.AddValueFlag("max-depth", 'E', "leave out what's more than this many levels below the sources", "N", "")
+			s.AddValueFlag("limit", 'r', "bandwidth to keep to, such as 20MiB/s", "RATE", "")
+			s.AddValueFlag("limit-schedule", 'w', "times of day the limit applies in, such as 09:00-17:00,22:00-06:00. By default, it always applies", "WINDOWS", "")
 		},
 	})
 }
@@ -0,0 +1,86 @@
+package protocol
+
+import (
+	"fmt"
+	"slices"
+)
+
+// CompressionAuto compresses with the preferred algorithm unless the files look like
+// they won't compress, in which case nothing is compressed.
+const CompressionAuto = "auto"
+
+// SelectCompression narrows negotiated features down to the compression asked for,
+// which is either an algorithm or CompressionAuto. With CompressionAuto, the sender
+// gets the preferred algorithm followed by CompressionNone to fall back on.
+func (f Features) SelectCompression(compression string, level int) (Features, error) {
+	f.CompressionLevel = level
+
+	if compression == "" || compression == CompressionAuto {
+		var preferred []string
+
+		for _, algorithm := range f.Compression {
+			if algorithm != CompressionNone {
+				preferred = []string{algorithm}
+				break
+			}
+		}
+
+		if slices.Contains(f.Compression, CompressionNone) {
+			preferred = append(preferred, CompressionNone)
+		}
+
+		if len(preferred) == 0 {
+			return f, fmt.Errorf("%w: compression", ErrNoCommon)
+		}
+
+		f.Compression = preferred
+
+		return f, nil
+	}
+
+	if !slices.Contains(f.Compression, compression) {
+		return f, fmt.Errorf("%w: compression, remote qcp doesn't support %s", ErrNoCommon, compression)
+	}
+
+	f.Compression = []string{compression}
+
+	return f, nil
+}
+
+// SelectedCompression returns the algorithm SelectCompression picked and whether the
+// sender may fall back on CompressionNone.
+func (f Features) SelectedCompression() (string, bool) {
+	if len(f.Compression) == 0 {
+		return CompressionGzip, false
+	}
+
+	return f.Compression[0], slices.Contains(f.Compression[1:], CompressionNone)
+}
+
+// CompressionFlags returns the flag bits for a compression algorithm.
+func CompressionFlags(algorithm string) (byte, error) {
+	switch algorithm {
+	case CompressionGzip:
+		return CompressedGzip, nil
+	case CompressionZstd:
+		return CompressedZstd, nil
+	case CompressionNone:
+		return CompressedNone, nil
+	}
+
+	return 0, fmt.Errorf("unsupported compression %s", algorithm)
+}
+
+// CompressionFromFlags is the inverse of CompressionFlags.
+func CompressionFromFlags(flags byte) (string, error) {
+	switch flags & CompressionMask {
+	case CompressedGzip:
+		return CompressionGzip, nil
+	case CompressedZstd:
+		return CompressionZstd, nil
+	case CompressedNone:
+		return CompressionNone, nil
+	}
+
+	return "", fmt.Errorf("unknown compression flags %03b", flags&CompressionMask)
+}
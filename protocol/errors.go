@@ -0,0 +1,131 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+	"syscall"
+)
+
+// Error codes carried in error frames.
+const (
+	CodeUnknown      = "unknown"
+	CodeNotFound     = "not-found"
+	CodePermission   = "permission-denied"
+	CodeExists       = "exists"
+	CodeDiskFull     = "disk-full"
+	CodeNotDirectory = "not-a-directory"
+	CodeChecksum     = "checksum-mismatch"
+)
+
+var ErrDiskFull = errors.New("no space left on device")
+var ErrNotDirectory = errors.New("not a directory")
+
+// RemoteError is an error that happened in a qcp process on the remote host and was
+// sent to us as an error frame. It matches the corresponding standard errors with
+// errors.Is, e.g. fs.ErrNotExist for CodeNotFound.
+type RemoteError struct {
+	Code    string
+	Path    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Message
+}
+
+func (e *RemoteError) Is(target error) bool {
+	switch e.Code {
+	case CodeNotFound:
+		return target == fs.ErrNotExist
+	case CodePermission:
+		return target == fs.ErrPermission
+	case CodeExists:
+		return target == fs.ErrExist
+	case CodeDiskFull:
+		return target == ErrDiskFull || target == syscall.ENOSPC
+	case CodeNotDirectory:
+		return target == ErrNotDirectory || target == syscall.ENOTDIR
+	case CodeChecksum:
+		return target == ErrChecksumMismatch
+	}
+
+	return false
+}
+
+// NewRemoteError classifies err so that it can be sent to the client as an error frame.
+func NewRemoteError(err error) *RemoteError {
+	remoteErr := &RemoteError{
+		Code:    CodeUnknown,
+		Message: err.Error(),
+	}
+
+	var pathErr *fs.PathError
+
+	if errors.As(err, &pathErr) {
+		remoteErr.Path = pathErr.Path
+	}
+
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		remoteErr.Code = CodeNotFound
+	case errors.Is(err, fs.ErrPermission):
+		remoteErr.Code = CodePermission
+	case errors.Is(err, fs.ErrExist):
+		remoteErr.Code = CodeExists
+	case errors.Is(err, syscall.ENOSPC), errors.Is(err, ErrDiskFull):
+		remoteErr.Code = CodeDiskFull
+	case errors.Is(err, syscall.ENOTDIR), errors.Is(err, ErrNotDirectory):
+		remoteErr.Code = CodeNotDirectory
+	case errors.Is(err, ErrChecksumMismatch):
+		remoteErr.Code = CodeChecksum
+	}
+
+	return remoteErr
+}
+
+// sanitize keeps the frame's control characters out of its fields.
+func sanitize(field string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ErrorFrame, UnitSeparator, EndTransmission:
+			return '?'
+		}
+
+		return r
+	}, field)
+}
+
+// Frame serializes the error as an error frame: ErrorFrame, then the code, path and
+// message separated by UnitSeparator, then EndTransmission.
+func (e *RemoteError) Frame() string {
+	return fmt.Sprintf("%c%s%c%s%c%s%c", ErrorFrame, sanitize(e.Code), UnitSeparator, sanitize(e.Path), UnitSeparator, sanitize(e.Message), EndTransmission)
+}
+
+// IsErrorFrame reports whether a response read up to and including EndTransmission is
+// an error frame.
+func IsErrorFrame(response string) bool {
+	return strings.HasPrefix(response, string(ErrorFrame))
+}
+
+// ParseErrorFrame is the inverse of RemoteError.Frame.
+func ParseErrorFrame(frame string) (*RemoteError, error) {
+	if !IsErrorFrame(frame) {
+		return nil, errors.New("not an error frame")
+	}
+
+	frame = strings.TrimPrefix(frame, string(ErrorFrame))
+	frame = strings.TrimSuffix(frame, string(EndTransmission))
+	components := strings.Split(frame, string(UnitSeparator))
+
+	if len(components) != 3 {
+		return nil, fmt.Errorf("expected 3 error frame components but got %d instead", len(components))
+	}
+
+	return &RemoteError{
+		Code:    components[0],
+		Path:    components[1],
+		Message: components[2],
+	}, nil
+}
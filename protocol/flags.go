@@ -2,4 +2,19 @@ package protocol
 
 const (
 	ShouldUnpack = 0b00000001
+
+	// The two bits after ShouldUnpack hold the compression algorithm. Gzip is zero
+	// because it's what versions of qcp without a choice of compression send.
+	CompressionMask = 0b00000110
+	CompressedGzip  = 0b00000000
+	CompressedZstd  = 0b00000010
+	CompressedNone  = 0b00000100
+
+	// HasTotals means the number of files and bytes about to be sent follow the flags,
+	// see serve.Totals.
+	HasTotals = 0b00001000
+
+	// HasPlan means the digest of how the transfer was split between streams follows
+	// the flags and totals, see serve.Plan.
+	HasPlan = 0b00010000
 )
@@ -0,0 +1,321 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const (
+	// Version is the protocol version spoken by this build of qcp. Version 1 is the
+	// original protocol, which predates the handshake.
+	Version = 2
+
+	// MinVersion is the oldest protocol version this build of qcp can talk to.
+	MinVersion = 2
+)
+
+// Compression algorithms, in order of preference.
+const (
+	CompressionZstd = "zstd"
+	CompressionGzip = "gzip"
+	CompressionNone = "none"
+)
+
+// Optional capabilities.
+const (
+	// CapResume means partial downloads can be resumed with an offset file and position.
+	CapResume = "resume"
+
+	// CapErrorFrames means server modes report errors as error frames, see errors.go.
+	CapErrorFrames = "error-frames"
+
+	// CapStreams means transfers can be split across several sessions, see Stream.
+	CapStreams = "streams"
+
+	// CapDelta means files can be sent as deltas against the receiver's copies, see
+	// PAXDelta.
+	CapDelta = "delta"
+
+	// CapSync means the remote can list and remove files for qcp sync, serve a selection
+	// of files and preserve modification times.
+	CapSync = "sync"
+
+	// CapPreserve means server modes can preserve links, special files and metadata.
+	CapPreserve = "preserve"
+
+	// CapXattrs means server modes can send and apply extended attributes.
+	CapXattrs = "xattrs"
+
+	// CapSparse means sparse files can be sent without their holes, see PAXSparseMap.
+	CapSparse = "sparse"
+
+	// CapAtomic means the receive mode can write files under a temporary name and move
+	// them into place once complete.
+	CapAtomic = "atomic"
+
+	// CapConflicts means the receive mode can take a conflict policy for files that
+	// already exist.
+	CapConflicts = "conflicts"
+
+	// CapResumeUpload means interrupted uploads can be resumed, see the resume mode.
+	CapResumeUpload = "resume-upload"
+
+	// CapJournal means the serve mode can be told which files the receiver already has
+	// and which one it was in the middle of, rather than just where to resume.
+	CapJournal = "journal"
+
+	// CapFilters means the serve and manifest modes can leave out files, see
+	// serve.Filters.
+	CapFilters = "filters"
+
+	// CapLimits means the serve and manifest modes can leave out files by size, age and
+	// depth as well.
+	CapLimits = "limits"
+
+	// CapTotals means the sender says how many files and bytes it's about to send, see
+	// HasTotals.
+	CapTotals = "totals"
+
+	// CapThrottle means the serve and receive modes can keep to a bandwidth limit, see
+	// serve.Limit.
+	CapThrottle = "throttle"
+
+	// CapFollow means server modes only follow symbolic links to directories when told
+	// to, and only recreate links and special files that were asked for.
+	CapFollow = "follow"
+
+	// CapPlan means streams of the serve mode send the digest of their plan, see HasPlan.
+	CapPlan = "plan"
+
+	// CapTrailers means checksums may follow the contents of files, see PAXTrailer, and
+	// the serve mode can be asked to put them ahead of the contents instead.
+	CapTrailers = "trailers"
+
+	// CapAnswers means the receive mode can list the files that already exist, so that
+	// the sender can ask the user about them and send the answers along, see PAXConflict.
+	CapAnswers = "answers"
+)
+
+var (
+	ErrTooOld   = errors.New("too old")
+	ErrNoCommon = errors.New("no common feature")
+)
+
+// Features describes what one side of a connection supports. Once negotiated, it
+// describes what both sides agreed to use, in which case Checksums holds at most one
+// algorithm. Compression holds the algorithms the sender may use, see SelectCompression.
+type Features struct {
+	Version      int
+	MinVersion   int
+	Compression  []string
+	Checksums    []string
+	Capabilities []string
+
+	// CompressionLevel is the level to compress at, or 0 for the algorithm's default.
+	CompressionLevel int
+
+	// Stream is which of Streams parts of a transfer a session handles. Streams is 0 or
+	// 1 when the transfer isn't split.
+	Stream  int
+	Streams int
+}
+
+// LocalFeatures returns everything this build of qcp supports.
+func LocalFeatures() Features {
+	return Features{
+		Version:      Version,
+		MinVersion:   MinVersion,
+		Compression:  []string{CompressionZstd, CompressionGzip, CompressionNone},
+		Checksums:    []string{ChecksumSHA256},
+		Capabilities: []string{CapResume, CapErrorFrames, CapStreams, CapDelta, CapSync, CapPreserve, CapXattrs, CapSparse, CapAtomic, CapConflicts, CapResumeUpload, CapJournal, CapFilters, CapLimits, CapTotals, CapThrottle, CapFollow, CapPlan, CapTrailers, CapAnswers},
+	}
+}
+
+// LegacyFeatures returns the features of a version 1 peer, which can't tell us itself.
+func LegacyFeatures() Features {
+	return Features{
+		Version:      1,
+		MinVersion:   1,
+		Compression:  []string{CompressionGzip},
+		Checksums:    []string{},
+		Capabilities: []string{CapResume},
+	}
+}
+
+func (f Features) Has(capability string) bool {
+	return slices.Contains(f.Capabilities, capability)
+}
+
+// Without returns the features without capability, so that it isn't used.
+func (f Features) Without(capability string) Features {
+	f.Capabilities = slices.DeleteFunc(slices.Clone(f.Capabilities), func(c string) bool {
+		return c == capability
+	})
+
+	return f
+}
+
+// String serializes features as a single shell-safe word, e.g.
+// "version=2;min-version=2;compression=gzip;checksums=sha256;capabilities=resume".
+func (f Features) String() string {
+	fields := []string{
+		"version=" + strconv.Itoa(f.Version),
+		"min-version=" + strconv.Itoa(f.MinVersion),
+		"compression=" + strings.Join(f.Compression, ","),
+		"checksums=" + strings.Join(f.Checksums, ","),
+		"capabilities=" + strings.Join(f.Capabilities, ","),
+	}
+
+	if f.CompressionLevel != 0 {
+		fields = append(fields, "compression-level="+strconv.Itoa(f.CompressionLevel))
+	}
+
+	if f.Streams > 1 {
+		fields = append(fields, "stream="+strconv.Itoa(f.Stream), "streams="+strconv.Itoa(f.Streams))
+	}
+
+	return strings.Join(fields, ";")
+}
+
+func splitList(val string) []string {
+	if val == "" {
+		return []string{}
+	}
+
+	return strings.Split(val, ",")
+}
+
+// ParseFeatures is the inverse of Features.String. Unknown fields are ignored so that
+// newer peers can add to the handshake. An empty string means the peer predates the
+// handshake.
+func ParseFeatures(serialized string) (Features, error) {
+	serialized = strings.TrimSpace(serialized)
+
+	if serialized == "" {
+		return LegacyFeatures(), nil
+	}
+
+	f := Features{
+		Compression:  []string{},
+		Checksums:    []string{},
+		Capabilities: []string{},
+	}
+
+	for _, field := range strings.Split(serialized, ";") {
+		key, val, found := strings.Cut(field, "=")
+
+		if !found {
+			return f, fmt.Errorf("malformed feature %q", field)
+		}
+
+		var err error
+
+		switch key {
+		case "version":
+			f.Version, err = strconv.Atoi(val)
+		case "min-version":
+			f.MinVersion, err = strconv.Atoi(val)
+		case "compression":
+			f.Compression = splitList(val)
+		case "checksums":
+			f.Checksums = splitList(val)
+		case "capabilities":
+			f.Capabilities = splitList(val)
+		case "compression-level":
+			f.CompressionLevel, err = strconv.Atoi(val)
+		case "stream":
+			f.Stream, err = strconv.Atoi(val)
+		case "streams":
+			f.Streams, err = strconv.Atoi(val)
+		}
+
+		if err != nil {
+			return f, fmt.Errorf("parse %s: %w", key, err)
+		}
+	}
+
+	if f.Version == 0 {
+		return f, errors.New("missing protocol version")
+	}
+
+	return f, nil
+}
+
+func intersect(preferred, other []string) []string {
+	common := []string{}
+
+	for _, item := range preferred {
+		if slices.Contains(other, item) {
+			common = append(common, item)
+		}
+	}
+
+	return common
+}
+
+// Negotiate picks the features both sides support, following the local order of
+// preference. It fails if either side is too old for the other.
+func Negotiate(local, remote Features) (Features, error) {
+	if remote.Version < local.MinVersion {
+		return Features{}, fmt.Errorf("remote qcp v%d %w, run qcp sideload", remote.Version, ErrTooOld)
+	}
+
+	if local.Version < remote.MinVersion {
+		return Features{}, fmt.Errorf("local qcp v%d %w for remote qcp v%d, update qcp", local.Version, ErrTooOld, remote.Version)
+	}
+
+	compression := intersect(local.Compression, remote.Compression)
+
+	if len(compression) == 0 {
+		return Features{}, fmt.Errorf("%w: compression, local qcp supports %v but remote qcp supports %v", ErrNoCommon, local.Compression, remote.Compression)
+	}
+
+	// Checksums are optional, so there being none in common isn't an error.
+	checksums := intersect(local.Checksums, remote.Checksums)
+
+	if len(checksums) > 1 {
+		checksums = checksums[:1]
+	}
+
+	return Features{
+		Version:      min(local.Version, remote.Version),
+		MinVersion:   max(local.MinVersion, remote.MinVersion),
+		Compression:  compression,
+		Checksums:    checksums,
+		Capabilities: intersect(local.Capabilities, remote.Capabilities),
+	}, nil
+}
+
+// Accept checks the features a client negotiated before it started a server mode.
+func Accept(serialized string) (Features, error) {
+	f, err := ParseFeatures(serialized)
+
+	if err != nil {
+		return f, fmt.Errorf("parse features: %w", err)
+	}
+
+	if f.Version != 1 && f.Version < MinVersion {
+		return f, fmt.Errorf("client qcp v%d %w, update qcp", f.Version, ErrTooOld)
+	}
+
+	for _, compression := range f.Compression {
+		if !slices.Contains(LocalFeatures().Compression, compression) {
+			return f, fmt.Errorf("%w: compression %s is not supported", ErrNoCommon, compression)
+		}
+	}
+
+	if f.Streams > 1 && (f.Stream < 0 || f.Stream >= f.Streams) {
+		return f, fmt.Errorf("stream %d out of range for %d streams", f.Stream, f.Streams)
+	}
+
+	for _, checksum := range f.Checksums {
+		if !slices.Contains(LocalFeatures().Checksums, checksum) {
+			return f, fmt.Errorf("%w: checksum %s is not supported", ErrNoCommon, checksum)
+		}
+	}
+
+	return f, nil
+}
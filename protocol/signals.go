@@ -2,6 +2,7 @@ package protocol
 
 const (
 	EndTransmission = '\x04'
+	ErrorFrame      = '\x15'
 	FileSeparator   = '\x1c'
 	GroupSeparator  = '\x1d'
 	RecordSeparator = '\x1e'
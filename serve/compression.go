@@ -0,0 +1,208 @@
+package serve
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/l-donovan/qcp/protocol"
+)
+
+const (
+	// sampleFiles and sampleBytes bound how much of the input auto compression looks at.
+	sampleFiles = 32
+	sampleBytes = 1 << 20
+
+	// poorRatio is the compressed to uncompressed size ratio above which compressing
+	// isn't worth the CPU time.
+	poorRatio = 0.95
+)
+
+// compressedExtensions are formats that are already compressed.
+var compressedExtensions = map[string]bool{
+	".7z": true, ".apk": true, ".avi": true, ".br": true, ".bz2": true, ".docx": true,
+	".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true, ".jpeg": true,
+	".jpg": true, ".lz4": true, ".m4a": true, ".mkv": true, ".mov": true, ".mp3": true,
+	".mp4": true, ".ogg": true, ".png": true, ".pptx": true, ".rar": true, ".tgz": true,
+	".webm": true, ".webp": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+// archiveExtensions and archiveMimeTypes describe a compressed tarball, for when one is
+// handed over as is.
+var archiveExtensions = map[string]string{
+	protocol.CompressionGzip: ".tar.gz",
+	protocol.CompressionZstd: ".tar.zst",
+	protocol.CompressionNone: ".tar",
+}
+
+var archiveMimeTypes = map[string]string{
+	protocol.CompressionGzip: "application/gzip",
+	protocol.CompressionZstd: "application/zstd",
+	protocol.CompressionNone: "application/x-tar",
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// newCompressor wraps w in a writer for the given algorithm. Level 0 means the
+// algorithm's default.
+func newCompressor(w io.Writer, algorithm string, level int) (io.WriteCloser, error) {
+	switch algorithm {
+	case protocol.CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+
+		return gzip.NewWriterLevel(w, level)
+	case protocol.CompressionZstd:
+		encoderLevel := zstd.SpeedDefault
+
+		if level != 0 {
+			encoderLevel = zstd.EncoderLevelFromZstd(level)
+		}
+
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(encoderLevel))
+	case protocol.CompressionNone:
+		return nopWriteCloser{w}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression %s", algorithm)
+}
+
+// newDecompressor is the reading counterpart of newCompressor.
+func newDecompressor(r io.Reader, algorithm string) (io.ReadCloser, error) {
+	switch algorithm {
+	case protocol.CompressionGzip:
+		return gzip.NewReader(r)
+	case protocol.CompressionZstd:
+		decoder, err := zstd.NewReader(r)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return decoder.IOReadCloser(), nil
+	case protocol.CompressionNone:
+		return io.NopCloser(r), nil
+	}
+
+	return nil, fmt.Errorf("unsupported compression %s", algorithm)
+}
+
+// sampleFilenames returns up to sampleFiles regular files from the start of the walk
+// over filenames, leaving out what filters do.
+func sampleFilenames(filenames []string, filters Filters) []string {
+	var sample []string
+
+	for _, filename := range filenames {
+		filter, err := filters.forRoot(filename)
+
+		if err != nil {
+			break
+		}
+
+		_ = filepath.WalkDir(filename, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			info, err := d.Info()
+
+			if err != nil {
+				return nil
+			}
+
+			if excluded, err := filter.excluded(path, info); err != nil || excluded {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			if d.Type().IsRegular() {
+				sample = append(sample, path)
+			}
+
+			if len(sample) >= sampleFiles {
+				return filepath.SkipAll
+			}
+
+			return nil
+		})
+
+		if len(sample) >= sampleFiles {
+			break
+		}
+	}
+
+	return sample
+}
+
+// worthCompressing guesses whether compressing filenames with algorithm pays off. It
+// doesn't if every sampled file is of an already compressed format, or if the start of
+// the sampled files hardly compresses.
+func worthCompressing(filenames []string, filters Filters, algorithm string) bool {
+	var readers []io.Reader
+
+	for _, filename := range sampleFilenames(filenames, filters) {
+		if compressedExtensions[strings.ToLower(filepath.Ext(filename))] {
+			continue
+		}
+
+		fp, err := os.Open(filename)
+
+		if err != nil {
+			continue
+		}
+
+		defer func() {
+			_ = fp.Close()
+		}()
+
+		readers = append(readers, fp)
+	}
+
+	if len(readers) == 0 {
+		return false
+	}
+
+	counter := &countingWriter{}
+	compressor, err := newCompressor(counter, algorithm, 1)
+
+	if err != nil {
+		return false
+	}
+
+	n, err := io.Copy(compressor, io.LimitReader(io.MultiReader(readers...), sampleBytes))
+
+	if err != nil {
+		return true
+	}
+
+	if err := compressor.Close(); err != nil || n == 0 {
+		return true
+	}
+
+	return float64(counter.n)/float64(n) < poorRatio
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+
+	return len(p), nil
+}
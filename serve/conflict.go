@@ -0,0 +1,314 @@
+package serve
+
+import (
+	"archive/tar"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/l-donovan/qcp/common"
+	"github.com/l-donovan/qcp/protocol"
+)
+
+// Conflict policies decide what happens to files that already exist at the destination.
+// Without one, files that already have the right size are skipped and the rest are
+// overwritten.
+const (
+	ConflictOverwrite = "overwrite"
+	ConflictSkip      = "skip"
+	ConflictNewer     = "newer"
+	ConflictRename    = "rename"
+	ConflictFail      = "fail"
+	ConflictAsk       = "ask"
+)
+
+var ConflictPolicies = []string{ConflictOverwrite, ConflictSkip, ConflictNewer, ConflictRename, ConflictFail, ConflictAsk}
+
+var ErrConflict = errors.New("already exists")
+
+// conflicts applies a conflict policy to received entries. With ConflictAsk, the
+// policy changes for good once the user picks one for all files.
+type conflicts struct {
+	policy   string
+	prompter common.Prompter
+	progress *Progress
+}
+
+// freeName returns the first of "name (1).ext", "name (2).ext" and so on that doesn't
+// exist yet.
+func freeName(filePath string) (string, error) {
+	dir, base := filepath.Split(filePath)
+	ext := filepath.Ext(base)
+
+	// Hidden files like .bashrc don't have an extension.
+	if ext == base {
+		ext = ""
+	}
+
+	stem := strings.TrimSuffix(base, ext)
+
+	for i := 1; ; i++ {
+		candidate := filepath.Join(dir, stem+" ("+strconv.Itoa(i)+")"+ext)
+
+		if _, err := os.Lstat(candidate); errors.Is(err, fs.ErrNotExist) {
+			return candidate, nil
+		} else if err != nil {
+			return "", err
+		}
+	}
+}
+
+var conflictAnswers = map[string]string{
+	"o": ConflictOverwrite,
+	"s": ConflictSkip,
+	"n": ConflictNewer,
+	"r": ConflictRename,
+	"f": ConflictFail,
+}
+
+// ask asks the user what to do about filePath, which already exists.
+func (c *conflicts) ask(filePath string) (string, error) {
+	if c.prompter == nil {
+		return "", fmt.Errorf("ask about %s: %w", filePath, common.ErrNoPrompter)
+	}
+
+	// The question goes where the progress bar would.
+	c.progress.Clear()
+
+	question := fmt.Sprintf("%s already exists. Overwrite, skip, keep if newer, rename or fail? Capitalize to answer for every file [o/s/n/r/f] ", filePath)
+
+	for {
+		answer, err := c.prompter.Prompt(question, true)
+
+		if err != nil {
+			return "", fmt.Errorf("ask about %s: %w", filePath, err)
+		}
+
+		answer = strings.TrimSpace(answer)
+
+		if policy, ok := conflictAnswers[strings.ToLower(answer)]; ok {
+			if answer != strings.ToLower(answer) {
+				c.policy = policy
+			}
+
+			return policy, nil
+		}
+
+		question = "Please type o, s, n, r or f: "
+	}
+}
+
+// resolve returns where to receive an entry that goes to filePath, or an empty string
+// to skip it. overwrite means whatever is there is replaced even if it looks complete.
+func (c *conflicts) resolve(header *tar.Header, filePath string) (target string, overwrite bool, err error) {
+	if c.policy == "" || header.Typeflag == tar.TypeDir {
+		return filePath, false, nil
+	}
+
+	// Resumed files and chunks go into files that exist on purpose.
+	if _, ok := header.PAXRecords[protocol.PAXOffset]; ok {
+		return filePath, false, nil
+	}
+
+	info, err := os.Lstat(filePath)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return filePath, false, nil
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	// Directories in the way are left to fail as they always have.
+	if info.IsDir() {
+		return filePath, false, nil
+	}
+
+	policy := c.policy
+
+	// Senders that ask the user themselves send the answer along.
+	if answer, ok := header.PAXRecords[protocol.PAXConflict]; ok && policy == ConflictAsk {
+		if !slices.Contains(ConflictPolicies, answer) || answer == ConflictAsk {
+			return "", false, fmt.Errorf("unknown conflict policy %s", answer)
+		}
+
+		policy = answer
+	} else if policy == ConflictAsk {
+		policy, err = c.ask(filePath)
+
+		if err != nil {
+			return "", false, err
+		}
+	}
+
+	switch policy {
+	case ConflictOverwrite:
+		return filePath, true, nil
+	case ConflictNewer:
+		// Times in the tarball are whole seconds.
+		if header.ModTime.After(info.ModTime().Round(time.Second)) {
+			return filePath, true, nil
+		}
+
+		c.progress.Printf("Skipping %s, which isn't older than the remote file\n", filePath)
+	case ConflictRename:
+		renamed, err := freeName(filePath)
+
+		return renamed, false, err
+	case ConflictFail:
+		return "", false, fmt.Errorf("%w: %s", ErrConflict, filePath)
+	default:
+		c.progress.Printf("Skipping %s, which already exists\n", filePath)
+	}
+
+	return "", false, nil
+}
+
+// answerConflict asks the user what to do about the entry in header if it already
+// exists at the destination, see UploadInfo.Existing, and sends the answer along for the
+// receiver to act on. It returns false if the entry is to be skipped instead.
+func (u *UploadInfo) answerConflict(header *tar.Header) (bool, error) {
+	if u.OnConflict != ConflictAsk || !u.Existing[header.Name] || header.Typeflag == tar.TypeDir {
+		return true, nil
+	}
+
+	if u.conflicts == nil {
+		u.conflicts = &conflicts{policy: u.OnConflict, prompter: u.Prompter, progress: u.Progress}
+	}
+
+	policy := u.conflicts.policy
+
+	if policy == ConflictAsk {
+		var err error
+
+		if policy, err = u.conflicts.ask(header.Name); err != nil {
+			return false, err
+		}
+	}
+
+	// Skipped files aren't worth sending.
+	if policy == ConflictSkip {
+		u.Progress.Printf("Skipping %s, which already exists\n", header.Name)
+		return false, nil
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = map[string]string{}
+	}
+
+	header.PAXRecords[protocol.PAXConflict] = policy
+
+	return true, nil
+}
+
+// ExistingFiles lists what isn't a directory under root/name for each of names, by
+// its path in the tarball.
+func ExistingFiles(root string, names []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+
+	for _, name := range names {
+		if !filepath.IsLocal(filepath.FromSlash(name)) {
+			return nil, fmt.Errorf("%w: %s is outside of %s", ErrUnsafePath, name, root)
+		}
+
+		localRoot := filepath.Join(root, filepath.FromSlash(name))
+
+		err := filepath.WalkDir(localRoot, func(filePath string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if d.IsDir() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(localRoot, filePath)
+
+			if err != nil {
+				return err
+			}
+
+			existing[path.Join(name, filepath.ToSlash(rel))] = true
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return existing, nil
+}
+
+// ExchangeExisting is the receiving end of an upload's conflict prelude. It reads the
+// roots of the tarball the sender is about to send from src and replies on dst with the
+// files already under root, see ExistingFiles.
+func ExchangeExisting(root string, src io.Reader, dst io.Writer) error {
+	var names []string
+
+	if err := gob.NewDecoder(src).Decode(&names); err != nil {
+		return fmt.Errorf("decode roots: %w", err)
+	}
+
+	existing, err := ExistingFiles(root, names)
+
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(dst).Encode(existing); err != nil {
+		return fmt.Errorf("encode existing files: %w", err)
+	}
+
+	return nil
+}
+
+// ReadExisting reads the files sent with ExchangeExisting.
+func ReadExisting(src io.Reader) (map[string]bool, error) {
+	var existing map[string]bool
+
+	if err := gob.NewDecoder(src).Decode(&existing); err != nil {
+		return nil, fmt.Errorf("decode existing files: %w", err)
+	}
+
+	return existing, nil
+}
+
+// ReadConflictPolicy reads a conflict policy sent ahead of a tarball.
+func ReadConflictPolicy(src io.Reader) (string, error) {
+	var policy string
+
+	if err := gob.NewDecoder(src).Decode(&policy); err != nil {
+		return "", fmt.Errorf("decode conflict policy: %w", err)
+	}
+
+	if !slices.Contains(ConflictPolicies, policy) {
+		return "", fmt.Errorf("unknown conflict policy %s", policy)
+	}
+
+	return policy, nil
+}
+
+// WriteConflictPolicy sends a conflict policy ahead of a tarball.
+func WriteConflictPolicy(dst io.Writer, policy string) error {
+	if err := gob.NewEncoder(dst).Encode(policy); err != nil {
+		return fmt.Errorf("send conflict policy: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,652 @@
+package serve
+
+import (
+	"archive/tar"
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/l-donovan/qcp/protocol"
+)
+
+const (
+	minBlockSize = 2 << 10
+	maxBlockSize = 128 << 10
+
+	// maxLiteral bounds how many unmatched bytes are buffered before they're written.
+	maxLiteral = 64 << 10
+)
+
+// Delta operations.
+const (
+	// opCopy is followed by the index of the first block to copy from the receiver's
+	// copy of the file and how many blocks to copy.
+	opCopy = 'C'
+
+	// opLiteral is followed by a length and that many bytes of the sender's file.
+	opLiteral = 'L'
+)
+
+// BlockSignature identifies a block of a file by a cheap rolling checksum and a strong
+// one to confirm matches with.
+type BlockSignature struct {
+	Weak   uint32
+	Strong [16]byte
+}
+
+// FileSignature describes the receiver's copy of a file, so that the sender can send
+// just what's different.
+type FileSignature struct {
+	Size      int64
+	BlockSize int
+	Blocks    []BlockSignature
+}
+
+// Signatures are keyed by path in the tarball.
+type Signatures map[string]FileSignature
+
+// ArchiveRoot returns the path a source is given in the tarball, which the paths of
+// everything under it start with.
+func ArchiveRoot(srcFilePath string) string {
+	return getArchivePath(srcFilePath, path.Dir(srcFilePath))
+}
+
+// blockSize picks a block size of about the square root of the file size, like rsync.
+func blockSize(size int64) int {
+	blockSize := int(math.Sqrt(float64(size)))
+	blockSize = (blockSize + 63) &^ 63
+
+	return min(max(blockSize, minBlockSize), maxBlockSize)
+}
+
+// weakChecksum is the rolling checksum of rsync. a is the sum of the bytes and b the
+// sum of the bytes weighted by their distance from the end of the block.
+func weakChecksum(block []byte) (uint32, uint32) {
+	var a, b uint32
+
+	for i, c := range block {
+		a += uint32(c)
+		b += uint32(len(block)-i) * uint32(c)
+	}
+
+	return a & 0xffff, b & 0xffff
+}
+
+// roll moves the weak checksum of a window of length bytes along by a byte, dropping out
+// from its start and taking in next at its end.
+func roll(a, b uint32, length int, out, next byte) (uint32, uint32) {
+	a = (a - uint32(out) + uint32(next)) & 0xffff
+	b = (b - uint32(length)*uint32(out) + a) & 0xffff
+
+	return a, b
+}
+
+// shrink drops out from the start of a window of length bytes, for the end of a file.
+func shrink(a, b uint32, length int, out byte) (uint32, uint32) {
+	a = (a - uint32(out)) & 0xffff
+	b = (b - uint32(length)*uint32(out)) & 0xffff
+
+	return a, b
+}
+
+func strongChecksum(block []byte) [16]byte {
+	var strong [16]byte
+	sum := sha256.Sum256(block)
+	copy(strong[:], sum[:])
+
+	return strong
+}
+
+func fileSignature(filePath string) (FileSignature, error) {
+	fp, err := os.Open(filePath)
+
+	if err != nil {
+		return FileSignature{}, err
+	}
+
+	defer func() {
+		_ = fp.Close()
+	}()
+
+	fileInfo, err := fp.Stat()
+
+	if err != nil {
+		return FileSignature{}, err
+	}
+
+	signature := FileSignature{
+		Size:      fileInfo.Size(),
+		BlockSize: blockSize(fileInfo.Size()),
+	}
+
+	block := make([]byte, signature.BlockSize)
+	reader := bufio.NewReaderSize(fp, maxBlockSize)
+
+	for {
+		n, err := io.ReadFull(reader, block)
+
+		if n > 0 {
+			a, b := weakChecksum(block[:n])
+
+			signature.Blocks = append(signature.Blocks, BlockSignature{
+				Weak:   a | b<<16,
+				Strong: strongChecksum(block[:n]),
+			})
+		}
+
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			return signature, nil
+		}
+
+		if err != nil {
+			return FileSignature{}, err
+		}
+	}
+}
+
+// ComputeSignatures signs every regular file under root/name for each of names, which
+// are roots in the tarball, as returned by ArchiveRoot. Files that don't exist yet are
+// left out.
+func ComputeSignatures(root string, names []string) (Signatures, error) {
+	signatures := Signatures{}
+
+	for _, name := range names {
+		localRoot := path.Join(root, name)
+
+		err := filepath.WalkDir(localRoot, func(filePath string, d fs.DirEntry, err error) error {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			if err != nil {
+				return err
+			}
+
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			rel, err := filepath.Rel(localRoot, filePath)
+
+			if err != nil {
+				return err
+			}
+
+			signature, err := fileSignature(filePath)
+
+			if err != nil {
+				return fmt.Errorf("sign %s: %w", filePath, err)
+			}
+
+			signatures[path.Join(name, filepath.ToSlash(rel))] = signature
+
+			return nil
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return signatures, nil
+}
+
+// deltaWriter encodes delta operations, merging runs of consecutive blocks.
+type deltaWriter struct {
+	w       *bufio.Writer
+	literal []byte
+
+	copyStart int
+	copyCount int
+	ops       int
+}
+
+func (d *deltaWriter) writeUvarints(op byte, values ...uint64) error {
+	if err := d.w.WriteByte(op); err != nil {
+		return err
+	}
+
+	for _, value := range values {
+		if _, err := d.w.Write(binary.AppendUvarint(nil, value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (d *deltaWriter) flushCopy() error {
+	if d.copyCount == 0 {
+		return nil
+	}
+
+	d.ops++
+	err := d.writeUvarints(opCopy, uint64(d.copyStart), uint64(d.copyCount))
+	d.copyCount = 0
+
+	return err
+}
+
+func (d *deltaWriter) flushLiteral() error {
+	if len(d.literal) == 0 {
+		return nil
+	}
+
+	d.ops++
+
+	if err := d.writeUvarints(opLiteral, uint64(len(d.literal))); err != nil {
+		return err
+	}
+
+	_, err := d.w.Write(d.literal)
+	d.literal = d.literal[:0]
+
+	return err
+}
+
+func (d *deltaWriter) copyBlock(index int) error {
+	if err := d.flushLiteral(); err != nil {
+		return err
+	}
+
+	if d.copyCount > 0 && d.copyStart+d.copyCount == index {
+		d.copyCount++
+		return nil
+	}
+
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+
+	d.copyStart, d.copyCount = index, 1
+
+	return nil
+}
+
+func (d *deltaWriter) addLiteral(c byte) error {
+	if err := d.flushCopy(); err != nil {
+		return err
+	}
+
+	d.literal = append(d.literal, c)
+
+	if len(d.literal) >= maxLiteral {
+		return d.flushLiteral()
+	}
+
+	return nil
+}
+
+// writeDelta encodes the difference between src and the file signature describes. It
+// reports whether src is identical to that file, in which case nothing is written.
+func writeDelta(dst io.Writer, src io.Reader, signature FileSignature) (bool, error) {
+	blocks := make(map[uint32][]int, len(signature.Blocks))
+
+	for i, block := range signature.Blocks {
+		blocks[block.Weak] = append(blocks[block.Weak], i)
+	}
+
+	d := &deltaWriter{w: bufio.NewWriter(dst)}
+	reader := bufio.NewReaderSize(src, maxBlockSize)
+
+	// Rolling bytes in moves the window off block, so it can be reused for every block
+	// that's read whole.
+	block := make([]byte, signature.BlockSize)
+	n, err := io.ReadFull(reader, block)
+
+	if err != nil && err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+		return false, err
+	}
+
+	window := block[:n]
+	eof := n < signature.BlockSize
+	a, b := weakChecksum(window)
+	var size int64
+
+	for len(window) > 0 {
+		matched := -1
+
+		for _, index := range blocks[a|b<<16] {
+			if strongChecksum(window) == signature.Blocks[index].Strong {
+				matched = index
+				break
+			}
+		}
+
+		if matched >= 0 {
+			if err := d.copyBlock(matched); err != nil {
+				return false, err
+			}
+
+			size += int64(len(window))
+			n, err := io.ReadFull(reader, block)
+
+			if err != nil && err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) {
+				return false, err
+			}
+
+			window = block[:n]
+			eof = n < signature.BlockSize
+			a, b = weakChecksum(window)
+
+			continue
+		}
+
+		out := window[0]
+
+		if err := d.addLiteral(out); err != nil {
+			return false, err
+		}
+
+		size++
+
+		// Roll the checksum forward by a byte, or just drop a byte once there's
+		// nothing left to read.
+		next, err := reader.ReadByte()
+
+		if err != nil && err != io.EOF {
+			return false, err
+		}
+
+		if eof || err == io.EOF {
+			eof = true
+			a, b = shrink(a, b, len(window), out)
+			window = window[1:]
+
+			continue
+		}
+
+		a, b = roll(a, b, len(window), out, next)
+		window = append(window[1:], next)
+	}
+
+	if err := d.flushLiteral(); err != nil {
+		return false, err
+	}
+
+	// A single run covering every block means nothing changed.
+	if d.ops == 0 && d.copyStart == 0 && d.copyCount == len(signature.Blocks) && size == signature.Size {
+		return true, nil
+	}
+
+	if err := d.flushCopy(); err != nil {
+		return false, err
+	}
+
+	return false, d.w.Flush()
+}
+
+// applyDelta writes the file a delta describes to dst, copying blocks from basis.
+func applyDelta(dst io.Writer, delta io.Reader, basis io.ReaderAt, blockSize int) error {
+	reader := bufio.NewReader(delta)
+
+	for {
+		op, err := reader.ReadByte()
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+
+		switch op {
+		case opCopy:
+			start, err := binary.ReadUvarint(reader)
+
+			if err != nil {
+				return fmt.Errorf("read copy start: %w", err)
+			}
+
+			count, err := binary.ReadUvarint(reader)
+
+			if err != nil {
+				return fmt.Errorf("read copy count: %w", err)
+			}
+
+			// The last block may be short, in which case the section ends early.
+			section := io.NewSectionReader(basis, int64(start)*int64(blockSize), int64(count)*int64(blockSize))
+
+			if _, err := io.Copy(dst, section); err != nil {
+				return fmt.Errorf("copy blocks: %w", err)
+			}
+		case opLiteral:
+			length, err := binary.ReadUvarint(reader)
+
+			if err != nil {
+				return fmt.Errorf("read literal length: %w", err)
+			}
+
+			if _, err := io.CopyN(dst, reader, int64(length)); err != nil {
+				return fmt.Errorf("copy literal: %w", err)
+			}
+		default:
+			return fmt.Errorf("unknown delta operation %q", op)
+		}
+	}
+}
+
+// addDeltaToTarArchive sends the difference between fp and the receiver's copy of it.
+// It reports false without sending anything if the delta wouldn't be smaller than the
+// file itself, in which case fp is rewound so that the file can be sent as usual.
+func (u *UploadInfo) addDeltaToTarArchive(tarWriter *tar.Writer, fp *os.File, fileInfo fs.FileInfo, archivePath string, signature FileSignature) (bool, error) {
+	tmp, err := os.CreateTemp("", "qcp-delta-*")
+
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	var src io.Reader = fp
+	var h hash.Hash
+
+	if u.Checksum != "" {
+		h = protocol.NewHash(u.Checksum)
+		src = io.TeeReader(fp, h)
+	}
+
+	unchanged, err := writeDelta(tmp, src, signature)
+
+	if err != nil {
+		return false, err
+	}
+
+	deltaSize, err := tmp.Seek(0, io.SeekCurrent)
+
+	if err != nil {
+		return false, err
+	}
+
+	if !unchanged && deltaSize >= fileInfo.Size() {
+		_, err := fp.Seek(0, io.SeekStart)
+		return false, err
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return false, err
+	}
+
+	header, err := tar.FileInfoHeader(fileInfo, archivePath)
+
+	if err != nil {
+		return false, err
+	}
+
+	// An unchanged file is sent as an empty delta. Nothing else can be, since a delta
+	// is only sent if it's smaller than the file.
+	header.Name = archivePath
+	header.Size = deltaSize
+	header.PAXRecords = map[string]string{
+		protocol.PAXDelta: strconv.Itoa(signature.BlockSize),
+	}
+
+	if h != nil {
+		header.PAXRecords[protocol.PAXChecksumPrefix+u.Checksum] = hex.EncodeToString(h.Sum(nil))
+	}
+
+	u.addXattrs(header, fp.Name())
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return false, err
+	}
+
+	u.Progress.File(archivePath)
+
+	if _, err := io.Copy(u.Progress.writer(tarWriter), tmp); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// receiveDelta rebuilds a file from a delta against the existing copy. The new file is
+// written next to it and then renamed over it.
+func receiveDelta(header *tar.Header, filePath string, src io.Reader, verify bool, progress *Progress) error {
+	blockSize, err := strconv.Atoi(header.PAXRecords[protocol.PAXDelta])
+
+	if err != nil || blockSize <= 0 {
+		return fmt.Errorf("parse block size of %s: %q", filePath, header.PAXRecords[protocol.PAXDelta])
+	}
+
+	basis, err := os.Open(filePath)
+
+	if err != nil {
+		return fmt.Errorf("open %s: %w", filePath, err)
+	}
+
+	defer func() {
+		_ = basis.Close()
+	}()
+
+	algorithm, expected := expectedDigest(header)
+
+	var h hash.Hash
+
+	if algorithm != "" {
+		h = protocol.NewHash(algorithm)
+	}
+
+	if header.Size == 0 {
+		progress.Printf("Unchanged %s\n", filePath)
+
+		// Every block matched by checksum already, so rehashing is left to --verify.
+		if h != nil && verify {
+			if _, err := io.Copy(h, basis); err != nil {
+				return fmt.Errorf("hash %s: %w", filePath, err)
+			}
+
+			if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+				return fmt.Errorf("%w: %s has %s %s but the remote file has %s", protocol.ErrChecksumMismatch, filePath, algorithm, actual, expected)
+			}
+		}
+
+		return basis.Chmod(header.FileInfo().Mode())
+	}
+
+	progress.Printf("Receiving %s (delta)\n", filePath)
+
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "."+filepath.Base(filePath)+".qcp-delta-*")
+
+	if err != nil {
+		return fmt.Errorf("create temporary file for %s: %w", filePath, err)
+	}
+
+	defer func() {
+		// Once renamed, there's nothing left to remove.
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+	}()
+
+	var dest io.Writer = tmp
+
+	if h != nil {
+		dest = io.MultiWriter(tmp, h)
+	}
+
+	writer := bufio.NewWriter(dest)
+
+	if err := applyDelta(writer, src, basis, blockSize); err != nil {
+		return fmt.Errorf("apply delta to %s: %w", filePath, err)
+	}
+
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("write %s: %w", filePath, err)
+	}
+
+	if h != nil {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return fmt.Errorf("%w: %s has %s %s but the remote file has %s", protocol.ErrChecksumMismatch, filePath, algorithm, actual, expected)
+		}
+	}
+
+	if err := tmp.Chmod(header.FileInfo().Mode()); err != nil {
+		return fmt.Errorf("change filemode: %w", err)
+	}
+
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", tmp.Name(), err)
+	}
+
+	if err := os.Rename(tmp.Name(), filePath); err != nil {
+		return fmt.Errorf("rename %s: %w", tmp.Name(), err)
+	}
+
+	return nil
+}
+
+// ReadSignatures reads the signatures a receiver sent with WriteSignatures.
+func ReadSignatures(src io.Reader) (Signatures, error) {
+	var signatures Signatures
+
+	if err := gob.NewDecoder(src).Decode(&signatures); err != nil {
+		return nil, fmt.Errorf("decode signatures: %w", err)
+	}
+
+	return signatures, nil
+}
+
+// WriteSignatures signs the files under root/name for each of names and sends the
+// signatures to the sender.
+func WriteSignatures(dst io.Writer, root string, names []string) error {
+	signatures, err := ComputeSignatures(root, names)
+
+	if err != nil {
+		return err
+	}
+
+	if err := gob.NewEncoder(dst).Encode(signatures); err != nil {
+		return fmt.Errorf("encode signatures: %w", err)
+	}
+
+	return nil
+}
+
+// ExchangeSignatures is the receiving end of an upload's delta prelude. It reads the
+// roots of the tarball the sender is about to send from src and replies on dst with
+// signatures of the files under root.
+func ExchangeSignatures(root string, src io.Reader, dst io.Writer) error {
+	var names []string
+
+	if err := gob.NewDecoder(src).Decode(&names); err != nil {
+		return fmt.Errorf("decode roots: %w", err)
+	}
+
+	return WriteSignatures(dst, root, names)
+}
@@ -0,0 +1,115 @@
+package serve
+
+import (
+	"bytes"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+
+	return data
+}
+
+func TestRollingChecksum(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   []byte
+		window int
+	}{
+		{"single byte", randomBytes(1, 100), 1},
+		{"short window", randomBytes(2, 100), 3},
+		{"block", randomBytes(3, 10000), minBlockSize},
+		{"whole data", randomBytes(4, 64), 64},
+		{"zeros", make([]byte, 5000), 512},
+		{"overflowing sums", bytes.Repeat([]byte{0xff}, 5000), 4096},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, b := weakChecksum(tt.data[:tt.window])
+
+			for start := 1; start+tt.window <= len(tt.data); start++ {
+				a, b = roll(a, b, tt.window, tt.data[start-1], tt.data[start+tt.window-1])
+				wantA, wantB := weakChecksum(tt.data[start : start+tt.window])
+
+				if a != wantA || b != wantB {
+					t.Fatalf("rolled to %d: got (%d, %d), want (%d, %d)", start, a, b, wantA, wantB)
+				}
+			}
+
+			// The window shrinks once the data runs out.
+			for start := len(tt.data) - tt.window + 1; start < len(tt.data); start++ {
+				a, b = shrink(a, b, len(tt.data)-start+1, tt.data[start-1])
+				wantA, wantB := weakChecksum(tt.data[start:])
+
+				if a != wantA || b != wantB {
+					t.Fatalf("shrunk to %d: got (%d, %d), want (%d, %d)", start, a, b, wantA, wantB)
+				}
+			}
+		})
+	}
+}
+
+func TestDeltaRoundTrip(t *testing.T) {
+	basis := randomBytes(5, 50000)
+
+	tests := []struct {
+		name      string
+		target    []byte
+		unchanged bool
+	}{
+		{"unchanged", basis, true},
+		{"empty", nil, false},
+		{"appended", append(bytes.Clone(basis), randomBytes(6, 3000)...), false},
+		{"truncated", basis[:31000], false},
+		{"inserted", append(append(bytes.Clone(basis[:10001]), "inserted"...), basis[10001:]...), false},
+		{"removed", append(bytes.Clone(basis[:7000]), basis[7100:]...), false},
+		{"different", randomBytes(7, 50000), false},
+	}
+
+	basisPath := filepath.Join(t.TempDir(), "basis")
+
+	if err := os.WriteFile(basisPath, basis, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	signature, err := fileSignature(basisPath)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var delta bytes.Buffer
+			unchanged, err := writeDelta(&delta, bytes.NewReader(tt.target), signature)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if unchanged != tt.unchanged {
+				t.Fatalf("got unchanged %t, want %t", unchanged, tt.unchanged)
+			}
+
+			if unchanged {
+				return
+			}
+
+			var result bytes.Buffer
+
+			if err := applyDelta(&result, &delta, bytes.NewReader(basis), signature.BlockSize); err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(result.Bytes(), tt.target) {
+				t.Fatalf("got %d bytes that differ from the %d wanted", result.Len(), len(tt.target))
+			}
+		})
+	}
+}
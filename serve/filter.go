@@ -0,0 +1,455 @@
+package serve
+
+import (
+	"bufio"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filters decide which files under the sources are sent. Sources are only ever left out
+// for their size or age, and everything under them is sent unless a filter excludes it.
+type Filters struct {
+	// Rules are patterns in .gitignore syntax, later ones taking precedence, so that a
+	// pattern starting with ! brings back what an earlier one excluded. Patterns are
+	// relative to the source they're applied to.
+	Rules []string
+
+	// Gitignore applies the .gitignore files found under the sources as well, below
+	// Rules, and leaves out .git directories.
+	Gitignore bool
+
+	// MinSize and MaxSize leave out files smaller or larger than them, unless they're 0.
+	// Directories are never too small or too large.
+	MinSize int64
+	MaxSize int64
+
+	// NewerThan and OlderThan leave out files last modified before or after them, unless
+	// they're zero. Directories are never too old or too new.
+	NewerThan TimeLimit
+	OlderThan TimeLimit
+
+	// MaxDepth leaves out what's more than MaxDepth levels below a source, unless it's 0.
+	MaxDepth int
+}
+
+// Empty reports whether the filters leave everything in.
+func (f Filters) Empty() bool {
+	return len(f.Rules) == 0 && !f.Gitignore && !f.Limited()
+}
+
+// Limited reports whether the filters limit the size, age or depth of what's sent.
+func (f Filters) Limited() bool {
+	return f.MinSize != 0 || f.MaxSize != 0 || !f.NewerThan.IsZero() || !f.OlderThan.IsZero() || f.MaxDepth != 0
+}
+
+// TimeLimit is a point in time, or an age measured back from when the files are walked
+// on the host they're on, so that its clock doesn't have to agree with the one that set
+// the limit.
+type TimeLimit struct {
+	Time time.Time
+	Age  time.Duration
+}
+
+func (l TimeLimit) IsZero() bool {
+	return l.Time.IsZero() && l.Age == 0
+}
+
+func (l TimeLimit) at(now time.Time) time.Time {
+	if l.Age != 0 {
+		return now.Add(-l.Age)
+	}
+
+	return l.Time
+}
+
+var timeLayouts = []string{time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// ParseTimeLimit parses an age like 90s, 2h30m, 3d or 2w, or a time like 2024-05-01,
+// 2024-05-01 12:00 or an RFC 3339 timestamp, in the local time zone unless it says
+// otherwise.
+func ParseTimeLimit(s string) (TimeLimit, error) {
+	for _, layout := range timeLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return TimeLimit{Time: t}, nil
+		}
+	}
+
+	// Days and weeks aren't durations Go knows.
+	for suffix, unit := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour} {
+		if !strings.HasSuffix(s, suffix) {
+			continue
+		}
+
+		if n, err := strconv.ParseFloat(strings.TrimSuffix(s, suffix), 64); err == nil && n > 0 {
+			return TimeLimit{Age: time.Duration(n * float64(unit))}, nil
+		}
+	}
+
+	if age, err := time.ParseDuration(s); err == nil && age > 0 {
+		return TimeLimit{Age: age}, nil
+	}
+
+	return TimeLimit{}, fmt.Errorf("invalid time or age %s", s)
+}
+
+// Exclude adds rules that leave out what matches patterns, which are never taken for
+// comments or negated.
+func (f *Filters) Exclude(patterns ...string) {
+	for _, pattern := range patterns {
+		if strings.HasPrefix(pattern, "#") || strings.HasPrefix(pattern, "!") {
+			pattern = `\` + pattern
+		}
+
+		f.Rules = append(f.Rules, pattern)
+	}
+}
+
+// Include adds rules that bring back what matches patterns.
+func (f *Filters) Include(patterns ...string) {
+	for _, pattern := range patterns {
+		f.Rules = append(f.Rules, "!"+pattern)
+	}
+}
+
+// SplitPatterns splits a comma separated list of patterns, expanding brace sets. Commas
+// inside brace sets don't separate patterns.
+func SplitPatterns(list string) []string {
+	var patterns []string
+
+	add := func(pattern string) {
+		if pattern = strings.TrimSpace(pattern); pattern != "" {
+			patterns = append(patterns, expandBraces(pattern)...)
+		}
+	}
+
+	depth, from := 0, 0
+
+	for i := 0; i < len(list); i++ {
+		switch list[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth = max(depth-1, 0)
+		case ',':
+			if depth == 0 {
+				add(list[from:i])
+				from = i + 1
+			}
+		}
+	}
+
+	add(list[from:])
+
+	return patterns
+}
+
+// ReadFilterRules reads the rules in the file at filePath, one per line, as in a
+// .gitignore file.
+func ReadFilterRules(filePath string) ([]string, error) {
+	fp, err := os.Open(filePath)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = fp.Close()
+	}()
+
+	var rules []string
+	scanner := bufio.NewScanner(fp)
+
+	for scanner.Scan() {
+		rules = append(rules, scanner.Text())
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", filePath, err)
+	}
+
+	return rules, nil
+}
+
+// WriteFilters sends filters to the side that walks the sources.
+func WriteFilters(dst io.Writer, filters Filters) error {
+	if err := gob.NewEncoder(dst).Encode(filters); err != nil {
+		return fmt.Errorf("encode filters: %w", err)
+	}
+
+	return nil
+}
+
+// ReadFilters reads filters sent with WriteFilters.
+func ReadFilters(src io.Reader) (Filters, error) {
+	var filters Filters
+
+	if err := gob.NewDecoder(src).Decode(&filters); err != nil {
+		return filters, fmt.Errorf("decode filters: %w", err)
+	}
+
+	if _, err := compileRules(filters.Rules); err != nil {
+		return filters, err
+	}
+
+	return filters, nil
+}
+
+// rule is a compiled filter pattern. parts are the components of the path it matches,
+// relative to where the rule applies, any of which may be **.
+type rule struct {
+	parts   []string
+	negate  bool
+	dirOnly bool
+}
+
+// compileRule compiles a line of a .gitignore file. Blank lines and comments compile to
+// nil.
+func compileRule(line string) (*rule, error) {
+	line = strings.TrimRight(line, " \t\r")
+
+	if line == "" || strings.HasPrefix(line, "#") {
+		return nil, nil
+	}
+
+	var r rule
+	pattern := line
+
+	if strings.HasPrefix(line, "!") {
+		r.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\!`) || strings.HasPrefix(line, `\#`) {
+		line = line[1:]
+	}
+
+	if strings.HasSuffix(line, "/") {
+		r.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+
+	// Patterns without a slash match at any depth, the rest from where the rule applies.
+	if !strings.Contains(line, "/") {
+		line = "**/" + line
+	}
+
+	for _, part := range strings.Split(strings.TrimPrefix(line, "/"), "/") {
+		if part == "" {
+			continue
+		}
+
+		part = strings.ReplaceAll(part, "[!", "[^")
+
+		if _, err := path.Match(part, ""); err != nil {
+			return nil, fmt.Errorf("bad filter %s: %w", pattern, err)
+		}
+
+		r.parts = append(r.parts, part)
+	}
+
+	if len(r.parts) == 0 {
+		return nil, nil
+	}
+
+	return &r, nil
+}
+
+func compileRules(lines []string) ([]rule, error) {
+	var rules []rule
+
+	for _, line := range lines {
+		r, err := compileRule(line)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if r != nil {
+			rules = append(rules, *r)
+		}
+	}
+
+	return rules, nil
+}
+
+func matchParts(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchParts(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(name) == 0 {
+		return false
+	}
+
+	matched, _ := path.Match(pattern[0], name[0])
+
+	return matched && matchParts(pattern[1:], name[1:])
+}
+
+// decide returns whether the last of rules to match name excludes it, and whether any
+// matched at all.
+func decide(rules []rule, name []string, isDir bool) (excluded bool, matched bool) {
+	for i := len(rules) - 1; i >= 0; i-- {
+		r := rules[i]
+
+		if (isDir || !r.dirOnly) && matchParts(r.parts, name) {
+			return !r.negate, true
+		}
+	}
+
+	return false, false
+}
+
+// filter applies Filters while walking one source. Directories are checked before what's
+// in them, and what's in an excluded directory is never looked at, so it can't be
+// brought back by a rule.
+type filter struct {
+	Filters
+
+	root  string
+	rules []rule
+
+	// newerThan and olderThan are the time limits as of when the walk started.
+	newerThan time.Time
+	olderThan time.Time
+
+	// ignores holds the rules of the .gitignore files found so far, by the directory
+	// they're in, relative to root.
+	ignores map[string][]rule
+}
+
+// forRoot returns the filter for walking root, or nil if there's nothing to filter.
+func (f Filters) forRoot(root string) (*filter, error) {
+	if f.Empty() {
+		return nil, nil
+	}
+
+	rules, err := compileRules(f.Rules)
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+
+	return &filter{
+		Filters:   f,
+		root:      root,
+		rules:     rules,
+		newerThan: f.NewerThan.at(now),
+		olderThan: f.OlderThan.at(now),
+		ignores:   map[string][]rule{},
+	}, nil
+}
+
+// outsideLimits reports whether a file is too small, too large, too old or too new.
+func (f *filter) outsideLimits(info fs.FileInfo) bool {
+	if info.IsDir() {
+		return false
+	}
+
+	if info.Size() < f.MinSize || (f.MaxSize != 0 && info.Size() > f.MaxSize) {
+		return true
+	}
+
+	if !f.newerThan.IsZero() && info.ModTime().Before(f.newerThan) {
+		return true
+	}
+
+	return !f.olderThan.IsZero() && !info.ModTime().Before(f.olderThan)
+}
+
+// ignored reports whether the .gitignore files found so far leave out name. The closest
+// one with a say in it wins.
+func (f *filter) ignored(name []string, isDir bool) bool {
+	if name[len(name)-1] == ".git" {
+		return true
+	}
+
+	for depth := len(name) - 1; depth >= 0; depth-- {
+		if excluded, matched := decide(f.ignores[strings.Join(name[:depth], "/")], name[depth:], isDir); matched {
+			return excluded
+		}
+	}
+
+	return false
+}
+
+// excluded reports whether filePath, which is under the root of the filter, is left out.
+func (f *filter) excluded(filePath string, info fs.FileInfo) (bool, error) {
+	if f == nil {
+		return false, nil
+	}
+
+	if f.outsideLimits(info) {
+		return true, nil
+	}
+
+	isDir := info.IsDir()
+
+	rel, err := filepath.Rel(f.root, filePath)
+
+	if err != nil {
+		return false, err
+	}
+
+	var name []string
+
+	if rel != "." {
+		name = strings.Split(filepath.ToSlash(rel), "/")
+
+		if f.MaxDepth != 0 && len(name) > f.MaxDepth {
+			return true, nil
+		}
+
+		excluded, matched := decide(f.rules, name, isDir)
+
+		if !matched && f.Gitignore {
+			excluded = f.ignored(name, isDir)
+		}
+
+		if excluded {
+			return true, nil
+		}
+	}
+
+	if !isDir || !f.Gitignore {
+		return false, nil
+	}
+
+	lines, err := ReadFilterRules(filepath.Join(filePath, ".gitignore"))
+
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	// Bad patterns in .gitignore files are ignored, as git does.
+	dir := strings.Join(name, "/")
+
+	for _, line := range lines {
+		if r, err := compileRule(line); err == nil && r != nil {
+			f.ignores[dir] = append(f.ignores[dir], *r)
+		}
+	}
+
+	return false, nil
+}
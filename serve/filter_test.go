@@ -0,0 +1,91 @@
+package serve
+
+import (
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestSplitPatterns(t *testing.T) {
+	tests := []struct {
+		list string
+		want []string
+	}{
+		{"", nil},
+		{"*.log", []string{"*.log"}},
+		{"*.log, build/ ,,tmp", []string{"*.log", "build/", "tmp"}},
+		{"*.{log,tmp},cache", []string{"*.log", "*.tmp", "cache"}},
+		{`a\,b,c`, []string{`a\,b`, "c"}},
+		{"{a,{b,c}}", []string{"a", "b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.list, func(t *testing.T) {
+			if got := SplitPatterns(tt.list); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecide(t *testing.T) {
+	tests := []struct {
+		name     string
+		rules    []string
+		path     string
+		isDir    bool
+		excluded bool
+		matched  bool
+	}{
+		{"no rules", nil, "a.log", false, false, false},
+		{"any depth", []string{"*.log"}, "dir/sub/a.log", false, true, true},
+		{"no match", []string{"*.log"}, "a.txt", false, false, false},
+		{"anchored", []string{"/a.log"}, "dir/a.log", false, false, false},
+		{"anchored at root", []string{"/a.log"}, "a.log", false, true, true},
+		{"with slash", []string{"dir/a.log"}, "dir/a.log", false, true, true},
+		{"with slash not deeper", []string{"dir/a.log"}, "x/dir/a.log", false, false, false},
+		{"double star", []string{"dir/**/a.log"}, "dir/x/y/a.log", false, true, true},
+		{"double star matching nothing", []string{"dir/**/a.log"}, "dir/a.log", false, true, true},
+		{"directory only on a file", []string{"build/"}, "build", false, false, false},
+		{"directory only", []string{"build/"}, "src/build", true, true, true},
+		{"negated", []string{"*.log", "!keep.log"}, "keep.log", false, false, true},
+		{"later rule wins", []string{"!keep.log", "*.log"}, "keep.log", false, true, true},
+		{"negated class", []string{"[!a]*"}, "b", false, true, true},
+		{"escaped bang", []string{`\!important`}, "!important", false, true, true},
+		{"escaped hash", []string{`\#notes`}, "#notes", false, true, true},
+		{"comment", []string{"# a.log"}, "# a.log", false, false, false},
+		{"trailing spaces", []string{"a.log  "}, "a.log", false, true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := compileRules(tt.rules)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			excluded, matched := decide(rules, strings.Split(tt.path, "/"), tt.isDir)
+
+			if excluded != tt.excluded || matched != tt.matched {
+				t.Fatalf("got excluded %t, matched %t, want %t, %t", excluded, matched, tt.excluded, tt.matched)
+			}
+		})
+	}
+}
+
+func TestExclude(t *testing.T) {
+	var filters Filters
+	filters.Exclude("#notes", "!important", "*.log")
+	filters.Include("keep.log")
+
+	want := []string{`\#notes`, `\!important`, "*.log", "!keep.log"}
+
+	if !slices.Equal(filters.Rules, want) {
+		t.Fatalf("got %q, want %q", filters.Rules, want)
+	}
+
+	if _, err := compileRules([]string{"[bad"}); err == nil {
+		t.Fatal("compiled a bad pattern")
+	}
+}
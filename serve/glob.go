@@ -0,0 +1,259 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+var ErrNoMatches = errors.New("no matches")
+
+// hasMeta reports whether pattern has any of the characters that make it a pattern.
+func hasMeta(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[{")
+}
+
+// braceSet finds the brace set that opens at start, returning where it closes and where
+// its alternatives are separated. Sets without a comma aren't sets, as in shells.
+func braceSet(pattern string, start int) (end int, commas []int, ok bool) {
+	depth := 0
+
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				commas = append(commas, i)
+			}
+		case '}':
+			depth--
+
+			if depth == 0 {
+				return i, commas, len(commas) > 0
+			}
+		}
+	}
+
+	return 0, nil, false
+}
+
+// expandBraces expands the brace sets in pattern, so that "a{b,c{d,e}}f" gives "abf",
+// "acdf" and "acef". Braces that don't make a set are left as they are.
+func expandBraces(pattern string) []string {
+	for start := 0; start < len(pattern); start++ {
+		if pattern[start] == '\\' {
+			start++
+			continue
+		}
+
+		if pattern[start] != '{' {
+			continue
+		}
+
+		end, commas, ok := braceSet(pattern, start)
+
+		if !ok {
+			continue
+		}
+
+		var expanded []string
+		from := start + 1
+
+		for _, to := range append(commas, end) {
+			expanded = append(expanded, expandBraces(pattern[:start]+pattern[from:to]+pattern[end+1:])...)
+			from = to + 1
+		}
+
+		return expanded
+	}
+
+	return []string{pattern}
+}
+
+// matchName matches a name in a directory against one component of a pattern. Like in
+// shells, [!...] negates a class and wildcards don't match a leading dot.
+func matchName(part, name string) (bool, error) {
+	if strings.HasPrefix(name, ".") && !strings.HasPrefix(part, ".") {
+		return false, nil
+	}
+
+	matched, err := filepath.Match(strings.ReplaceAll(part, "[!", "[^"), name)
+
+	if err != nil {
+		return false, fmt.Errorf("bad pattern %s: %w", part, err)
+	}
+
+	return matched, nil
+}
+
+// globParts adds what matches the components of a pattern in parts under dir to
+// matches. Directories that can't be read have no matches, as in shells.
+func globParts(dir string, parts []string, matches *[]string) error {
+	if len(parts) == 0 {
+		*matches = append(*matches, dir)
+		return nil
+	}
+
+	part, rest := parts[0], parts[1:]
+
+	if !hasMeta(part) {
+		next := filepath.Join(dir, part)
+
+		if _, err := os.Lstat(next); err != nil {
+			return nil
+		}
+
+		return globParts(next, rest, matches)
+	}
+
+	entries, err := os.ReadDir(dir)
+
+	if err != nil {
+		return nil
+	}
+
+	// **/ matches dir and every directory below it, without following symbolic links. At
+	// the end of a pattern, ** is the same as *.
+	if part == "**" && len(rest) > 0 {
+		if err := globParts(dir, rest, matches); err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() && !strings.HasPrefix(entry.Name(), ".") {
+				if err := globParts(filepath.Join(dir, entry.Name()), parts, matches); err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	}
+
+	for _, entry := range entries {
+		matched, err := matchName(part, entry.Name())
+
+		if err != nil {
+			return err
+		}
+
+		if matched {
+			if err := globParts(filepath.Join(dir, entry.Name()), rest, matches); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Glob returns the paths that match pattern, sorted. Besides what filepath.Match
+// understands, patterns may have brace sets like {a,b} and **/ to match any number of
+// directories.
+func Glob(pattern string) ([]string, error) {
+	var matches []string
+
+	for _, p := range expandBraces(pattern) {
+		dir := "."
+
+		if filepath.IsAbs(p) {
+			dir = string(filepath.Separator)
+		}
+
+		parts := strings.FieldsFunc(p, func(r rune) bool {
+			return r == filepath.Separator
+		})
+
+		if err := globParts(dir, parts, &matches); err != nil {
+			return nil, err
+		}
+	}
+
+	slices.Sort(matches)
+
+	return slices.Compact(matches), nil
+}
+
+// ExpandSources replaces the patterns among sources with the paths they match. Sources
+// that exist as they are aren't taken for patterns.
+func ExpandSources(sources []string) ([]string, error) {
+	var expanded []string
+
+	for _, source := range sources {
+		if !hasMeta(source) {
+			expanded = append(expanded, source)
+			continue
+		}
+
+		if _, err := os.Lstat(source); err == nil {
+			expanded = append(expanded, source)
+			continue
+		}
+
+		matches, err := Glob(source)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("%w for %s", ErrNoMatches, source)
+		}
+
+		expanded = append(expanded, matches...)
+	}
+
+	return expanded, nil
+}
+
+// ArchiveRoots is ArchiveRoot for sources that may be patterns, which the receiver can
+// only guess the roots of from what it has under root. Each match is a root of its own,
+// named after the last component of the pattern.
+func ArchiveRoots(root, source string) ([]string, error) {
+	if !hasMeta(source) {
+		return []string{ArchiveRoot(source)}, nil
+	}
+
+	var names []string
+
+	for _, p := range expandBraces(source) {
+		name := ArchiveRoot(p)
+
+		if !hasMeta(name) {
+			names = append(names, name)
+			continue
+		}
+
+		if name == "**" {
+			name = "*"
+		}
+
+		entries, err := os.ReadDir(filepath.Join(root, "."))
+
+		if err != nil {
+			continue
+		}
+
+		for _, entry := range entries {
+			matched, err := matchName(name, entry.Name())
+
+			if err != nil {
+				return nil, err
+			}
+
+			if matched {
+				names = append(names, entry.Name())
+			}
+		}
+	}
+
+	slices.Sort(names)
+
+	return slices.Compact(names), nil
+}
@@ -0,0 +1,66 @@
+package serve
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestExpandBraces(t *testing.T) {
+	tests := []struct {
+		pattern string
+		want    []string
+	}{
+		{"plain", []string{"plain"}},
+		{"*.{go,md}", []string{"*.go", "*.md"}},
+		{"a{b,c{d,e}}f", []string{"abf", "acdf", "acef"}},
+		{"{a,b}{c,d}", []string{"ac", "ad", "bc", "bd"}},
+		{"x{,y}", []string{"x", "xy"}},
+		{"{single}", []string{"{single}"}},
+		{"{unclosed,set", []string{"{unclosed,set"}},
+		{`\{a,b}`, []string{`\{a,b}`}},
+		{`{a\,b,c}`, []string{`a\,b`, "c"}},
+		{"{}{a,b}", []string{"{}a", "{}b"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern, func(t *testing.T) {
+			if got := expandBraces(tt.pattern); !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchName(t *testing.T) {
+	tests := []struct {
+		part  string
+		name  string
+		want  bool
+		isErr bool
+	}{
+		{"*.go", "main.go", true, false},
+		{"*.go", "main.md", false, false},
+		{"?", "a", true, false},
+		{"*", ".hidden", false, false},
+		{"?hidden", ".hidden", false, false},
+		{".*", ".hidden", true, false},
+		{"[ab]*", "bar", true, false},
+		{"[!ab]*", "bar", false, false},
+		{"[!ab]*", "car", true, false},
+		{"[", "x", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.part+" "+tt.name, func(t *testing.T) {
+			got, err := matchName(tt.part, tt.name)
+
+			if (err != nil) != tt.isErr {
+				t.Fatalf("got error %v, want one: %t", err, tt.isErr)
+			}
+
+			if got != tt.want {
+				t.Fatalf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package serve
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/l-donovan/qcp/protocol"
+)
+
+// ManifestEntry describes a file or directory under the root of a manifest.
+type ManifestEntry struct {
+	// Path is relative to the root and separated by slashes, as in the tarball.
+	Path string
+	Mode fs.FileMode
+	Size int64
+
+	// ModTime is rounded to seconds, like tar.Writer does unless told otherwise.
+	ModTime int64
+
+	// Digest is the hex checksum of a regular file, if the manifest was built with one.
+	Digest string
+}
+
+// Manifest lists everything under a directory, parents before their contents.
+type Manifest []ManifestEntry
+
+// BuildManifest lists the files and directories under root that filters leave in,
+// checksumming files if checksum names an algorithm. Like Serve with Dereference, it
+// follows symbolic links.
+func BuildManifest(root string, checksum string, filters Filters) (Manifest, error) {
+	rootInfo, err := os.Stat(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !rootInfo.IsDir() {
+		return nil, &fs.PathError{Op: "list", Path: root, Err: protocol.ErrNotDirectory}
+	}
+
+	filter, err := filters.forRoot(root)
+
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := Manifest{}
+
+	err = walk(root, followAllLinks, func(filePath string, fileInfo fs.FileInfo) error {
+		excluded, err := filter.excluded(filePath, fileInfo)
+
+		if err != nil {
+			return err
+		}
+
+		if excluded {
+			return fs.SkipDir
+		}
+
+		// Links that don't lead anywhere and special files are never sent without
+		// --preserve, which sync doesn't do.
+		if filePath == root || (!fileInfo.Mode().IsRegular() && !fileInfo.IsDir()) {
+			return nil
+		}
+
+		rel, err := filepath.Rel(root, filePath)
+
+		if err != nil {
+			return err
+		}
+
+		entry := ManifestEntry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    fileInfo.Mode(),
+			Size:    fileInfo.Size(),
+			ModTime: fileInfo.ModTime().Round(time.Second).Unix(),
+		}
+
+		if !fileInfo.Mode().IsRegular() {
+			entry.Size = 0
+		}
+
+		if checksum != "" && fileInfo.Mode().IsRegular() {
+			fp, err := os.Open(filePath)
+
+			if err != nil {
+				return err
+			}
+
+			entry.Digest, err = fileDigest(fp, checksum)
+			_ = fp.Close()
+
+			if err != nil {
+				return fmt.Errorf("checksum %s: %w", filePath, err)
+			}
+		}
+
+		manifest = append(manifest, entry)
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// WriteManifest sends a manifest to the other side.
+func WriteManifest(dst io.Writer, manifest Manifest) error {
+	if err := gob.NewEncoder(dst).Encode(manifest); err != nil {
+		return fmt.Errorf("encode manifest: %w", err)
+	}
+
+	return nil
+}
+
+// ReadManifest reads a manifest sent with WriteManifest.
+func ReadManifest(src io.Reader) (Manifest, error) {
+	var manifest Manifest
+
+	if err := gob.NewDecoder(src).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// ReadPaths reads a list of paths relative to a root, as sent by a client with gob, and
+// rejects any that would escape the root.
+func ReadPaths(src io.Reader) ([]string, error) {
+	var paths []string
+
+	if err := gob.NewDecoder(src).Decode(&paths); err != nil {
+		return nil, fmt.Errorf("decode paths: %w", err)
+	}
+
+	for _, p := range paths {
+		if !filepath.IsLocal(filepath.FromSlash(p)) {
+			return nil, fmt.Errorf("path %q is outside of the root", p)
+		}
+	}
+
+	return paths, nil
+}
+
+// RemovePaths removes each of paths under root, along with anything inside them.
+func RemovePaths(root string, paths []string) error {
+	for _, p := range paths {
+		filePath, err := localPath(root, p, true)
+
+		if err != nil {
+			return fmt.Errorf("remove %s: %w", p, err)
+		}
+
+		fmt.Printf("Deleting %s\n", filePath)
+
+		if err := os.RemoveAll(filePath); err != nil {
+			return fmt.Errorf("remove %s: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+// ContentsOf returns a source path that Serve sends the contents of, rather than the
+// directory itself, so that paths in the tarball are relative to the directory.
+func ContentsOf(directory string) string {
+	return strings.TrimSuffix(directory, "/") + "/"
+}
@@ -0,0 +1,79 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var ErrUnsafePath = errors.New("unsafe path")
+
+// localPath returns where the tarball entry name goes under root. It fails if that's
+// outside of root, or if getting there means going through a symbolic link below root,
+// which an earlier entry may have planted to point elsewhere. The entry itself may only
+// be a symbolic link if linkOK is set, for entries that replace what's there or don't
+// follow it.
+func localPath(root, name string, linkOK bool) (string, error) {
+	rel := filepath.FromSlash(name)
+
+	if !filepath.IsLocal(rel) {
+		return "", fmt.Errorf("%w: %s is outside of %s", ErrUnsafePath, name, root)
+	}
+
+	rel = filepath.Clean(rel)
+
+	if rel == "." {
+		return root, nil
+	}
+
+	parts := strings.Split(rel, string(filepath.Separator))
+	current := root
+
+	for i, part := range parts {
+		current = filepath.Join(current, part)
+
+		if i == len(parts)-1 && linkOK {
+			break
+		}
+
+		info, err := os.Lstat(current)
+
+		// Nothing below a missing path exists yet either.
+		if errors.Is(err, fs.ErrNotExist) {
+			break
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		if info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: %s is a symbolic link", ErrUnsafePath, current)
+		}
+	}
+
+	return filepath.Join(root, rel), nil
+}
+
+// refuseLink fails if filePath is a symbolic link, which an earlier entry may have
+// planted to have what's written to it land elsewhere.
+func refuseLink(filePath string) error {
+	info, err := os.Lstat(filePath)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		return fmt.Errorf("%w: %s is a symbolic link", ErrUnsafePath, filePath)
+	}
+
+	return nil
+}
@@ -0,0 +1,72 @@
+package serve
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+
+	if err := os.Mkdir(filepath.Join(root, "dir"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.Symlink(outside, filepath.Join(root, "dir", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		entry  string
+		linkOK bool
+		want   string
+		err    bool
+	}{
+		{"file", "file", false, "file", false},
+		{"nested", "dir/file", false, "dir/file", false},
+		{"missing directories", "missing/deeper/file", false, "missing/deeper/file", false},
+		{"root", ".", false, "", false},
+		{"cleaned", "dir/./other/../file", false, "dir/file", false},
+		{"dot dot", "..", false, "", true},
+		{"dot dot component", "../file", false, "", true},
+		{"dot dot out of subdirectory", "dir/../../file", false, "", true},
+		{"absolute", "/etc/passwd", false, "", true},
+		{"empty", "", false, "", true},
+		{"through link", "link/file", false, "", true},
+		{"through nested link", "dir/link/file", false, "", true},
+		{"through link with linkOK", "link/file", true, "", true},
+		{"link", "link", false, "", true},
+		{"link with linkOK", "link", true, "link", false},
+		{"nested link with linkOK", "dir/link", true, "dir/link", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := localPath(root, tt.entry, tt.linkOK)
+
+			if tt.err {
+				if !errors.Is(err, ErrUnsafePath) {
+					t.Fatalf("got %q, %v, want %v", got, err, ErrUnsafePath)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if want := filepath.Join(root, tt.want); got != want {
+				t.Fatalf("got %s, want %s", got, want)
+			}
+		})
+	}
+}
@@ -2,8 +2,10 @@ package serve
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"os"
 	"path"
 	"strings"
@@ -15,6 +17,7 @@ type BrowseInfo struct {
 	Location    string
 	Source      io.Reader
 	Destination io.WriteCloser
+	Features    protocol.Features
 }
 
 func serializeDirEntry(entry os.DirEntry) (string, error) {
@@ -29,6 +32,53 @@ func serializeDirEntry(entry os.DirEntry) (string, error) {
 	return fmt.Sprintf("%s%c%d", entry.Name(), protocol.GroupSeparator, fileMode), nil
 }
 
+// listFiles serializes the entries of the current location. Entries that disappear
+// while we're listing them are left out.
+func (b BrowseInfo) listFiles() (string, error) {
+	var items []string
+	entries, err := os.ReadDir(b.Location)
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		serializedEntry, err := serializeDirEntry(entry)
+
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+
+		if err != nil {
+			return "", err
+		}
+
+		items = append(items, serializedEntry)
+	}
+
+	return strings.Join(items, string(protocol.FileSeparator)), nil
+}
+
+// enter checks that a directory can be entered before making it the current location.
+func (b *BrowseInfo) enter(entryName string) error {
+	newLocation := path.Join(b.Location, entryName)
+	info, err := os.Stat(newLocation)
+
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return &fs.PathError{Op: "enter", Path: newLocation, Err: protocol.ErrNotDirectory}
+	}
+
+	b.Location = newLocation
+
+	return nil
+}
+
+// Present answers browse commands until the client quits. If error frames were
+// negotiated, failed commands are answered with an error frame and the session goes on.
 func (b BrowseInfo) Present() error {
 	srcReader := bufio.NewReader(b.Source)
 
@@ -51,25 +101,20 @@ func (b BrowseInfo) Present() error {
 
 		switch command {
 		case protocol.ListFiles:
-			var items []string
-			entries, err := os.ReadDir(b.Location)
+			itemStr, err := b.listFiles()
 
 			if err != nil {
-				return err
-			}
-
-			for _, entry := range entries {
-				serializedEntry, err := serializeDirEntry(entry)
+				if !b.Features.Has(protocol.CapErrorFrames) {
+					return err
+				}
 
-				if err != nil {
+				if _, err := fmt.Fprint(b.Destination, protocol.NewRemoteError(err).Frame()); err != nil {
 					return err
 				}
 
-				items = append(items, serializedEntry)
+				continue
 			}
 
-			itemStr := strings.Join(items, string(protocol.FileSeparator))
-
 			if _, err := fmt.Fprintf(b.Destination, "%s%c", itemStr, protocol.EndTransmission); err != nil {
 				return err
 			}
@@ -81,7 +126,22 @@ func (b BrowseInfo) Present() error {
 			}
 
 			entryName := strings.TrimSuffix(result, string(protocol.EndTransmission))
-			b.Location = path.Join(b.Location, entryName)
+
+			// Older clients don't expect an answer, so they get the old behavior.
+			if !b.Features.Has(protocol.CapErrorFrames) {
+				b.Location = path.Join(b.Location, entryName)
+				continue
+			}
+
+			response := string(protocol.EndTransmission)
+
+			if err := b.enter(entryName); err != nil {
+				response = protocol.NewRemoteError(err).Frame()
+			}
+
+			if _, err := fmt.Fprint(b.Destination, response); err != nil {
+				return err
+			}
 		case protocol.Quit:
 			return nil
 		}
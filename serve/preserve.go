@@ -0,0 +1,271 @@
+package serve
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+// addSpecialToTarArchive sends a symbolic link, FIFO or device node as such. Links are
+// only sent if they're preserved or sent as links, FIFOs and devices only if they're
+// preserved, and sockets can't be sent at all, so the rest are skipped with a warning.
+// Reading them like files could block forever.
+func (u *UploadInfo) addSpecialToTarArchive(tarWriter *tar.Writer, filePath string, archivePath string, info fs.FileInfo) error {
+	var linkname string
+
+	if info.Mode()&fs.ModeSymlink != 0 {
+		// Links to directories that aren't followed, and links that don't lead anywhere.
+		if !u.Preserve && !u.NoDereference {
+			if _, err := os.Stat(filePath); err != nil {
+				_, _ = fmt.Fprintf(os.Stderr, "Skipping %s, which is a broken symbolic link\n", filePath)
+			} else {
+				_, _ = fmt.Fprintf(os.Stderr, "Skipping %s, which links to a directory. -L follows it\n", filePath)
+			}
+
+			return nil
+		}
+
+		target, err := os.Readlink(filePath)
+
+		if err != nil {
+			return fmt.Errorf("read link %s: %w", filePath, err)
+		}
+
+		linkname = target
+	} else if !u.Preserve || info.Mode()&fs.ModeSocket != 0 {
+		_, _ = fmt.Fprintf(os.Stderr, "Skipping %s, which is a special file\n", filePath)
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, linkname)
+
+	if err != nil {
+		return err
+	}
+
+	header.Name = archivePath
+	u.addXattrs(header, filePath)
+
+	if send, err := u.answerConflict(header); !send || err != nil {
+		return err
+	}
+
+	return tarWriter.WriteHeader(header)
+}
+
+// addHardLinkToTarArchive sends a file as a hard link if another link to it has already
+// been sent, reporting whether it did.
+func (u *UploadInfo) addHardLinkToTarArchive(tarWriter *tar.Writer, archivePath string, info fs.FileInfo) (bool, error) {
+	id, ok := hardLinkID(info)
+
+	if !ok {
+		return false, nil
+	}
+
+	target, seen := u.links[id]
+
+	if !seen {
+		if u.links == nil {
+			u.links = map[fileID]string{}
+		}
+
+		u.links[id] = archivePath
+
+		return false, nil
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+
+	if err != nil {
+		return false, err
+	}
+
+	header.Name = archivePath
+	header.Typeflag = tar.TypeLink
+	header.Linkname = target
+	header.Size = 0
+
+	if send, err := u.answerConflict(header); !send || err != nil {
+		return true, err
+	}
+
+	return true, tarWriter.WriteHeader(header)
+}
+
+// receiveSpecial creates a link, FIFO or device node. Anything other than a directory
+// that's in the way is replaced. Only symbolic links are created without d.Preserve, and
+// only with d.Links, so that a sender can't make device nodes nobody asked for.
+func (d DownloadInfo) receiveSpecial(header *tar.Header, filePath string) error {
+	if !d.Preserve && (header.Typeflag != tar.TypeSymlink || !d.Links) {
+		_, _ = fmt.Fprintf(os.Stderr, "Skipping %s, which is a link or special file. --preserve recreates them\n", header.Name)
+		return nil
+	}
+
+	var target string
+
+	if header.Typeflag == tar.TypeLink {
+		var err error
+		target, err = localPath(d.Filename, header.Linkname, true)
+
+		if err != nil {
+			return fmt.Errorf("link to %s: %w", header.Linkname, err)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o775); err != nil {
+		return fmt.Errorf("create directory %s: %w", filepath.Dir(filePath), err)
+	}
+
+	if info, err := os.Lstat(filePath); err == nil && !info.IsDir() {
+		if err := os.Remove(filePath); err != nil {
+			return fmt.Errorf("replace %s: %w", filePath, err)
+		}
+	}
+
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		d.Progress.Printf("Linking %s -> %s\n", filePath, header.Linkname)
+
+		if err := os.Symlink(header.Linkname, filePath); err != nil {
+			return fmt.Errorf("create link %s: %w", filePath, err)
+		}
+	case tar.TypeLink:
+		d.Progress.Printf("Linking %s to %s\n", filePath, target)
+
+		if err := os.Link(target, filePath); err != nil {
+			return fmt.Errorf("create hard link %s: %w", filePath, err)
+		}
+	default:
+		d.Progress.Printf("Creating %s\n", filePath)
+
+		if err := makeSpecial(header, filePath); err != nil {
+			return fmt.Errorf("create %s: %w", filePath, err)
+		}
+	}
+
+	return nil
+}
+
+// owners maps the owners of received files to local users and groups, by name where
+// possible, like tar does.
+type owners struct {
+	users  map[string]int
+	groups map[string]int
+}
+
+func newOwners() owners {
+	return owners{
+		users:  map[string]int{},
+		groups: map[string]int{},
+	}
+}
+
+func lookupID(cache map[string]int, name string, id int, lookup func(name string) (string, error)) int {
+	if name == "" {
+		return id
+	}
+
+	if cached, ok := cache[name]; ok {
+		if cached < 0 {
+			return id
+		}
+
+		return cached
+	}
+
+	cache[name] = -1
+
+	if localID, err := lookup(name); err == nil {
+		if parsed, err := strconv.Atoi(localID); err == nil {
+			cache[name] = parsed
+			return parsed
+		}
+	}
+
+	return id
+}
+
+func (o owners) lookup(header *tar.Header) (int, int) {
+	uid := lookupID(o.users, header.Uname, header.Uid, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+
+		if err != nil {
+			return "", err
+		}
+
+		return u.Uid, nil
+	})
+
+	gid := lookupID(o.groups, header.Gname, header.Gid, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+
+		if err != nil {
+			return "", err
+		}
+
+		return g.Gid, nil
+	})
+
+	return uid, gid
+}
+
+// preserveMetadata gives a received file the owner, mode and times it had on the
+// sending side.
+func (o owners) preserveMetadata(header *tar.Header, filePath string) error {
+	uid, gid := o.lookup(header)
+
+	// Only root can give files away, so this is expected to fail for everyone else.
+	if err := os.Lchown(filePath, uid, gid); err != nil && !errors.Is(err, fs.ErrPermission) && !errors.Is(err, errors.ErrUnsupported) {
+		return fmt.Errorf("change owner of %s: %w", filePath, err)
+	}
+
+	// The access time only survives in PAX headers.
+	atime := header.AccessTime
+
+	if atime.IsZero() {
+		atime = header.ModTime
+	}
+
+	if header.Typeflag == tar.TypeSymlink {
+		if err := lchtimes(filePath, atime, header.ModTime); err != nil {
+			return fmt.Errorf("set times of %s: %w", filePath, err)
+		}
+
+		return nil
+	}
+
+	// Changing the owner clears the setuid and setgid bits, so the mode is set again.
+	if err := os.Chmod(filePath, header.FileInfo().Mode()); err != nil {
+		return fmt.Errorf("change filemode of %s: %w", filePath, err)
+	}
+
+	if err := os.Chtimes(filePath, atime, header.ModTime); err != nil {
+		return fmt.Errorf("set times of %s: %w", filePath, err)
+	}
+
+	return nil
+}
+
+// receivedDirectory is a directory whose metadata is preserved once everything in it
+// has been received, as receiving files changes its times and its mode may not allow
+// writing to it.
+type receivedDirectory struct {
+	header   *tar.Header
+	filePath string
+}
+
+func (o owners) preserveDirectories(directories []receivedDirectory) error {
+	// Children come after their parents, so going backwards finishes them first.
+	for i := len(directories) - 1; i >= 0; i-- {
+		if err := o.preserveMetadata(directories[i].header, directories[i].filePath); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
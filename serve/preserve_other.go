@@ -0,0 +1,29 @@
+//go:build !unix
+
+package serve
+
+import (
+	"archive/tar"
+	"errors"
+	"io/fs"
+	"time"
+)
+
+// oNoFollow is left out where there's no portable way to refuse links when opening.
+const oNoFollow = 0
+
+type fileID struct{}
+
+// hardLinkID never recognizes hard links, as there's no portable way to.
+func hardLinkID(_ fs.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
+
+func makeSpecial(_ *tar.Header, filePath string) error {
+	return &fs.PathError{Op: "create", Path: filePath, Err: errors.ErrUnsupported}
+}
+
+// lchtimes leaves the times of links alone, as there's no portable way to set them.
+func lchtimes(_ string, _, _ time.Time) error {
+	return nil
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package serve
+
+import (
+	"archive/tar"
+	"io/fs"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// oNoFollow makes opening a symbolic link fail rather than open what it points to.
+const oNoFollow = unix.O_NOFOLLOW
+
+// fileID identifies a file on the sending side, so that hard links can be recognized.
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// hardLinkID returns the identity of a file that has more than one hard link.
+func hardLinkID(info fs.FileInfo) (fileID, bool) {
+	sys, ok := info.Sys().(*syscall.Stat_t)
+
+	if !ok || sys.Nlink < 2 {
+		return fileID{}, false
+	}
+
+	return fileID{uint64(sys.Dev), uint64(sys.Ino)}, true
+}
+
+// makeSpecial creates a FIFO or device node described by a tar header.
+func makeSpecial(header *tar.Header, filePath string) error {
+	mode := uint32(header.FileInfo().Mode().Perm())
+
+	switch header.Typeflag {
+	case tar.TypeFifo:
+		return unix.Mkfifo(filePath, mode)
+	case tar.TypeChar:
+		mode |= unix.S_IFCHR
+	case tar.TypeBlock:
+		mode |= unix.S_IFBLK
+	}
+
+	return unix.Mknod(filePath, mode, int(unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor))))
+}
+
+// lchtimes sets the times of a symbolic link itself.
+func lchtimes(filePath string, atime, mtime time.Time) error {
+	return unix.Lutimes(filePath, []unix.Timeval{
+		unix.NsecToTimeval(atime.UnixNano()),
+		unix.NsecToTimeval(mtime.UnixNano()),
+	})
+}
@@ -0,0 +1,470 @@
+package serve
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/term"
+
+	"github.com/l-donovan/qcp/common"
+)
+
+const (
+	// printFrequency is how many times a second the progress bar is redrawn at most.
+	printFrequency = 8
+
+	// logInterval is how often progress is logged when stdout isn't a terminal.
+	logInterval = 5 * time.Second
+
+	barWidth = 24
+)
+
+// Totals is what a sender is about to send: how many files, and how many bytes of them.
+// It's sent ahead of the tarball, so that the receiver can tell how far along it is.
+type Totals struct {
+	Files int64
+	Bytes int64
+}
+
+// WriteTotals sends totals ahead of a tarball, see protocol.HasTotals.
+func WriteTotals(dst io.Writer, totals Totals) error {
+	if err := binary.Write(dst, binary.BigEndian, totals); err != nil {
+		return fmt.Errorf("write totals: %w", err)
+	}
+
+	return nil
+}
+
+// ReadTotals reads totals sent with WriteTotals. It reads nothing past them.
+func ReadTotals(src io.Reader) (Totals, error) {
+	var totals Totals
+
+	if err := binary.Read(src, binary.BigEndian, &totals); err != nil {
+		return totals, fmt.Errorf("read totals: %w", err)
+	}
+
+	return totals, nil
+}
+
+// Progress shows how far along a transfer is, as a bar at the bottom of the terminal or
+// as a line logged every logInterval when stdout isn't a terminal. Other output goes
+// through Printf so that it doesn't get mixed up with the bar. Its methods do nothing on
+// a nil Progress, except for Printf, which prints as usual.
+type Progress struct {
+	mu sync.Mutex
+
+	// verb says what happens to the files, such as "received".
+	verb string
+	tty  bool
+
+	expected Totals
+	done     Totals
+	file     string
+
+	start    time.Time
+	lastDraw time.Time
+	lastLog  time.Time
+	drawn    bool
+
+	// rate is a moving average of bytes per second, to estimate the time left with.
+	rate      float64
+	rateTime  time.Time
+	rateBytes int64
+}
+
+// NewProgress returns a Progress for a transfer with nothing expected of it yet. The
+// transfer is timed from when the first file starts.
+func NewProgress(verb string) *Progress {
+	return &Progress{
+		verb: verb,
+		tty:  term.IsTerminal(int(os.Stdout.Fd())),
+	}
+}
+
+// Expect adds totals to what the transfer is expected to amount to. A transfer split
+// into several streams expects the totals of each.
+func (p *Progress) Expect(totals Totals) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.expected.Files += totals.Files
+	p.expected.Bytes += totals.Bytes
+}
+
+// File marks the start of another file.
+func (p *Progress) File(name string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done.Files++
+	p.file = name
+	p.update(false)
+}
+
+// Add counts n more bytes transferred.
+func (p *Progress) Add(n int64) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.done.Bytes += n
+	p.update(false)
+}
+
+// Printf prints a line of other output above the bar.
+func (p *Progress) Printf(format string, args ...any) {
+	if p == nil {
+		fmt.Printf(format, args...)
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+	fmt.Printf(format, args...)
+	p.update(true)
+}
+
+// Clear takes the bar off the terminal until there's progress again, so that something
+// else can use the line, such as a prompt.
+func (p *Progress) Clear() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+}
+
+// Finish takes the bar down and prints a summary of the transfer.
+func (p *Progress) Finish() {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.clear()
+
+	var elapsed time.Duration
+
+	if !p.start.IsZero() {
+		elapsed = time.Since(p.start)
+	}
+
+	speed := int64(float64(p.done.Bytes*8) / max(elapsed.Seconds(), 0.001))
+	precision := 100 * time.Millisecond
+
+	if elapsed < time.Second {
+		precision = time.Millisecond
+	}
+
+	fmt.Printf("All files %s: %s, %s in %s (%s)\n", p.verb, countFiles(p.done.Files), common.PrettifySize(p.done.Bytes), elapsed.Round(precision), common.PrettifySpeed(speed))
+}
+
+func countFiles(n int64) string {
+	if n == 1 {
+		return "1 file"
+	}
+
+	return fmt.Sprintf("%d files", n)
+}
+
+// reader counts what's read from r as transferred.
+func (p *Progress) reader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+
+	return &progressReader{r, p}
+}
+
+type progressReader struct {
+	r        io.Reader
+	progress *Progress
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.progress.Add(int64(n))
+
+	return n, err
+}
+
+// writer counts what's written to w as transferred.
+func (p *Progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+
+	return &progressWriter{w, p}
+}
+
+type progressWriter struct {
+	w        io.Writer
+	progress *Progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.progress.Add(int64(n))
+
+	return n, err
+}
+
+func (p *Progress) clear() {
+	if p.drawn {
+		fmt.Print("\r\033[K")
+		p.drawn = false
+	}
+}
+
+// update redraws the bar, or logs a line, if it's been long enough since the last time
+// or force is set.
+func (p *Progress) update(force bool) {
+	now := time.Now()
+
+	if p.start.IsZero() {
+		p.start, p.lastLog, p.rateTime = now, now, now
+	}
+
+	if elapsed := now.Sub(p.rateTime); elapsed >= time.Second {
+		rate := float64(p.done.Bytes-p.rateBytes) / elapsed.Seconds()
+
+		if p.rate == 0 {
+			p.rate = rate
+		} else {
+			p.rate = 0.7*p.rate + 0.3*rate
+		}
+
+		p.rateTime, p.rateBytes = now, p.done.Bytes
+	}
+
+	if !p.tty {
+		if now.Sub(p.lastLog) >= logInterval {
+			fmt.Println(p.status(false))
+			p.lastLog = now
+		}
+
+		return
+	}
+
+	if !force && p.drawn && now.Sub(p.lastDraw) < time.Second/printFrequency {
+		return
+	}
+
+	line := p.status(true)
+
+	if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 && len(line) >= width {
+		line = line[:max(width-1, 0)]
+	}
+
+	fmt.Printf("\r\033[K%s", line)
+	p.drawn = true
+	p.lastDraw = now
+}
+
+// status describes the progress so far, with a bar if it's for a terminal.
+func (p *Progress) status(bar bool) string {
+	var b strings.Builder
+
+	if p.expected.Bytes > 0 {
+		fraction := min(float64(p.done.Bytes)/float64(p.expected.Bytes), 1)
+
+		// The percentage is padded on the bar so that the rest of the line stays put.
+		percent := "%.0f%%"
+
+		if bar {
+			filled := int(fraction * barWidth)
+			b.WriteString("[" + strings.Repeat("=", filled) + strings.Repeat(" ", barWidth-filled) + "] ")
+			percent = "%3.0f%%"
+		}
+
+		fmt.Fprintf(&b, percent, 100*fraction)
+		fmt.Fprintf(&b, " %s of %s, %d of %s", common.PrettifySize(p.done.Bytes), common.PrettifySize(p.expected.Bytes), min(p.done.Files, p.expected.Files), countFiles(p.expected.Files))
+	} else {
+		fmt.Fprintf(&b, "%s, %s", common.PrettifySize(p.done.Bytes), countFiles(p.done.Files))
+	}
+
+	if p.rate > 0 {
+		fmt.Fprintf(&b, " at %s", common.PrettifySpeed(int64(p.rate*8)))
+
+		if left := p.expected.Bytes - p.done.Bytes; left > 0 {
+			fmt.Fprintf(&b, ", %s left", time.Duration(float64(left)/p.rate*float64(time.Second)).Round(time.Second))
+		}
+	}
+
+	if p.file != "" {
+		b.WriteString(": " + p.file)
+	}
+
+	return b.String()
+}
+
+// watchTarball follows the files in a tarball compressed with compression as it's read
+// from r, for a transfer that passes it on as it is rather than unpacking it. It returns
+// the reader to pass on, which gives the same bytes as r, and a function to call once
+// done with it, which waits until everything read has been counted.
+func (p *Progress) watchTarball(r io.Reader, compression string) (io.Reader, func()) {
+	if p == nil {
+		return r, func() {}
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		// Whatever goes wrong, the pipe has to be drained so that the transfer goes on.
+		defer func() {
+			_, _ = io.Copy(io.Discard, pr)
+		}()
+
+		decompressor, err := newDecompressor(pr, compression)
+
+		if err != nil {
+			return
+		}
+
+		defer func() {
+			_ = decompressor.Close()
+		}()
+
+		tarReader := tar.NewReader(decompressor)
+
+		for {
+			header, err := tarReader.Next()
+
+			if err != nil {
+				return
+			}
+
+			if header.Typeflag == tar.TypeReg {
+				p.File(header.Name)
+			}
+
+			if _, err := io.Copy(io.Discard, p.reader(tarReader)); err != nil {
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+
+	return io.TeeReader(r, pw), func() {
+		once.Do(func() {
+			_ = pw.Close()
+			<-done
+		})
+	}
+}
+
+// countTotals walks the files to send the way Serve does, adding up what it will send.
+func (u *UploadInfo) countTotals() (Totals, error) {
+	var totals Totals
+
+	foundOffsetFile := u.OffsetFile == ""
+	links := map[fileID]bool{}
+
+	for _, srcFilePath := range u.Filenames {
+		basePath := path.Dir(srcFilePath)
+		filter, err := u.Filters.forRoot(srcFilePath)
+
+		if err != nil {
+			return totals, err
+		}
+
+		if err := walk(srcFilePath, u.follows(), func(filePath string, info fs.FileInfo) error {
+			excluded, err := filter.excluded(filePath, info)
+
+			if err != nil {
+				return err
+			}
+
+			if excluded {
+				return fs.SkipDir
+			}
+
+			archivePath := getArchivePath(filePath, basePath)
+
+			if !info.Mode().IsRegular() || !u.selected(archivePath) {
+				return nil
+			}
+
+			if !foundOffsetFile {
+				if archivePath != u.OffsetFile {
+					return nil
+				}
+
+				foundOffsetFile = true
+			}
+
+			// Only the first of several hard links is sent with its contents.
+			if id, ok := hardLinkID(info); ok && u.Preserve {
+				if links[id] {
+					return nil
+				}
+
+				links[id] = true
+			}
+
+			if entry, ok := u.Resume.Completed[archivePath]; ok && entry.matches(info) {
+				return nil
+			}
+
+			offset, _ := u.resumeOffset(archivePath, info)
+			totals.Files++
+			totals.Bytes += info.Size() - offset
+
+			return nil
+		}); err != nil {
+			return totals, err
+		}
+	}
+
+	return totals, nil
+}
+
+// piecesTotals adds up what a stream sends. A chunked file counts once, with its first
+// chunk.
+func piecesTotals(pieces []piece) Totals {
+	var totals Totals
+
+	for _, p := range pieces {
+		if !p.regular {
+			continue
+		}
+
+		if p.offset == 0 {
+			totals.Files++
+		}
+
+		totals.Bytes += p.size
+	}
+
+	return totals
+}
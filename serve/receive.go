@@ -3,7 +3,10 @@ package serve
 import (
 	"archive/tar"
 	"compress/gzip"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"mime"
@@ -11,13 +14,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
-	"time"
+	"strconv"
+	"strings"
 
 	"github.com/l-donovan/qcp/common"
-)
-
-const (
-	printFrequency = 8
+	"github.com/l-donovan/qcp/protocol"
 )
 
 type DownloadInfo struct {
@@ -25,118 +26,566 @@ type DownloadInfo struct {
 	Contents     io.Reader
 	ShouldUnpack bool
 	Mode         os.FileMode
-	Progress     chan int64
+
+	// Totals is what the sender said it's about to send, if it did. Plan identifies how
+	// the transfer was split between streams, if the sender said.
+	Totals Totals
+	Plan   PlanDigest
+
+	// Progress, if it isn't nil, shows how far along receiving is and takes care of
+	// printing what's received.
+	Progress *Progress
+
+	// Throttle, if it isn't nil, keeps what's read from Contents to a bandwidth limit.
+	Throttle *Throttle
+
+	// Verify rehashes files that are resumed or skipped because they already exist.
+	Verify bool
+
+	// Compression is the algorithm Contents is compressed with, gzip if it's empty.
+	Compression string
+
+	// PreserveTimes sets the modification times of received files to the sender's.
+	// Preserve keeps their owners, modes and times, directories included, and recreates
+	// links, FIFOs and device nodes. Links recreates symbolic links without Preserve.
+	PreserveTimes bool
+	Preserve      bool
+	Links         bool
+
+	// Xattrs applies the extended attributes sent with files.
+	Xattrs bool
+
+	// Atomic writes each file to PartialPath and moves it into place once it's complete
+	// and verified.
+	Atomic bool
+
+	// OnConflict is one of ConflictPolicies, or empty for the default. Prompter asks
+	// the user with ConflictAsk.
+	OnConflict string
+	Prompter   common.Prompter
+
+	// tarReader is what entries are read from, for the digests that follow files.
+	tarReader *tar.Reader
+}
+
+func (d DownloadInfo) contents() io.Reader {
+	return d.Throttle.reader(d.Contents)
 }
 
-func receiveTarEntry(fileInfo fs.FileInfo, filePath string, src *tar.Reader) error {
+// relative returns filePath relative to where files are received, if that isn't name.
+func (d DownloadInfo) relative(filePath string, name string) string {
+	rel, err := filepath.Rel(d.Filename, filePath)
+
+	if err != nil || filepath.ToSlash(rel) == path.Clean(name) {
+		return ""
+	}
+
+	return filepath.ToSlash(rel)
+}
+
+func (d DownloadInfo) compression() string {
+	if d.Compression == "" {
+		return protocol.CompressionGzip
+	}
+
+	return d.Compression
+}
+
+// expectedDigest returns the checksum algorithm and hex digest the sender attached to a
+// tar header, if any. The digest is empty if it follows the file, see readTrailer.
+func expectedDigest(header *tar.Header) (string, string) {
+	if algorithm, ok := header.PAXRecords[protocol.PAXTrailer]; ok && protocol.NewHash(algorithm) != nil {
+		return algorithm, ""
+	}
+
+	for key, digest := range header.PAXRecords {
+		algorithm, found := strings.CutPrefix(key, protocol.PAXChecksumPrefix)
+
+		if found && protocol.NewHash(algorithm) != nil {
+			return algorithm, digest
+		}
+	}
+
+	return "", ""
+}
+
+// readTrailer returns the digest that follows the contents of a file sent with
+// protocol.PAXTrailer, or an empty string if it wasn't.
+func (d DownloadInfo) readTrailer(header *tar.Header) (string, error) {
+	algorithm, ok := header.PAXRecords[protocol.PAXTrailer]
+
+	if !ok {
+		return "", nil
+	}
+
+	trailer, err := d.tarReader.Next()
+
+	if err != nil {
+		return "", fmt.Errorf("read checksum of %s: %w", header.Name, err)
+	}
+
+	if trailer.Typeflag != protocol.TypeTrailer || trailer.Name != header.Name {
+		return "", fmt.Errorf("%s isn't followed by its checksum", header.Name)
+	}
+
+	return trailer.PAXRecords[protocol.PAXChecksumPrefix+algorithm], nil
+}
+
+// hashFile feeds the first n bytes of a file to h.
+func hashFile(fp *os.File, n int64, h hash.Hash) error {
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	_, err := io.CopyN(h, fp, n)
+
+	return err
+}
+
+// PartialPath returns where a file is received with DownloadInfo.Atomic until it's
+// complete.
+func PartialPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "."+filepath.Base(filePath)+".qcp-partial")
+}
+
+// haveFile reports whether filePath already holds the size bytes the sender has. If
+// verify is set and there is a checksum, it's rehashed with h to make sure, and h is
+// reset if it differs. It reports false if the checksum only comes after the file, as
+// there's nothing to check against yet.
+func (d DownloadInfo) haveFile(filePath string, size int64, h hash.Hash, expected string, verify bool) (bool, error) {
+	fp, err := os.Open(filePath)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	defer func() {
+		_ = fp.Close()
+	}()
+
+	localFileInfo, err := fp.Stat()
+
+	if err != nil {
+		return false, err
+	}
+
+	if localFileInfo.Size() != size {
+		return false, nil
+	}
+
+	if h == nil || !verify {
+		return true, nil
+	}
+
+	// A checksum that comes after the file can't vouch for what's already here.
+	if expected == "" {
+		return false, nil
+	}
+
+	if err := hashFile(fp, size, h); err != nil {
+		return false, err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != expected {
+		d.Progress.Printf("%s differs from the remote file, receiving it again\n", filePath)
+		h.Reset()
+
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// receiveTarEntry receives a file or directory. Files that already exist are
+// overwritten, unless they already have the right size and overwrite isn't set. Regular
+// files are recorded in journal, if it isn't nil, as they arrive.
+func (d DownloadInfo) receiveTarEntry(header *tar.Header, filePath string, src io.Reader, overwrite bool, journal *Journal) error {
+	verify, atomic := d.Verify, d.Atomic
+
+	if _, ok := header.PAXRecords[protocol.PAXSize]; ok {
+		return d.receiveChunk(header, filePath, src, verify)
+	}
+
+	if _, ok := header.PAXRecords[protocol.PAXDelta]; ok {
+		return receiveDelta(header, filePath, src, verify, d.Progress)
+	}
+
+	fileInfo := header.FileInfo()
+
 	if fileInfo.IsDir() {
-		fmt.Printf("Creating directory %s\n", filePath)
+		d.Progress.Printf("Creating directory %s\n", filePath)
 
 		if err := os.MkdirAll(filePath, 0o777); err != nil {
 			return fmt.Errorf("create directory %s: %w", filePath, err)
 		}
-	} else {
-		fmt.Printf("Receiving %s\n", filePath)
 
-		if err := os.MkdirAll(filepath.Dir(filePath), 0o775); err != nil {
-			return fmt.Errorf("create directory %s: %w", filepath.Dir(filePath), err)
+		return nil
+	}
+
+	d.Progress.Printf("Receiving %s\n", filePath)
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o775); err != nil {
+		return fmt.Errorf("create directory %s: %w", filepath.Dir(filePath), err)
+	}
+
+	algorithm, expected := expectedDigest(header)
+
+	// Sparse files are sent without their holes, so the header only has the size of
+	// the data.
+	size := fileInfo.Size()
+	segments, sparseSize, err := sparseMap(header)
+
+	if err != nil {
+		return fmt.Errorf("receive %s: %w", filePath, err)
+	}
+
+	if segments != nil {
+		size = sparseSize
+	}
+
+	var h hash.Hash
+
+	if algorithm != "" {
+		h = protocol.NewHash(algorithm)
+	}
+
+	entry := JournalEntry{
+		Path:     header.Name,
+		Local:    d.relative(filePath, header.Name),
+		Size:     size,
+		ModTime:  header.ModTime.Unix(),
+		Checksum: algorithm,
+		Digest:   expected,
+	}
+
+	// With atomic, the file is written next to where it goes and moved there once it's
+	// complete, so that nobody sees half of it.
+	writePath := filePath
+	otherPath := PartialPath(filePath)
+
+	if atomic {
+		writePath, otherPath = otherPath, writePath
+	}
+
+	// Only filePath has been checked so far, and the partial file is just as much a
+	// way out of the destination.
+	if err := refuseLink(writePath); err != nil {
+		return err
+	}
+
+	if err := refuseLink(otherPath); err != nil {
+		return err
+	}
+
+	// The received contents are written from offset onwards.
+	var offset int64
+	offsetStr, resumed := header.PAXRecords[protocol.PAXOffset]
+
+	if resumed {
+		// We already have the start of a resumed file.
+		offset, err = strconv.ParseInt(offsetStr, 10, 64)
+
+		if err != nil {
+			return fmt.Errorf("parse offset of %s: %w", filePath, err)
 		}
 
-		fp, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o666)
+		entry.Size += offset
+		entry.Offset = offset
+
+		// The start may be in the other file if the last attempt was or wasn't atomic.
+		if _, err := os.Lstat(writePath); errors.Is(err, fs.ErrNotExist) {
+			if err := os.Rename(otherPath, writePath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("resume %s: %w", filePath, err)
+			}
+		}
+	} else if !overwrite && !journal.changed(entry) {
+		// Assume we already have this file, unless we're asked to make sure.
+		skip, err := d.haveFile(filePath, size, h, expected, verify)
 
 		if err != nil {
-			return fmt.Errorf("create %s: %w", filePath, err)
+			return fmt.Errorf("hash %s: %w", filePath, err)
 		}
 
-		var dest io.Writer = fp
+		if skip {
+			if _, err := io.Copy(io.Discard, src); err != nil {
+				return fmt.Errorf("skip %s: %w", filePath, err)
+			}
 
-		defer func() {
-			// Close returns an error if the file pointer has already been closed.
-			// Under normal operation we expect the file to be closed before we
-			// get here, so we ignore the potential error.
+			if entry.Digest, err = d.readTrailer(header); err != nil {
+				return err
+			}
 
-			_ = fp.Close()
-		}()
+			if err := os.Chmod(filePath, fileInfo.Mode()); err != nil {
+				return fmt.Errorf("change filemode: %w", err)
+			}
 
-		localFileInfo, err := fp.Stat()
+			entry.Done = true
 
-		if err != nil {
-			return fmt.Errorf("stat %s: %w", filePath, err)
+			return journal.record(entry)
 		}
+	}
 
-		if localFileInfo.Size() == fileInfo.Size() {
-			// Skip.
+	fp, err := os.OpenFile(writePath, os.O_RDWR|os.O_CREATE|oNoFollow, 0o666)
 
-			dest = io.Discard
-		} else if localFileInfo.Size() > fileInfo.Size() {
-			// Truncate.
+	if err != nil {
+		return fmt.Errorf("create %s: %w", writePath, err)
+	}
 
-			if _, err := fp.Seek(0, io.SeekStart); err != nil {
-				return fmt.Errorf("rewind %s: %w", filePath, err)
-			}
+	defer func() {
+		_ = fp.Close()
+	}()
+
+	if resumed {
+		localFileInfo, err := fp.Stat()
 
-			if err := os.Truncate(filePath, 0); err != nil {
-				return fmt.Errorf("truncate %s: %w", filePath, err)
+		if err != nil {
+			return fmt.Errorf("stat %s: %w", writePath, err)
+		}
+
+		if localFileInfo.Size() < offset {
+			return fmt.Errorf("resume %s: have %d bytes but the remote resumed at %d", filePath, localFileInfo.Size(), offset)
+		}
+
+		// Checking a resumed file means reading back what we already have, so it's
+		// only done when asked for.
+		if h != nil && verify {
+			if err := hashFile(fp, offset, h); err != nil {
+				return fmt.Errorf("hash %s: %w", filePath, err)
 			}
+		} else {
+			h = nil
 		}
+	}
+
+	if err := journal.record(entry); err != nil {
+		return err
+	}
+
+	if err := fp.Truncate(offset); err != nil {
+		return fmt.Errorf("truncate %s: %w", writePath, err)
+	}
+
+	if _, err := fp.Seek(offset, io.SeekStart); err != nil {
+		return fmt.Errorf("seek %s: %w", writePath, err)
+	}
+
+	var dest io.Writer = fp
+
+	if h != nil {
+		dest = io.MultiWriter(fp, h)
+	}
+
+	checkpoints := newCheckpointWriter(fp, dest, journal, entry)
 
-		if err := os.Truncate(filePath, fileInfo.Size()); err != nil {
-			return fmt.Errorf("set file size: %w", err)
+	if segments != nil {
+		if err := writeSegments(fp, h, src, segments, size, checkpoints); err != nil {
+			return fmt.Errorf("write %s: %w", writePath, err)
 		}
+	} else if _, err := io.Copy(checkpoints, src); err != nil {
+		return fmt.Errorf("write %s: %w", writePath, err)
+	}
+
+	trailer, err := d.readTrailer(header)
+
+	if err != nil {
+		return err
+	}
+
+	if trailer != "" {
+		expected, entry.Digest = trailer, trailer
+	}
+
+	if h != nil {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			// A corrupt file never takes the place of the old one.
+			if atomic {
+				_ = os.Remove(writePath)
+			}
 
-		if _, err := io.Copy(dest, src); err != nil {
-			return fmt.Errorf("write %s: %w", dest, err)
+			return fmt.Errorf("%w: %s has %s %s but the remote file has %s", protocol.ErrChecksumMismatch, filePath, algorithm, actual, expected)
 		}
+	}
+
+	if err := fp.Chmod(fileInfo.Mode()); err != nil {
+		return fmt.Errorf("change filemode: %w", err)
+	}
+
+	if !atomic && journal == nil {
+		return nil
+	}
+
+	// The file is only recorded as done once it's sure to be on disk.
+	if err := fp.Sync(); err != nil {
+		return fmt.Errorf("sync %s: %w", writePath, err)
+	}
 
-		if err := fp.Chmod(fileInfo.Mode()); err != nil {
-			return fmt.Errorf("change filemode: %w", err)
+	if err := fp.Close(); err != nil {
+		return fmt.Errorf("close %s: %w", writePath, err)
+	}
+
+	if atomic {
+		if err := os.Rename(writePath, filePath); err != nil {
+			return fmt.Errorf("move %s into place: %w", writePath, err)
 		}
 	}
 
+	entry.Done = true
+	entry.Offset = 0
+
+	return journal.record(entry)
+}
+
+// Receive receives every file in d.Contents, keeping track of its progress in journal if
+// it isn't nil.
+func (d DownloadInfo) Receive(journal *Journal) error {
+	if err := d.receive(journal); err != nil {
+		return err
+	}
+
+	if d.Progress != nil {
+		d.Progress.Finish()
+	} else {
+		fmt.Println("All files received")
+	}
+
 	return nil
 }
 
-func (d DownloadInfo) Receive(progressFile *os.File) error {
-	gzipReader, err := gzip.NewReader(d.Contents)
+// ReceiveStream receives one of several streams a transfer is split into. Unlike
+// Receive, it doesn't announce when it's done.
+func (d DownloadInfo) ReceiveStream() error {
+	return d.receive(nil)
+}
+
+func (d DownloadInfo) receive(journal *Journal) error {
+	decompressor, err := newDecompressor(d.contents(), d.compression())
 
 	if err != nil {
-		return fmt.Errorf("create gzip reader: %w", err)
+		return fmt.Errorf("create %s reader: %w", d.compression(), err)
 	}
 
-	tarReader := tar.NewReader(gzipReader)
+	defer func() {
+		_ = decompressor.Close()
+	}()
+
+	tarReader := tar.NewReader(decompressor)
+	src := d.Progress.reader(tarReader)
+	d.tarReader = tarReader
+	owners := newOwners()
+	warnings := xattrWarnings{}
+	conflicts := &conflicts{policy: d.OnConflict, prompter: d.Prompter, progress: d.Progress}
+
+	var directories []receivedDirectory
 
 	for {
 		header, err := tarReader.Next()
 
 		if err != nil {
 			if err == io.EOF {
-				fmt.Println("All files received")
-				return nil
+				return owners.preserveDirectories(directories)
 			}
 
 			return fmt.Errorf("read tar: %w", err)
 		}
 
-		filePath := path.Join(d.Filename, header.Name)
-		fileInfo := header.FileInfo()
+		// The digests of files that were skipped are of no use.
+		if header.Typeflag == protocol.TypeTrailer {
+			continue
+		}
 
-		if progressFile != nil {
-			if _, err := progressFile.Seek(0, io.SeekStart); err != nil {
-				return fmt.Errorf("rewind progress file: %w", err)
-			}
+		// A chunk of a file counts as the file only if it's the first.
+		if header.Typeflag == tar.TypeReg && (header.PAXRecords[protocol.PAXSize] == "" || header.PAXRecords[protocol.PAXOffset] == "0") {
+			d.Progress.File(header.Name)
+		}
 
-			if err := progressFile.Truncate(0); err != nil {
-				return fmt.Errorf("truncate progress file: %w", err)
-			}
+		special := false
 
-			if _, err := progressFile.WriteString(filePath); err != nil {
-				return fmt.Errorf("write progress file: %w", err)
-			}
+		switch header.Typeflag {
+		case tar.TypeSymlink, tar.TypeLink, tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			special = true
+		}
+
+		// Whoever sends the tarball doesn't get to write anywhere else.
+		filePath, err := localPath(d.Filename, header.Name, special)
+
+		if errors.Is(err, ErrUnsafePath) {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", header.Name, err)
+			d.Progress.Add(header.Size)
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("resolve %s: %w", header.Name, err)
+		}
+
+		if journal.owns(filePath) {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping %s, which would replace the journal\n", header.Name)
+			d.Progress.Add(header.Size)
+			continue
 		}
 
-		if err := receiveTarEntry(fileInfo, filePath, tarReader); err != nil {
+		overwrite := false
+
+		// A resumed file goes where the last attempt put it, rather than being resolved
+		// again.
+		if local := journal.resolved(header.Name); header.PAXRecords[protocol.PAXOffset] != "" && local != header.Name {
+			filePath, err = localPath(d.Filename, local, false)
+		} else {
+			filePath, overwrite, err = conflicts.resolve(header, filePath)
+		}
+
+		if errors.Is(err, ErrUnsafePath) {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", header.Name, err)
+			d.Progress.Add(header.Size)
+			continue
+		}
+
+		if err != nil {
+			return fmt.Errorf("resolve conflict: %w", err)
+		}
+
+		if filePath == "" {
+			d.Progress.Add(header.Size)
+			continue
+		}
+
+		if special {
+			err = d.receiveSpecial(header, filePath)
+		} else {
+			err = d.receiveTarEntry(header, filePath, src, overwrite, journal)
+		}
+
+		if errors.Is(err, ErrUnsafePath) {
+			_, _ = fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", header.Name, err)
+			d.Progress.Add(header.Size)
+			continue
+		}
+
+		if err != nil {
 			return fmt.Errorf("receive tar entry: %w", err)
 		}
+
+		if d.Preserve {
+			if header.Typeflag == tar.TypeDir {
+				directories = append(directories, receivedDirectory{header, filePath})
+			} else if err := owners.preserveMetadata(header, filePath); err != nil {
+				return err
+			}
+		} else if d.PreserveTimes && header.Typeflag == tar.TypeReg {
+			// Directories are left alone, as their times change with every file received.
+			if err := os.Chtimes(filePath, header.ModTime, header.ModTime); err != nil {
+				return fmt.Errorf("set times of %s: %w", filePath, err)
+			}
+		}
+
+		// This comes after the owner is changed, which clears file capabilities.
+		if d.Xattrs {
+			warnings.applyXattrs(header, filePath)
+		}
 	}
 }
 
@@ -158,33 +607,34 @@ func (d DownloadInfo) ReceiveWeb(w http.ResponseWriter) {
 			mimeType = "text/plain"
 		}
 	} else {
-		mimeType = "application/gzip"
+		mimeType = archiveMimeTypes[d.compression()]
 	}
 
 	w.Header().Set("Content-Type", mimeType)
 	w.Header().Set("X-Content-Type-Options", "nosniff")
 
-	defer func() {
-		if d.Progress != nil {
-			d.Progress <- -1
-		}
-	}()
-
 	var dst io.Writer
 	var src io.Reader
 
+	// stop waits for the progress of a tarball to be counted, see watchTarball.
+	stop := func() {}
+
 	if d.ShouldUnpack {
-		gzipReader, err := gzip.NewReader(d.Contents)
+		decompressor, err := newDecompressor(d.contents(), d.compression())
 
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
-			_, _ = fmt.Fprintf(w, "Could not create gzip reader: %v", err)
+			_, _ = fmt.Fprintf(w, "Could not create %s reader: %v", d.compression(), err)
 			return
 		}
 
-		tarReader := tar.NewReader(gzipReader)
+		defer func() {
+			_ = decompressor.Close()
+		}()
+
+		tarReader := tar.NewReader(decompressor)
 
-		_, err = tarReader.Next()
+		header, err := tarReader.Next()
 
 		if err != nil {
 			w.WriteHeader(http.StatusInternalServerError)
@@ -192,6 +642,8 @@ func (d DownloadInfo) ReceiveWeb(w http.ResponseWriter) {
 			return
 		}
 
+		d.Progress.File(header.Name)
+
 		gzipWriter := gzip.NewWriter(w)
 
 		defer func() {
@@ -204,82 +656,38 @@ func (d DownloadInfo) ReceiveWeb(w http.ResponseWriter) {
 		w.Header().Set("Content-Encoding", "gzip")
 
 		dst = gzipWriter
-		src = tarReader
+		src = d.Progress.reader(tarReader)
 	} else {
-		w.Header().Set("Content-Disposition", "attachment;filename="+d.Filename+".tar.gz")
+		w.Header().Set("Content-Disposition", "attachment;filename="+d.Filename+archiveExtensions[d.compression()])
 		// We don't set Content-Encoding: gzip for directories even though they are
 		// sent as tar.gz files, because we don't want the browser to prematurely decompress
 		// the archive.
 
+		// The tarball is passed on as it is, so following its progress means reading it
+		// on the side.
+		src, stop = d.Progress.watchTarball(d.contents(), d.compression())
+
+		defer stop()
+
 		dst = w
-		src = d.Contents
 	}
 
-	var totalCopied int64
-
 	for {
-		n, err := io.CopyN(dst, src, 1024)
+		_, err := io.CopyN(dst, src, 1024)
 
 		if err != nil {
 			if err != io.EOF {
 				w.WriteHeader(http.StatusInternalServerError)
 				_, _ = fmt.Fprintf(w, "download: %v", err)
+				return
 			}
 
-			return
-		}
-
-		totalCopied += n
-
-		if d.Progress != nil {
-			d.Progress <- totalCopied
-		}
-
-		flusher.Flush()
-	}
-}
-
-func (d *DownloadInfo) PrintProgressBar() {
-	d.Progress = make(chan int64)
-
-	printPeriod := time.Duration(1000/printFrequency) * time.Millisecond
-
-	lastTime := time.Now()
-	lastProgressBytes := int64(0)
-	lastLen := 0
-
-	for progressBytes := range d.Progress {
-		timeDelta := time.Since(lastTime)
-
-		// We effectively need to lower the resolution so that we have a large
-		// enough time delta from which we can compute download speed.
-
-		if timeDelta < printPeriod {
-			continue
-		}
-
-		speedBitsPerSecond := 1_000 * 8 * (progressBytes - lastProgressBytes) / timeDelta.Milliseconds()
-
-		if lastLen == 0 {
-			fmt.Print("\033[?25lTransferred ")
-		} else {
-			fmt.Printf("\033[%dD", lastLen)
-		}
-
-		if progressBytes == -1 {
 			break
 		}
 
-		prettySize := common.PrettifySize(progressBytes)
-		prettySpeed := common.PrettifySpeed(speedBitsPerSecond)
-
-		text := fmt.Sprintf("%s (%s)", prettySize, prettySpeed)
-		fmt.Printf("\033[K%s", text)
-
-		lastTime = time.Now()
-		lastProgressBytes = progressBytes
-		lastLen = len(text)
+		flusher.Flush()
 	}
 
-	fmt.Println("\033[?25h")
+	stop()
+	d.Progress.Finish()
 }
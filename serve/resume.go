@@ -0,0 +1,372 @@
+package serve
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+// Journals are kept in the destination directory while files are received into it, so
+// that an interrupted transfer can be resumed. Downloads and uploads keep separate ones.
+const (
+	DownloadJournalName = ".qcp-download.journal"
+	UploadJournalName   = ".qcp-upload.journal"
+)
+
+// checkpointInterval is how much of a file is received between checkpoints, each of
+// which syncs the file to disk before recording how much of it is there.
+const checkpointInterval = 64 << 20
+
+// JournalEntry describes a regular file in the tarball as the sender had it. Local is
+// where it was written instead of Path, if a conflict policy renamed it. Offset is how
+// much of an unfinished file is safely on disk, and Done marks a complete file.
+type JournalEntry struct {
+	Path     string `json:"path"`
+	Local    string `json:"local,omitempty"`
+	Size     int64  `json:"size"`
+	ModTime  int64  `json:"mtime"`
+	Checksum string `json:"checksum,omitempty"`
+	Digest   string `json:"digest,omitempty"`
+	Offset   int64  `json:"offset,omitempty"`
+	Done     bool   `json:"done,omitempty"`
+}
+
+// local returns where the file was written, relative to the destination.
+func (e JournalEntry) local() string {
+	if e.Local != "" {
+		return e.Local
+	}
+
+	return e.Path
+}
+
+// matches reports whether the sender's file is still the one the entry describes. Times
+// in the tarball are whole seconds.
+func (e JournalEntry) matches(info fs.FileInfo) bool {
+	return info.Mode().IsRegular() && info.Size() == e.Size && info.ModTime().Round(time.Second).Unix() == e.ModTime
+}
+
+// ResumeState is what a receiver tells the sender to resume a transfer: the files it
+// already has and the one it was in the middle of, if any. The sender skips and resumes
+// them only if they haven't changed since.
+type ResumeState struct {
+	Completed map[string]JournalEntry
+	InFlight  *JournalEntry
+}
+
+// Empty reports whether there's nothing to resume.
+func (s ResumeState) Empty() bool {
+	return len(s.Completed) == 0 && s.InFlight == nil
+}
+
+// Journal records the progress of a transfer as one JSON object per line, so that it
+// survives being cut off at any point. Its methods do nothing on a nil Journal.
+type Journal struct {
+	fp      *os.File
+	path    string
+	entries []JournalEntry
+}
+
+// OpenJournal reads the journal at path, if there is one, and opens it to record more.
+// The directory it's in must exist.
+func OpenJournal(path string) (*Journal, error) {
+	j, err := readJournal(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Whoever sends the files mustn't get to plant a link that has the journal written
+	// elsewhere, see Journal.owns.
+	j.fp, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND|oNoFollow, 0o644)
+
+	if err != nil {
+		return nil, fmt.Errorf("open journal: %w", err)
+	}
+
+	return j, nil
+}
+
+// readJournal reads the journal at path, if there is one, without opening it to record
+// more.
+func readJournal(path string) (*Journal, error) {
+	j := &Journal{path: path}
+	fp, err := os.OpenFile(path, os.O_RDONLY|oNoFollow, 0)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return j, nil
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("read journal: %w", err)
+	}
+
+	defer func() {
+		_ = fp.Close()
+	}()
+
+	scanner := bufio.NewScanner(fp)
+
+	for scanner.Scan() {
+		var entry JournalEntry
+
+		// The last line may have been cut off, in which case it's ignored.
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		j.entries = append(j.entries, entry)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("read %s: %w", path, err)
+	}
+
+	return j, nil
+}
+
+// receivedSize returns how much of entry's file has arrived under root. What arrived is in
+// the partial file if the transfer was atomic and the file wasn't finished yet.
+func receivedSize(root string, entry JournalEntry) (int64, error) {
+	localFile := filepath.Join(root, filepath.FromSlash(entry.local()))
+	fileInfo, err := os.Lstat(PartialPath(localFile))
+
+	if errors.Is(err, fs.ErrNotExist) {
+		fileInfo, err = os.Lstat(localFile)
+	}
+
+	if err != nil {
+		return 0, err
+	}
+
+	return fileInfo.Size(), nil
+}
+
+// ResumeState replays the journal of a transfer into root. Files that have since been
+// removed or changed size at the destination are received again.
+func (j *Journal) ResumeState(root string) ResumeState {
+	state := ResumeState{Completed: map[string]JournalEntry{}}
+
+	if j == nil {
+		return state
+	}
+
+	for _, entry := range j.entries {
+		if entry.Done {
+			state.Completed[entry.Path] = entry
+
+			if state.InFlight != nil && state.InFlight.Path == entry.Path {
+				state.InFlight = nil
+			}
+
+			continue
+		}
+
+		delete(state.Completed, entry.Path)
+		state.InFlight = &entry
+	}
+
+	for path, entry := range state.Completed {
+		if size, err := receivedSize(root, entry); err != nil || size != entry.Size {
+			delete(state.Completed, path)
+		}
+	}
+
+	// Only what was synced to disk before the last checkpoint is sure to be there.
+	if state.InFlight != nil {
+		size, err := receivedSize(root, *state.InFlight)
+
+		if err != nil || state.InFlight.Offset == 0 {
+			state.InFlight = nil
+		} else {
+			state.InFlight.Offset = min(state.InFlight.Offset, size)
+		}
+	}
+
+	return state
+}
+
+// UploadResumeState returns what the receiver already has from an interrupted upload into
+// root.
+func UploadResumeState(root string) (ResumeState, error) {
+	journal, err := readJournal(filepath.Join(root, UploadJournalName))
+
+	if err != nil {
+		return ResumeState{}, err
+	}
+
+	return journal.ResumeState(root), nil
+}
+
+// changed reports whether the journal has an earlier version of entry's file, which
+// means whatever is there now is out of date even if it has the right size.
+func (j *Journal) changed(entry JournalEntry) bool {
+	if j == nil {
+		return false
+	}
+
+	for _, previous := range slices.Backward(j.entries) {
+		if previous.Path == entry.Path {
+			return previous.Size != entry.Size || previous.ModTime != entry.ModTime
+		}
+	}
+
+	return false
+}
+
+// resolved returns where the last attempt wrote name, relative to the destination.
+func (j *Journal) resolved(name string) string {
+	if j == nil {
+		return name
+	}
+
+	for _, previous := range slices.Backward(j.entries) {
+		if previous.Path == name {
+			return previous.local()
+		}
+	}
+
+	return name
+}
+
+// owns reports whether filePath is the journal itself, which received files mustn't
+// replace.
+func (j *Journal) owns(filePath string) bool {
+	return j != nil && filepath.Clean(filePath) == filepath.Clean(j.path)
+}
+
+func (j *Journal) record(entry JournalEntry) error {
+	if j == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := j.fp.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("write %s: %w", j.path, err)
+	}
+
+	return nil
+}
+
+func (j *Journal) Close() error {
+	if j == nil || j.fp == nil {
+		return nil
+	}
+
+	return j.fp.Close()
+}
+
+// Remove closes and removes the journal once the transfer is complete.
+func (j *Journal) Remove() error {
+	if j == nil {
+		return nil
+	}
+
+	_ = j.Close()
+
+	if err := os.Remove(j.path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("remove %s: %w", j.path, err)
+	}
+
+	return nil
+}
+
+// checkpointWriter writes to a file being received, syncing it and recording how much of
+// it is there in the journal every checkpointInterval bytes.
+type checkpointWriter struct {
+	fp      *os.File
+	dest    io.Writer
+	journal *Journal
+	entry   JournalEntry
+	next    int64
+}
+
+func newCheckpointWriter(fp *os.File, dest io.Writer, journal *Journal, entry JournalEntry) *checkpointWriter {
+	return &checkpointWriter{fp, dest, journal, entry, entry.Offset + checkpointInterval}
+}
+
+func (c *checkpointWriter) Write(p []byte) (int, error) {
+	n, err := c.dest.Write(p)
+	c.entry.Offset += int64(n)
+
+	if err != nil || c.entry.Offset < c.next {
+		return n, err
+	}
+
+	return n, c.checkpoint()
+}
+
+// skip moves past a hole up to offset, which nothing is written to.
+func (c *checkpointWriter) skip(offset int64) {
+	c.entry.Offset = offset
+}
+
+// checkpoint syncs the file and records how much of it is there.
+func (c *checkpointWriter) checkpoint() error {
+	if c.journal == nil {
+		return nil
+	}
+
+	if err := c.fp.Sync(); err != nil {
+		return err
+	}
+
+	c.next = c.entry.Offset + checkpointInterval
+
+	return c.journal.record(c.entry)
+}
+
+// resumeOffset returns where to resume sending the file at archivePath, if the receiver
+// was in the middle of it and it hasn't changed since.
+func (u *UploadInfo) resumeOffset(archivePath string, info fs.FileInfo) (int64, bool) {
+	if u.OffsetFile != "" && archivePath == u.OffsetFile {
+		return u.OffsetPos, true
+	}
+
+	if inFlight := u.Resume.InFlight; inFlight != nil && inFlight.Path == archivePath && inFlight.matches(info) {
+		return inFlight.Offset, true
+	}
+
+	return 0, false
+}
+
+// changedSince reports whether the in-flight file was rewritten without changing its size
+// or modification time, going by digest, the hex digest of the whole file.
+func (u *UploadInfo) changedSince(archivePath string, digest string) bool {
+	inFlight := u.Resume.InFlight
+
+	return inFlight != nil && inFlight.Path == archivePath && inFlight.Checksum == u.Checksum && inFlight.Digest != "" && inFlight.Digest != digest
+}
+
+// WriteResumeState sends a resume state to the other side.
+func WriteResumeState(dst io.Writer, state ResumeState) error {
+	if err := gob.NewEncoder(dst).Encode(state); err != nil {
+		return fmt.Errorf("encode resume state: %w", err)
+	}
+
+	return nil
+}
+
+// ReadResumeState reads a resume state sent with WriteResumeState.
+func ReadResumeState(src io.Reader) (ResumeState, error) {
+	var state ResumeState
+
+	if err := gob.NewDecoder(src).Decode(&state); err != nil {
+		return state, fmt.Errorf("decode resume state: %w", err)
+	}
+
+	return state, nil
+}
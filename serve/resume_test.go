@@ -0,0 +1,309 @@
+package serve
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// journalLine encodes entry as it's recorded in a journal.
+func journalLine(t *testing.T, entry JournalEntry) string {
+	t.Helper()
+
+	line, err := json.Marshal(entry)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(line)
+}
+
+// writeFiles creates a file of each size under root, by its path relative to root.
+func writeFiles(t *testing.T, root string, sizes map[string]int) {
+	t.Helper()
+
+	for name, size := range sizes {
+		filePath := filepath.Join(root, filepath.FromSlash(name))
+
+		if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := os.WriteFile(filePath, make([]byte, size), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestJournalResumeState(t *testing.T) {
+	a := JournalEntry{Path: "dir/a", Size: 5, ModTime: 1}
+	b := JournalEntry{Path: "dir/b", Size: 10, ModTime: 2}
+
+	done := func(e JournalEntry) JournalEntry {
+		e.Done = true
+		return e
+	}
+
+	at := func(e JournalEntry, offset int64) JournalEntry {
+		e.Offset = offset
+		return e
+	}
+
+	renamed := func(e JournalEntry, local string) JournalEntry {
+		e.Local = local
+		return e
+	}
+
+	tests := []struct {
+		name      string
+		entries   []JournalEntry
+		tail      string
+		files     map[string]int
+		completed []string
+		inFlight  string
+		offset    int64
+	}{
+		{
+			name:      "completed files",
+			entries:   []JournalEntry{done(a), done(b)},
+			files:     map[string]int{"dir/a": 5, "dir/b": 10},
+			completed: []string{"dir/a", "dir/b"},
+		},
+		{
+			name:      "truncated last line",
+			entries:   []JournalEntry{done(a)},
+			tail:      `{"path":"dir/b","size":10,"off`,
+			files:     map[string]int{"dir/a": 5, "dir/b": 10},
+			completed: []string{"dir/a"},
+		},
+		{
+			name:      "in flight",
+			entries:   []JournalEntry{done(a), at(b, 4)},
+			files:     map[string]int{"dir/a": 5, "dir/b": 6},
+			completed: []string{"dir/a"},
+			inFlight:  "dir/b",
+			offset:    4,
+		},
+		{
+			name:     "offset limited to what's on disk",
+			entries:  []JournalEntry{at(b, 8)},
+			files:    map[string]int{"dir/b": 6},
+			inFlight: "dir/b",
+			offset:   6,
+		},
+		{
+			name:    "in flight before the first checkpoint",
+			entries: []JournalEntry{at(b, 0)},
+			files:   map[string]int{"dir/b": 6},
+		},
+		{
+			name:      "in flight file finished",
+			entries:   []JournalEntry{at(b, 4), done(b)},
+			files:     map[string]int{"dir/b": 10},
+			completed: []string{"dir/b"},
+		},
+		{
+			name:     "completed file sent again",
+			entries:  []JournalEntry{done(b), at(b, 4)},
+			files:    map[string]int{"dir/b": 6},
+			inFlight: "dir/b",
+			offset:   4,
+		},
+		{
+			name:      "missing in flight file",
+			entries:   []JournalEntry{done(a), at(b, 4)},
+			files:     map[string]int{"dir/a": 5},
+			completed: []string{"dir/a"},
+		},
+		{
+			name:    "missing partial file",
+			entries: []JournalEntry{at(b, 4)},
+			files:   map[string]int{},
+		},
+		{
+			name:    "completed file of another size",
+			entries: []JournalEntry{done(a), done(b)},
+			files:   map[string]int{"dir/a": 4},
+		},
+		{
+			name:     "in flight in a partial file",
+			entries:  []JournalEntry{at(b, 4)},
+			files:    map[string]int{"dir/.b.qcp-partial": 6},
+			inFlight: "dir/b",
+			offset:   4,
+		},
+		{
+			name:     "partial file ahead of an older copy",
+			entries:  []JournalEntry{at(b, 8)},
+			files:    map[string]int{"dir/.b.qcp-partial": 2, "dir/b": 10},
+			inFlight: "dir/b",
+			offset:   2,
+		},
+		{
+			name:      "atomic run moved into place",
+			entries:   []JournalEntry{at(a, 3), done(a)},
+			files:     map[string]int{"dir/a": 5},
+			completed: []string{"dir/a"},
+		},
+		{
+			name:      "renamed file",
+			entries:   []JournalEntry{done(renamed(a, "dir/a (1)")), at(renamed(b, "dir/b (1)"), 4)},
+			files:     map[string]int{"dir/a (1)": 5, "dir/b": 10, "dir/b (1)": 6},
+			completed: []string{"dir/a"},
+			inFlight:  "dir/b",
+			offset:    4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			writeFiles(t, root, tt.files)
+
+			var lines []string
+
+			for _, entry := range tt.entries {
+				lines = append(lines, journalLine(t, entry)+"\n")
+			}
+
+			journalPath := filepath.Join(root, DownloadJournalName)
+
+			if err := os.WriteFile(journalPath, []byte(strings.Join(lines, "")+tt.tail), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			journal, err := readJournal(journalPath)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			state := journal.ResumeState(root)
+			completed := slices.Sorted(maps.Keys(state.Completed))
+
+			if !slices.Equal(completed, tt.completed) {
+				t.Errorf("got completed %q, want %q", completed, tt.completed)
+			}
+
+			if tt.inFlight == "" {
+				if state.InFlight != nil {
+					t.Errorf("got %s in flight at %d, want nothing", state.InFlight.Path, state.InFlight.Offset)
+				}
+
+				return
+			}
+
+			if state.InFlight == nil || state.InFlight.Path != tt.inFlight || state.InFlight.Offset != tt.offset {
+				t.Errorf("got in flight %+v, want %s at %d", state.InFlight, tt.inFlight, tt.offset)
+			}
+		})
+	}
+}
+
+func TestJournalChanged(t *testing.T) {
+	entries := []JournalEntry{
+		{Path: "a", Size: 5, ModTime: 1, Done: true},
+		{Path: "b", Size: 10, ModTime: 2, Offset: 4},
+		{Path: "a", Size: 6, ModTime: 3, Done: true},
+	}
+
+	tests := []struct {
+		name  string
+		entry JournalEntry
+		want  bool
+	}{
+		{"same as the last attempt", JournalEntry{Path: "a", Size: 6, ModTime: 3}, false},
+		{"same as an earlier attempt", JournalEntry{Path: "a", Size: 5, ModTime: 1}, true},
+		{"other size", JournalEntry{Path: "b", Size: 11, ModTime: 2}, true},
+		{"other time", JournalEntry{Path: "b", Size: 10, ModTime: 7}, true},
+		{"not in the journal", JournalEntry{Path: "c", Size: 1, ModTime: 1}, false},
+	}
+
+	journal := &Journal{entries: entries}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := journal.changed(tt.entry); got != tt.want {
+				t.Fatalf("got %t, want %t", got, tt.want)
+			}
+		})
+	}
+
+	if (*Journal)(nil).changed(entries[0]) {
+		t.Fatal("a nil journal reported a change")
+	}
+}
+
+func TestCheckpointWriter(t *testing.T) {
+	const chunk = 1 << 20
+
+	tests := []struct {
+		name    string
+		start   int64
+		written int64
+		want    []int64
+	}{
+		{"short of a checkpoint", 0, checkpointInterval - chunk, nil},
+		{"one checkpoint", 0, checkpointInterval, []int64{checkpointInterval}},
+		{"two checkpoints", 0, 2*checkpointInterval + chunk, []int64{checkpointInterval, 2 * checkpointInterval}},
+		{"resumed", 10, checkpointInterval, []int64{checkpointInterval + 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+			journalPath := filepath.Join(root, DownloadJournalName)
+			journal, err := OpenJournal(journalPath)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				_ = journal.Close()
+			}()
+
+			fp, err := os.Create(filepath.Join(root, "file"))
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				_ = fp.Close()
+			}()
+
+			entry := JournalEntry{Path: "file", Size: 3 * checkpointInterval, Offset: tt.start}
+			writer := newCheckpointWriter(fp, io.Discard, journal, entry)
+			buf := make([]byte, chunk)
+
+			for written := int64(0); written < tt.written; written += chunk {
+				if _, err := writer.Write(buf); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			recorded, err := readJournal(journalPath)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var offsets []int64
+
+			for _, e := range recorded.entries {
+				offsets = append(offsets, e.Offset)
+			}
+
+			if !slices.Equal(offsets, tt.want) {
+				t.Fatalf("got checkpoints at %v, want %v", offsets, tt.want)
+			}
+		})
+	}
+}
@@ -2,14 +2,16 @@ package serve
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"io/fs"
 	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/l-donovan/qcp/common"
@@ -22,10 +24,110 @@ type UploadInfo struct {
 	OffsetFile  string
 	OffsetPos   int64
 
+	// Checksum is the algorithm used to checksum each file. No checksums are sent if
+	// it's empty.
+	Checksum string
+
+	// Compression is the algorithm to compress with, gzip if it's empty, at the given
+	// Level. With AutoCompression, nothing is compressed if the files look like they
+	// won't compress.
+	Compression     string
+	Level           int
+	AutoCompression bool
+
+	// Stream is which of Streams parts of the files this UploadInfo sends. Streams is 0
+	// or 1 to send everything.
+	Stream  int
+	Streams int
+
+	// Plan, if it isn't nil, is how the files are split between the streams, which each
+	// stream works out on its own otherwise. SendPlan sends the digest of the plan ahead
+	// of the tarball, see protocol.HasPlan.
+	Plan     *Plan
+	SendPlan bool
+
+	// Signatures describe the receiver's copies of files, which are then sent as deltas
+	// against those copies.
+	Signatures Signatures
+
+	// Only holds the paths in the tarball to send, if it isn't nil. Everything else is
+	// left out.
+	Only map[string]bool
+
+	// NoDereference sends symbolic links as links, rather than what they point to.
+	// Otherwise, links to files are followed, and so are links to directories if
+	// Dereference is set. Preserve sends hard links, FIFOs and device nodes as such too.
+	NoDereference bool
+	Dereference   bool
+	Preserve      bool
+
+	// Xattrs sends extended attributes, including POSIX ACLs and file capabilities.
+	Xattrs bool
+
+	// Sparse sends sparse files without their holes.
+	Sparse bool
+
+	// TrailingChecksums sends the digests of files after their contents rather than in
+	// their headers, so that they're only read once. The receiver can then only check
+	// them once they've arrived, and not the copies it already has.
+	TrailingChecksums bool
+
+	// Filters leave out files under Filenames, without reading what's in excluded
+	// directories.
+	Filters Filters
+
+	// Resume describes what the receiver has from an interrupted transfer. Files it
+	// already has aren't sent again, and the file it was in the middle of is resumed.
+	Resume ResumeState
+
+	// SendTotals sends the number of files and bytes about to be sent ahead of the
+	// tarball, see protocol.HasTotals. Progress, if it isn't nil, is told about them too,
+	// and about every file as it's sent.
+	SendTotals bool
+	Progress   *Progress
+
+	// Throttle, if it isn't nil, keeps what's written to Destination to a bandwidth
+	// limit.
+	Throttle *Throttle
+
+	// Existing holds the paths in the tarball that already exist at the destination.
+	// With OnConflict set to ConflictAsk, Prompter asks the user about them and the
+	// answers are sent along, see protocol.PAXConflict.
+	Existing   map[string]bool
+	OnConflict string
+	Prompter   common.Prompter
+
 	foundOffsetFile bool
+	links           map[fileID]string
+	conflicts       *conflicts
+}
+
+func (u *UploadInfo) selected(archivePath string) bool {
+	return u.Only == nil || u.Only[archivePath]
+}
+
+// fileDigest returns the hex digest of an entire file and rewinds it.
+func fileDigest(fp *os.File, algorithm string) (string, error) {
+	h := protocol.NewHash(algorithm)
+
+	if h == nil {
+		return "", fmt.Errorf("unsupported checksum %s", algorithm)
+	}
+
+	if _, err := io.Copy(h, fp); err != nil {
+		return "", err
+	}
+
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
 }
 
-func (u *UploadInfo) addFileToTarArchive(tarWriter *tar.Writer, filePath string, directory string) error {
+// getArchivePath returns the path of a file in the tarball, relative to the directory
+// containing the source it was found in.
+func getArchivePath(filePath string, directory string) string {
 	archivePath := filePath
 
 	// This check prevents us from getting rid of the file name/extension separator when it's
@@ -35,7 +137,16 @@ func (u *UploadInfo) addFileToTarArchive(tarWriter *tar.Writer, filePath string,
 	}
 
 	archivePath = strings.TrimPrefix(archivePath, string(filepath.Separator))
-	archivePath = filepath.ToSlash(archivePath)
+
+	return filepath.ToSlash(archivePath)
+}
+
+func (u *UploadInfo) addFileToTarArchive(tarWriter *tar.Writer, filePath string, directory string, info fs.FileInfo) error {
+	archivePath := getArchivePath(filePath, directory)
+
+	if !u.selected(archivePath) {
+		return nil
+	}
 
 	if u.OffsetFile != "" && !u.foundOffsetFile {
 		// We are looking for the partial file.
@@ -49,6 +160,22 @@ func (u *UploadInfo) addFileToTarArchive(tarWriter *tar.Writer, filePath string,
 		u.foundOffsetFile = true
 	}
 
+	if !info.Mode().IsRegular() && !info.IsDir() {
+		return u.addSpecialToTarArchive(tarWriter, filePath, archivePath, info)
+	}
+
+	// Links to files sent by other streams may arrive before the files themselves.
+	if u.Preserve && u.Streams <= 1 && info.Mode().IsRegular() {
+		if linked, err := u.addHardLinkToTarArchive(tarWriter, archivePath, info); linked || err != nil {
+			return err
+		}
+	}
+
+	// Files the receiver already has from an interrupted transfer aren't sent again.
+	if entry, ok := u.Resume.Completed[archivePath]; ok && entry.matches(info) {
+		return nil
+	}
+
 	// Open the path to read from.
 	fp, err := os.Open(filePath)
 
@@ -68,10 +195,64 @@ func (u *UploadInfo) addFileToTarArchive(tarWriter *tar.Writer, filePath string,
 		return err
 	}
 
-	if u.OffsetFile != "" && archivePath == u.OffsetFile {
-		fileInfo = common.NewPartialFileInfo(fileInfo, u.OffsetPos)
+	offset, resumed := u.resumeOffset(archivePath, fileInfo)
+
+	if signature, ok := u.Signatures[archivePath]; ok && fileInfo.Mode().IsRegular() && !resumed {
+		sent, err := u.addDeltaToTarArchive(tarWriter, fp, fileInfo, archivePath, signature)
+
+		if err != nil {
+			return fmt.Errorf("send delta of %s: %w", filePath, err)
+		}
+
+		if sent {
+			return nil
+		}
+	}
 
-		if _, err := fp.Seek(u.OffsetPos, io.SeekStart); err != nil {
+	records := map[string]string{}
+
+	var h hash.Hash
+
+	// The digest covers the whole file, so that the receiver can verify resumed files too.
+	// Receivers only verify those when asked to, and then they ask for the digest up
+	// front, so a trailing one is left out.
+	if u.Checksum != "" && fileInfo.Mode().IsRegular() && u.TrailingChecksums {
+		if !resumed {
+			if h = protocol.NewHash(u.Checksum); h == nil {
+				return fmt.Errorf("unsupported checksum %s", u.Checksum)
+			}
+
+			records[protocol.PAXTrailer] = u.Checksum
+		}
+	} else if u.Checksum != "" && fileInfo.Mode().IsRegular() {
+		digest, err := fileDigest(fp, u.Checksum)
+
+		if err != nil {
+			return fmt.Errorf("checksum %s: %w", filePath, err)
+		}
+
+		records[protocol.PAXChecksumPrefix+u.Checksum] = digest
+
+		if resumed && u.changedSince(archivePath, digest) {
+			resumed = false
+		}
+	}
+
+	var segments []segment
+
+	if u.Sparse && fileInfo.Mode().IsRegular() && !resumed {
+		segments, err = sparseSegments(fp, fileInfo.Size())
+
+		if err != nil {
+			return fmt.Errorf("find holes in %s: %w", filePath, err)
+		}
+	}
+
+	if resumed {
+		fileInfo = common.NewPartialFileInfo(fileInfo, offset)
+		records[protocol.PAXOffset] = strconv.FormatInt(offset, 10)
+
+		if _, err := fp.Seek(offset, io.SeekStart); err != nil {
 			return fmt.Errorf("seek partial file to offset: %w", err)
 		}
 	}
@@ -85,6 +266,26 @@ func (u *UploadInfo) addFileToTarArchive(tarWriter *tar.Writer, filePath string,
 
 	header.Name = archivePath
 
+	if segments != nil {
+		records[protocol.PAXSparseMap] = encodeSegments(segments)
+		records[protocol.PAXSparseSize] = strconv.FormatInt(fileInfo.Size(), 10)
+		header.Size = 0
+
+		for _, s := range segments {
+			header.Size += s.length
+		}
+	}
+
+	if len(records) > 0 {
+		header.PAXRecords = records
+	}
+
+	u.addXattrs(header, filePath)
+
+	if send, err := u.answerConflict(header); !send || err != nil {
+		return err
+	}
+
 	if err := tarWriter.WriteHeader(header); err != nil {
 		return err
 	}
@@ -94,20 +295,57 @@ func (u *UploadInfo) addFileToTarArchive(tarWriter *tar.Writer, filePath string,
 		return nil
 	}
 
-	// Write the source file into the tarball at path from Create().
-	if _, err = io.Copy(tarWriter, fp); err != nil {
+	u.Progress.File(archivePath)
+
+	if segments != nil {
+		err = copySegments(u.Progress.writer(tarWriter), h, fp, segments, fileInfo.Size())
+	} else if h != nil {
+		_, err = io.Copy(io.MultiWriter(u.Progress.writer(tarWriter), h), fp)
+	} else {
+		// Write the source file into the tarball at path from Create().
+		_, err = io.Copy(u.Progress.writer(tarWriter), fp)
+	}
+
+	if err != nil {
 		return err
 	}
 
-	return nil
+	return addTrailer(tarWriter, archivePath, u.Checksum, h)
 }
 
-// Serve sends file and directories as gzipped tarballs via stdout and a simple wire protocol.
+// addTrailer sends the digest in h of the file just sent, if there is one, see
+// protocol.TypeTrailer.
+func addTrailer(tarWriter *tar.Writer, archivePath string, algorithm string, h hash.Hash) error {
+	if h == nil {
+		return nil
+	}
+
+	return tarWriter.WriteHeader(&tar.Header{
+		Name:     archivePath,
+		Typeflag: protocol.TypeTrailer,
+		Format:   tar.FormatPAX,
+		PAXRecords: map[string]string{
+			protocol.PAXChecksumPrefix + algorithm: hex.EncodeToString(h.Sum(nil)),
+		},
+	})
+}
+
+// Serve sends file and directories as compressed tarballs via stdout and a simple wire protocol.
 func (u UploadInfo) Serve() error {
 	if len(u.Filenames) == 0 {
 		return errors.New("no filenames provided")
 	}
 
+	// Patterns are expanded here rather than by the shell running us, which doesn't get
+	// to see them.
+	filenames, err := ExpandSources(u.Filenames)
+
+	if err != nil {
+		return err
+	}
+
+	u.Filenames = filenames
+
 	var flags byte
 
 	if len(u.Filenames) == 1 {
@@ -122,19 +360,89 @@ func (u UploadInfo) Serve() error {
 		}
 	}
 
-	if _, err := u.Destination.Write([]byte{flags}); err != nil {
+	compression := u.Compression
+
+	if compression == "" {
+		compression = protocol.CompressionGzip
+	}
+
+	if u.AutoCompression && compression != protocol.CompressionNone && !worthCompressing(u.Filenames, u.Filters, compression) {
+		compression = protocol.CompressionNone
+	}
+
+	compressionFlags, err := protocol.CompressionFlags(compression)
+
+	if err != nil {
+		return err
+	}
+
+	flags |= compressionFlags
+
+	// Streams plan what they send up front, which also tells them what that adds up to.
+	plan := u.Plan
+
+	if plan == nil && u.Streams > 1 {
+		pieces, err := u.planStreams()
+
+		if err != nil {
+			return err
+		}
+
+		plan = &Plan{pieces}
+	}
+
+	var totals Totals
+
+	if u.SendTotals || u.Progress != nil {
+		if plan != nil {
+			totals = piecesTotals(plan.pieces[u.Stream])
+		} else if totals, err = u.countTotals(); err != nil {
+			return err
+		}
+
+		u.Progress.Expect(totals)
+	}
+
+	if u.SendTotals {
+		flags |= protocol.HasTotals
+	}
+
+	if u.SendPlan && plan != nil {
+		flags |= protocol.HasPlan
+	}
+
+	// Compressors don't write anything until they're given data, so this comes before
+	// the flags in order to catch bad levels early.
+	destination := u.Throttle.writer(u.Destination)
+	compressor, err := newCompressor(destination, compression, u.Level)
+
+	if err != nil {
+		return fmt.Errorf("create %s writer: %w", compression, err)
+	}
+
+	if _, err := destination.Write([]byte{flags}); err != nil {
 		return fmt.Errorf("write flags: %w", err)
 	}
 
-	gzipWriter := gzip.NewWriter(u.Destination)
+	if u.SendTotals {
+		if err := WriteTotals(destination, totals); err != nil {
+			return err
+		}
+	}
+
+	if u.SendPlan && plan != nil {
+		if err := WritePlanDigest(destination, plan.digest()); err != nil {
+			return err
+		}
+	}
 
 	defer func() {
-		if err := gzipWriter.Close(); err != nil {
-			_, _ = fmt.Fprintf(os.Stderr, "Error closing gzip writer: %v\n", err)
+		if err := compressor.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error closing %s writer: %v\n", compression, err)
 		}
 	}()
 
-	tarWriter := tar.NewWriter(gzipWriter)
+	tarWriter := tar.NewWriter(compressor)
 
 	defer func() {
 		if err := tarWriter.Close(); err != nil {
@@ -142,35 +450,38 @@ func (u UploadInfo) Serve() error {
 		}
 	}()
 
-	for _, srcFilePath := range u.Filenames {
-		info, err := os.Stat(srcFilePath)
-
-		if err != nil {
-			return err
+	if plan != nil {
+		for _, p := range plan.pieces[u.Stream] {
+			if err := u.addPieceToTarArchive(tarWriter, p); err != nil {
+				return err
+			}
 		}
 
+		return nil
+	}
+
+	for _, srcFilePath := range u.Filenames {
 		basePath := path.Dir(srcFilePath)
+		filter, err := u.Filters.forRoot(srcFilePath)
 
-		if err := u.addFileToTarArchive(tarWriter, srcFilePath, basePath); err != nil {
+		if err != nil {
 			return err
 		}
 
-		if info.IsDir() {
-			if err := filepath.WalkDir(srcFilePath, func(path string, d fs.DirEntry, err error) error {
-				if err != nil {
-					return err
-				}
-
-				// Skip the source directory root. This can be ignored because the source
-				// directory root is just the root of the tarball.
-				if path == srcFilePath {
-					return nil
-				}
+		if err := walk(srcFilePath, u.follows(), func(filePath string, info fs.FileInfo) error {
+			excluded, err := filter.excluded(filePath, info)
 
-				return u.addFileToTarArchive(tarWriter, path, basePath)
-			}); err != nil {
+			if err != nil {
 				return err
 			}
+
+			if excluded {
+				return fs.SkipDir
+			}
+
+			return u.addFileToTarArchive(tarWriter, filePath, basePath, info)
+		}); err != nil {
+			return err
 		}
 	}
 
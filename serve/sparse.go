@@ -0,0 +1,191 @@
+package serve
+
+import (
+	"archive/tar"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/l-donovan/qcp/protocol"
+)
+
+// segment is a range of a sparse file that holds data. Everything between segments is
+// a hole, which reads as zeros.
+type segment struct {
+	offset int64
+	length int64
+}
+
+// sparseSegments returns where the data in a file is, or nil if it has no holes.
+func sparseSegments(fp *os.File, size int64) ([]segment, error) {
+	segments, err := dataSegments(fp, size)
+
+	if err != nil || segments == nil {
+		return nil, err
+	}
+
+	var dataSize int64
+
+	for _, s := range segments {
+		dataSize += s.length
+	}
+
+	if dataSize == size {
+		return nil, nil
+	}
+
+	return segments, nil
+}
+
+func encodeSegments(segments []segment) string {
+	fields := make([]string, 0, 2*len(segments))
+
+	for _, s := range segments {
+		fields = append(fields, strconv.FormatInt(s.offset, 10), strconv.FormatInt(s.length, 10))
+	}
+
+	return strings.Join(fields, ",")
+}
+
+// sparseMap returns the data segments and full size of a sparse file from its tar
+// header, or nil if it isn't sparse.
+func sparseMap(header *tar.Header) ([]segment, int64, error) {
+	encoded, ok := header.PAXRecords[protocol.PAXSparseMap]
+
+	if !ok {
+		return nil, 0, nil
+	}
+
+	size, err := strconv.ParseInt(header.PAXRecords[protocol.PAXSparseSize], 10, 64)
+
+	if err != nil {
+		return nil, 0, fmt.Errorf("parse sparse size: %w", err)
+	}
+
+	segments := []segment{}
+
+	if encoded != "" {
+		fields := strings.Split(encoded, ",")
+
+		if len(fields)%2 != 0 {
+			return nil, 0, fmt.Errorf("malformed sparse map %q", encoded)
+		}
+
+		for i := 0; i < len(fields); i += 2 {
+			offset, err := strconv.ParseInt(fields[i], 10, 64)
+
+			if err != nil {
+				return nil, 0, fmt.Errorf("parse sparse map: %w", err)
+			}
+
+			length, err := strconv.ParseInt(fields[i+1], 10, 64)
+
+			if err != nil {
+				return nil, 0, fmt.Errorf("parse sparse map: %w", err)
+			}
+
+			segments = append(segments, segment{offset, length})
+		}
+	}
+
+	// Segments must be in order and within the file, and hold exactly what was sent.
+	var end, dataSize int64
+
+	for _, s := range segments {
+		if s.offset < end || s.length < 0 || s.offset+s.length > size {
+			return nil, 0, fmt.Errorf("malformed sparse map %q", encoded)
+		}
+
+		end = s.offset + s.length
+		dataSize += s.length
+	}
+
+	if dataSize != header.Size {
+		return nil, 0, fmt.Errorf("sparse map %q doesn't match %d bytes of data", encoded, header.Size)
+	}
+
+	return segments, size, nil
+}
+
+// copySegments sends the data of a sparse file of the given size. If h isn't nil, the
+// whole file is hashed, with the holes as the zeros they read as.
+func copySegments(dst io.Writer, h hash.Hash, fp *os.File, segments []segment, size int64) error {
+	var end int64
+
+	for _, s := range segments {
+		dest := dst
+
+		if h != nil {
+			if _, err := io.CopyN(h, zeroReader{}, s.offset-end); err != nil {
+				return err
+			}
+
+			dest = io.MultiWriter(dst, h)
+		}
+
+		if _, err := io.Copy(dest, io.NewSectionReader(fp, s.offset, s.length)); err != nil {
+			return err
+		}
+
+		end = s.offset + s.length
+	}
+
+	if h != nil {
+		if _, err := io.CopyN(h, zeroReader{}, size-end); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// writeSegments writes the data of a sparse file to fp, which must be empty, through
+// checkpoints, leaving holes in between. The holes are hashed with h as the zeros they
+// read as. Everything up to the end of a segment is on disk once it's written, so that's
+// where each segment is checkpointed.
+func writeSegments(fp *os.File, h hash.Hash, src io.Reader, segments []segment, size int64, checkpoints *checkpointWriter) error {
+	var end int64
+
+	for _, s := range segments {
+		if h != nil {
+			if _, err := io.CopyN(h, zeroReader{}, s.offset-end); err != nil {
+				return err
+			}
+		}
+
+		if _, err := fp.Seek(s.offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		checkpoints.skip(s.offset)
+
+		if _, err := io.CopyN(checkpoints, src, s.length); err != nil {
+			return err
+		}
+
+		if err := checkpoints.checkpoint(); err != nil {
+			return err
+		}
+
+		end = s.offset + s.length
+	}
+
+	if h != nil {
+		if _, err := io.CopyN(h, zeroReader{}, size-end); err != nil {
+			return err
+		}
+	}
+
+	// A hole at the end is only there once the file has its full size.
+	return fp.Truncate(size)
+}
@@ -0,0 +1,75 @@
+//go:build linux
+
+package serve
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// dataSegments finds the data in a file with SEEK_DATA and SEEK_HOLE. It returns nil if
+// the filesystem can't tell.
+func dataSegments(fp *os.File, size int64) ([]segment, error) {
+	conn, err := fp.SyscallConn()
+
+	if err != nil {
+		return nil, err
+	}
+
+	segments := []segment{}
+	var seekErr error
+
+	err = conn.Control(func(fd uintptr) {
+		var offset int64
+
+		for offset < size {
+			data, err := unix.Seek(int(fd), offset, unix.SEEK_DATA)
+
+			// There's no data past offset, so the rest is a hole.
+			if errors.Is(err, unix.ENXIO) {
+				break
+			}
+
+			if err != nil {
+				seekErr = err
+				return
+			}
+
+			hole, err := unix.Seek(int(fd), data, unix.SEEK_HOLE)
+
+			if err != nil {
+				seekErr = err
+				return
+			}
+
+			hole = min(hole, size)
+
+			if hole > data {
+				segments = append(segments, segment{data, hole - data})
+			}
+
+			offset = hole
+		}
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if errors.Is(seekErr, unix.EINVAL) || errors.Is(seekErr, unix.EOPNOTSUPP) {
+		return nil, nil
+	}
+
+	if seekErr != nil {
+		return nil, seekErr
+	}
+
+	// Reading goes on from the start of the file.
+	if _, err := fp.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	return segments, nil
+}
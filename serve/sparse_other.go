@@ -0,0 +1,10 @@
+//go:build !linux
+
+package serve
+
+import "os"
+
+// dataSegments can't find holes, as SEEK_DATA and SEEK_HOLE are only used on Linux.
+func dataSegments(_ *os.File, _ int64) ([]segment, error) {
+	return nil, nil
+}
@@ -0,0 +1,100 @@
+package serve
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWriteSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		segments []segment
+		size     int64
+		want     []int64
+	}{
+		{"no segments", nil, 4096, nil},
+		{"one segment", []segment{{0, 100}}, 100, []int64{100}},
+		{"holes between", []segment{{100, 50}, {1000, 24}}, 1024, []int64{150, 1024}},
+		{"hole at the end", []segment{{0, 10}, {20, 10}}, 4096, []int64{10, 30}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root := t.TempDir()
+
+			// What the file reads as, and what's sent of it.
+			want := make([]byte, tt.size)
+			var data []byte
+
+			for i, s := range tt.segments {
+				chunk := bytes.Repeat([]byte{byte(i + 1)}, int(s.length))
+				copy(want[s.offset:], chunk)
+				data = append(data, chunk...)
+			}
+
+			journalPath := filepath.Join(root, DownloadJournalName)
+			journal, err := OpenJournal(journalPath)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				_ = journal.Close()
+			}()
+
+			filePath := filepath.Join(root, "file")
+			fp, err := os.Create(filePath)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer func() {
+				_ = fp.Close()
+			}()
+
+			h := sha256.New()
+			checkpoints := newCheckpointWriter(fp, io.MultiWriter(fp, h), journal, JournalEntry{Path: "file", Size: tt.size})
+
+			if err := writeSegments(fp, h, bytes.NewReader(data), tt.segments, tt.size, checkpoints); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := os.ReadFile(filePath)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(got, want) {
+				t.Fatal("the file doesn't read as what was sent")
+			}
+
+			if sum := sha256.Sum256(want); !bytes.Equal(h.Sum(nil), sum[:]) {
+				t.Fatal("the holes weren't hashed as zeros")
+			}
+
+			recorded, err := readJournal(journalPath)
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var offsets []int64
+
+			for _, e := range recorded.entries {
+				offsets = append(offsets, e.Offset)
+			}
+
+			if !slices.Equal(offsets, tt.want) {
+				t.Fatalf("got checkpoints at %v, want %v", offsets, tt.want)
+			}
+		})
+	}
+}
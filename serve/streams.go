@@ -0,0 +1,361 @@
+package serve
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/l-donovan/qcp/common"
+	"github.com/l-donovan/qcp/protocol"
+)
+
+// chunkSize is the size of the chunks that large files are split into when sending
+// over several streams.
+const chunkSize = 32 << 20
+
+// piece is a file, or a chunk of one, to be sent by one of several streams.
+type piece struct {
+	filePath  string
+	directory string
+	info      fs.FileInfo
+	regular   bool
+	chunked   bool
+	offset    int64
+	size      int64
+}
+
+// Plan is how the files of a transfer are split between its streams. Streams that run in
+// one process share one, see UploadInfo.Plan. Those that don't make their own and send
+// its digest, so that the receiver can tell if the files changed while they were planning.
+type Plan struct {
+	pieces [][]piece
+}
+
+// PlanDigest identifies a plan, see protocol.HasPlan.
+type PlanDigest [sha256.Size]byte
+
+// PlanStreams plans how the files of u are split between u.Streams streams.
+func (u UploadInfo) PlanStreams() (*Plan, error) {
+	filenames, err := ExpandSources(u.Filenames)
+
+	if err != nil {
+		return nil, err
+	}
+
+	u.Filenames = filenames
+	pieces, err := u.planStreams()
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Plan{pieces}, nil
+}
+
+// digest identifies the plan by what every stream sends.
+func (p *Plan) digest() PlanDigest {
+	h := sha256.New()
+
+	for stream, pieces := range p.pieces {
+		for _, piece := range pieces {
+			_, _ = fmt.Fprintf(h, "%d\x00%s\x00%d\x00%d\x00", stream, getArchivePath(piece.filePath, piece.directory), piece.offset, piece.size)
+		}
+	}
+
+	return PlanDigest(h.Sum(nil))
+}
+
+// WritePlanDigest sends the digest of a plan after the totals, see protocol.HasPlan.
+func WritePlanDigest(dst io.Writer, digest PlanDigest) error {
+	if _, err := dst.Write(digest[:]); err != nil {
+		return fmt.Errorf("write plan: %w", err)
+	}
+
+	return nil
+}
+
+// ReadPlanDigest reads a digest sent with WritePlanDigest. It reads nothing past it.
+func ReadPlanDigest(src io.Reader) (PlanDigest, error) {
+	var digest PlanDigest
+
+	if _, err := io.ReadFull(src, digest[:]); err != nil {
+		return digest, fmt.Errorf("read plan: %w", err)
+	}
+
+	return digest, nil
+}
+
+// planStreams splits the files to send between u.Streams streams, chunking large files
+// so that they are spread out too.
+func (u *UploadInfo) planStreams() ([][]piece, error) {
+	plan := make([][]piece, u.Streams)
+	load := make([]int64, u.Streams)
+
+	assign := func(p piece) {
+		// Directories are cheap and go first, so that the directory entries arrive
+		// before anything else when possible.
+		stream := 0
+
+		if p.size > 0 {
+			for i := range load {
+				if load[i] < load[stream] {
+					stream = i
+				}
+			}
+		}
+
+		plan[stream] = append(plan[stream], p)
+		load[stream] += p.size
+	}
+
+	add := func(filePath string, directory string, info fs.FileInfo) {
+		if !u.selected(getArchivePath(filePath, directory)) {
+			return
+		}
+
+		if !info.Mode().IsRegular() || info.Size() <= chunkSize {
+			size := int64(0)
+
+			if info.Mode().IsRegular() {
+				size = info.Size()
+			}
+
+			assign(piece{filePath: filePath, directory: directory, info: info, regular: info.Mode().IsRegular(), size: size})
+			return
+		}
+
+		for offset := int64(0); offset < info.Size(); offset += chunkSize {
+			assign(piece{
+				filePath:  filePath,
+				directory: directory,
+				info:      info,
+				regular:   true,
+				chunked:   true,
+				offset:    offset,
+				size:      min(chunkSize, info.Size()-offset),
+			})
+		}
+	}
+
+	for _, srcFilePath := range u.Filenames {
+		basePath := path.Dir(srcFilePath)
+		filter, err := u.Filters.forRoot(srcFilePath)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if err := walk(srcFilePath, u.follows(), func(filePath string, info fs.FileInfo) error {
+			excluded, err := filter.excluded(filePath, info)
+
+			if err != nil {
+				return err
+			}
+
+			if excluded {
+				return fs.SkipDir
+			}
+
+			add(filePath, basePath, info)
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+	}
+
+	return plan, nil
+}
+
+// addPieceToTarArchive sends a piece of the plan, either as a whole file or as a chunk
+// marked with the offset of the chunk and the size of the whole file.
+func (u *UploadInfo) addPieceToTarArchive(tarWriter *tar.Writer, p piece) error {
+	if !p.chunked {
+		return u.addFileToTarArchive(tarWriter, p.filePath, p.directory, p.info)
+	}
+
+	archivePath := getArchivePath(p.filePath, p.directory)
+	fp, err := os.Open(p.filePath)
+
+	if err != nil {
+		return fmt.Errorf("open file: %w", err)
+	}
+
+	defer func() {
+		if err := fp.Close(); err != nil {
+			_, _ = fmt.Fprintf(os.Stderr, "Error closing file: %v\n", err)
+		}
+	}()
+
+	fileInfo, err := fp.Stat()
+
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(fileInfo, archivePath)
+
+	if err != nil {
+		return err
+	}
+
+	header.Name = archivePath
+	header.Size = p.size
+	header.PAXRecords = map[string]string{
+		protocol.PAXOffset: strconv.FormatInt(p.offset, 10),
+		protocol.PAXSize:   strconv.FormatInt(fileInfo.Size(), 10),
+	}
+
+	var h hash.Hash
+
+	if u.Checksum != "" {
+		if h = protocol.NewHash(u.Checksum); h == nil {
+			return fmt.Errorf("unsupported checksum %s", u.Checksum)
+		}
+	}
+
+	if h != nil && u.TrailingChecksums {
+		header.PAXRecords[protocol.PAXTrailer] = u.Checksum
+	} else if h != nil {
+		if _, err := io.Copy(h, io.NewSectionReader(fp, p.offset, p.size)); err != nil {
+			return fmt.Errorf("checksum %s: %w", p.filePath, err)
+		}
+
+		header.PAXRecords[protocol.PAXChecksumPrefix+u.Checksum] = hex.EncodeToString(h.Sum(nil))
+		h = nil
+	}
+
+	u.addXattrs(header, p.filePath)
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+
+	if p.offset == 0 {
+		u.Progress.File(archivePath)
+	}
+
+	var dest io.Writer = u.Progress.writer(tarWriter)
+
+	if h != nil {
+		dest = io.MultiWriter(dest, h)
+	}
+
+	// A file that shrank since the plan was made is caught here, as the tar writer
+	// refuses to finish an entry that's too short.
+	if _, err := io.Copy(dest, io.NewSectionReader(fp, p.offset, p.size)); err != nil {
+		return err
+	}
+
+	return addTrailer(tarWriter, archivePath, u.Checksum, h)
+}
+
+// receiveChunk writes a chunk of a file sent over several streams. Other streams may be
+// writing the rest of the file at the same time, so the file is only ever set to its
+// full size and written in place.
+func (d DownloadInfo) receiveChunk(header *tar.Header, filePath string, src io.Reader, verify bool) error {
+	offset, err := strconv.ParseInt(header.PAXRecords[protocol.PAXOffset], 10, 64)
+
+	if err != nil {
+		return fmt.Errorf("parse offset of %s: %w", filePath, err)
+	}
+
+	size, err := strconv.ParseInt(header.PAXRecords[protocol.PAXSize], 10, 64)
+
+	if err != nil {
+		return fmt.Errorf("parse size of %s: %w", filePath, err)
+	}
+
+	d.Progress.Printf("Receiving %s (from %s)\n", filePath, common.PrettifySize(offset))
+
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o775); err != nil {
+		return fmt.Errorf("create directory %s: %w", filepath.Dir(filePath), err)
+	}
+
+	fp, err := os.OpenFile(filePath, os.O_RDWR|os.O_CREATE|oNoFollow, 0o666)
+
+	if err != nil {
+		return fmt.Errorf("create %s: %w", filePath, err)
+	}
+
+	defer func() {
+		_ = fp.Close()
+	}()
+
+	localFileInfo, err := fp.Stat()
+
+	if err != nil {
+		return fmt.Errorf("stat %s: %w", filePath, err)
+	}
+
+	algorithm, expected := expectedDigest(header)
+
+	var h hash.Hash
+
+	if algorithm != "" {
+		h = protocol.NewHash(algorithm)
+	}
+
+	// Chunks are always written unless asked to check what's already there, as another
+	// stream may have just set the file to its full size.
+	if h != nil && verify && localFileInfo.Size() == size {
+		if _, err := io.Copy(h, io.NewSectionReader(fp, offset, header.Size)); err != nil {
+			return fmt.Errorf("hash %s: %w", filePath, err)
+		}
+
+		if hex.EncodeToString(h.Sum(nil)) == expected {
+			if _, err := io.Copy(io.Discard, src); err != nil {
+				return fmt.Errorf("skip %s: %w", filePath, err)
+			}
+
+			_, err := d.readTrailer(header)
+
+			return err
+		}
+
+		h.Reset()
+	}
+
+	if err := fp.Truncate(size); err != nil {
+		return fmt.Errorf("set size of %s: %w", filePath, err)
+	}
+
+	var dest io.Writer = io.NewOffsetWriter(fp, offset)
+
+	if h != nil {
+		dest = io.MultiWriter(dest, h)
+	}
+
+	if _, err := io.Copy(dest, src); err != nil {
+		return fmt.Errorf("write %s: %w", filePath, err)
+	}
+
+	trailer, err := d.readTrailer(header)
+
+	if err != nil {
+		return err
+	}
+
+	if trailer != "" {
+		expected = trailer
+	}
+
+	if h != nil {
+		if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+			return fmt.Errorf("%w: %s from %d has %s %s but the remote file has %s", protocol.ErrChecksumMismatch, filePath, offset, algorithm, actual, expected)
+		}
+	}
+
+	if err := fp.Chmod(header.FileInfo().Mode()); err != nil {
+		return fmt.Errorf("change filemode: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,331 @@
+package serve
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/l-donovan/qcp/common"
+)
+
+// Limit caps the bandwidth of a transfer, as what goes over the wire.
+type Limit struct {
+	// Rate is in bytes per second, and 0 means there's no limit.
+	Rate int64
+
+	// Schedule holds the times of day the limit applies in, and the limit always applies
+	// if it's empty. Location is the name of the time zone the times are in, like
+	// Europe/Berlin, so that both ends of a transfer read them the same way even across
+	// a change to or from daylight saving time. Zone is the offset from UTC in seconds,
+	// for when there's no such name or the other side doesn't know it.
+	Schedule []Window
+	Location string
+	Zone     int
+}
+
+// Window is a time of day, as how long after midnight it starts and ends. A window that
+// ends before it starts goes past midnight.
+type Window struct {
+	From time.Duration
+	To   time.Duration
+}
+
+func (w Window) contains(t time.Duration) bool {
+	if w.From <= w.To {
+		return w.From <= t && t < w.To
+	}
+
+	return t >= w.From || t < w.To
+}
+
+func (w Window) String() string {
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+
+	return clock(w.From) + "-" + clock(w.To)
+}
+
+// Empty reports whether there's no limit.
+func (l Limit) Empty() bool {
+	return l.Rate == 0
+}
+
+// location returns the time zone the schedule is in.
+func (l Limit) location() *time.Location {
+	if l.Location != "" {
+		if loc, err := time.LoadLocation(l.Location); err == nil {
+			return loc
+		}
+	}
+
+	return time.FixedZone("", l.Zone)
+}
+
+// active reports whether the limit applies at now, which is in the schedule's time zone.
+func (l Limit) active(now time.Time) bool {
+	if len(l.Schedule) == 0 {
+		return true
+	}
+
+	sinceMidnight := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+
+	for _, w := range l.Schedule {
+		if w.contains(sinceMidnight) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Split returns the limit for each of n streams that share it.
+func (l Limit) Split(n int) Limit {
+	if l.Empty() || n <= 1 {
+		return l
+	}
+
+	l.Rate = max(l.Rate/int64(n), 1)
+
+	return l
+}
+
+// ParseRate parses a rate like 500k, 20MiB/s or 1.5G, in bytes per second.
+func ParseRate(s string) (int64, error) {
+	rate, err := common.ParseSize(strings.TrimSuffix(strings.TrimSpace(s), "/s"))
+
+	if err != nil || rate <= 0 {
+		return 0, fmt.Errorf("invalid rate %s", s)
+	}
+
+	return rate, nil
+}
+
+// LocalZone returns the name of the local time zone, from $TZ or from where
+// /etc/localtime links to, or an empty string if there's no telling.
+func LocalZone() string {
+	name, ok := os.LookupEnv("TZ")
+
+	if !ok {
+		target, err := os.Readlink("/etc/localtime")
+
+		if err != nil {
+			return ""
+		}
+
+		_, name, _ = strings.Cut(target, "zoneinfo/")
+	}
+
+	name = strings.TrimPrefix(name, ":")
+
+	// Only names the other side can look up are any use, and an empty one means UTC.
+	if name == "" || name == "Local" {
+		return ""
+	}
+
+	if _, err := time.LoadLocation(name); err != nil {
+		return ""
+	}
+
+	return name
+}
+
+// ParseSchedule parses comma separated windows like 09:00-17:00 or 22:00-06:30, in the
+// local time zone.
+func ParseSchedule(s string) ([]Window, error) {
+	var schedule []Window
+
+	for _, field := range strings.Split(s, ",") {
+		from, to, found := strings.Cut(strings.TrimSpace(field), "-")
+
+		if !found {
+			return nil, fmt.Errorf("invalid schedule %s", s)
+		}
+
+		var w Window
+		var err error
+
+		if w.From, err = parseClock(from); err != nil {
+			return nil, fmt.Errorf("invalid schedule %s", s)
+		}
+
+		// A window starting at the end of the day would never begin.
+		if w.From == 24*time.Hour {
+			return nil, fmt.Errorf("invalid schedule %s: 24:00 only ends a window", s)
+		}
+
+		if w.To, err = parseClock(to); err != nil {
+			return nil, fmt.Errorf("invalid schedule %s", s)
+		}
+
+		if w.From == w.To {
+			return nil, fmt.Errorf("invalid schedule %s: %s is empty", s, w)
+		}
+
+		schedule = append(schedule, w)
+	}
+
+	return schedule, nil
+}
+
+// parseClock parses a time of day like 9:00 or 17:30, or 24:00 for the end of the day.
+func parseClock(s string) (time.Duration, error) {
+	hours, minutes, found := strings.Cut(strings.TrimSpace(s), ":")
+
+	if !found || !isDigits(hours) || len(hours) > 2 || !isDigits(minutes) || len(minutes) != 2 {
+		return 0, fmt.Errorf("invalid time of day %s", s)
+	}
+
+	h, _ := strconv.Atoi(hours)
+	m, _ := strconv.Atoi(minutes)
+
+	if m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %s", s)
+	}
+
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// isDigits reports whether s is made of nothing but decimal digits, unlike what
+// strconv.Atoi takes, which may have a sign.
+func isDigits(s string) bool {
+	return s != "" && strings.Trim(s, "0123456789") == ""
+}
+
+// WriteLimit sends a limit to the other side of a transfer, so that it keeps to it too.
+func WriteLimit(dst io.Writer, limit Limit) error {
+	if err := gob.NewEncoder(dst).Encode(limit); err != nil {
+		return fmt.Errorf("encode limit: %w", err)
+	}
+
+	return nil
+}
+
+// ReadLimit reads a limit sent with WriteLimit.
+func ReadLimit(src io.Reader) (Limit, error) {
+	var limit Limit
+
+	if err := gob.NewDecoder(src).Decode(&limit); err != nil {
+		return limit, fmt.Errorf("decode limit: %w", err)
+	}
+
+	if limit.Rate < 0 {
+		return limit, fmt.Errorf("invalid rate %d", limit.Rate)
+	}
+
+	return limit, nil
+}
+
+// Throttle keeps a transfer to a Limit with a token bucket, which holds up to a quarter
+// of a second's worth of bytes so that short bursts go through at full speed. Several
+// streams of a transfer can share one. Its methods do nothing on a nil Throttle.
+type Throttle struct {
+	mu sync.Mutex
+
+	limit  Limit
+	zone   *time.Location
+	tokens float64
+	last   time.Time
+}
+
+// NewThrottle returns a Throttle for limit, or nil if there's no limit.
+func NewThrottle(limit Limit) *Throttle {
+	if limit.Empty() {
+		return nil
+	}
+
+	return &Throttle{limit: limit, zone: limit.location(), tokens: float64(limit.Rate) / 4, last: time.Now()}
+}
+
+// burst is the most that may go through at once, which is what the bucket holds.
+func (t *Throttle) burst() int {
+	return int(max(t.limit.Rate/4, 1))
+}
+
+// take spends n tokens, waiting for the bucket to refill if it runs out.
+func (t *Throttle) take(n int) {
+	if t == nil || n <= 0 {
+		return
+	}
+
+	t.mu.Lock()
+
+	now := time.Now()
+	rate := float64(t.limit.Rate)
+	t.tokens = min(t.tokens+now.Sub(t.last).Seconds()*rate, rate/4)
+	t.last = now
+
+	if !t.limit.active(now.In(t.zone)) {
+		t.mu.Unlock()
+		return
+	}
+
+	// The bucket may run into debt, which whoever comes next waits out as well.
+	t.tokens -= float64(n)
+	wait := time.Duration(-t.tokens / rate * float64(time.Second))
+
+	t.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// writer keeps what's written to w to the limit.
+func (t *Throttle) writer(w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+
+	return &throttledWriter{w, t}
+}
+
+type throttledWriter struct {
+	w        io.Writer
+	throttle *Throttle
+}
+
+func (w *throttledWriter) Write(b []byte) (int, error) {
+	written := 0
+
+	for len(b) > 0 {
+		chunk := b[:min(len(b), w.throttle.burst())]
+		n, err := w.w.Write(chunk)
+		written += n
+		w.throttle.take(n)
+
+		if err != nil {
+			return written, err
+		}
+
+		b = b[n:]
+	}
+
+	return written, nil
+}
+
+// reader keeps what's read from r to the limit.
+func (t *Throttle) reader(r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+
+	return &throttledReader{r, t}
+}
+
+type throttledReader struct {
+	r        io.Reader
+	throttle *Throttle
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b[:min(len(b), r.throttle.burst())])
+	r.throttle.take(n)
+
+	return n, err
+}
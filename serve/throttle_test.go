@@ -0,0 +1,104 @@
+package serve
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestWindowContains(t *testing.T) {
+	clock := func(hours, minutes int) time.Duration {
+		return time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute
+	}
+
+	day := Window{clock(9, 0), clock(17, 0)}
+	night := Window{clock(22, 0), clock(6, 30)}
+	evening := Window{clock(18, 0), clock(24, 0)}
+
+	tests := []struct {
+		name   string
+		window Window
+		at     time.Duration
+		want   bool
+	}{
+		{"start of the day", day, clock(9, 0), true},
+		{"during the day", day, clock(12, 0), true},
+		{"end of the day", day, clock(17, 0), false},
+		{"before the day", day, clock(8, 59), false},
+		{"start of the night", night, clock(22, 0), true},
+		{"before midnight", night, clock(23, 59), true},
+		{"midnight", night, 0, true},
+		{"after midnight", night, clock(3, 0), true},
+		{"end of the night", night, clock(6, 30), false},
+		{"between nights", night, clock(12, 0), false},
+		{"before the night", night, clock(21, 59), false},
+		{"until the end of the day", evening, clock(23, 59), true},
+		{"midnight after the evening", evening, 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.contains(tt.at); got != tt.want {
+				t.Fatalf("%s contains %s: got %t, want %t", tt.window, tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		want     []string
+		isErr    bool
+	}{
+		{"09:00-17:00", []string{"09:00-17:00"}, false},
+		{"9:00-17:30", []string{"09:00-17:30"}, false},
+		{" 22:00 - 06:30 , 12:00-13:00", []string{"22:00-06:30", "12:00-13:00"}, false},
+		{"18:00-24:00", []string{"18:00-24:00"}, false},
+		{"00:00-24:00", []string{"00:00-24:00"}, false},
+		{"", nil, true},
+		{"09:00", nil, true},
+		{"09:00-", nil, true},
+		{"9:00xyz-17:00", nil, true},
+		{"09:00-17:00xyz", nil, true},
+		{"09:00-17:00,", nil, true},
+		{"9-17", nil, true},
+		{"9:0-17:00", nil, true},
+		{"+9:00-17:00", nil, true},
+		{"-1:00-17:00", nil, true},
+		{"09:60-17:00", nil, true},
+		{"25:00-06:00", nil, true},
+		{"24:01-06:00", nil, true},
+		{"24:00-06:00", nil, true},
+		{"09:00-09:00", nil, true},
+		{"123:00-17:00", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.schedule, func(t *testing.T) {
+			schedule, err := ParseSchedule(tt.schedule)
+
+			if tt.isErr {
+				if err == nil {
+					t.Fatalf("got %v, want an error", schedule)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+
+			for _, w := range schedule {
+				got = append(got, w.String())
+			}
+
+			if !slices.Equal(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
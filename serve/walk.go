@@ -0,0 +1,117 @@
+package serve
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// linkPolicy is how symbolic links are sent.
+type linkPolicy int
+
+const (
+	// followFileLinks follows links to files, and the root itself if it's a link, but
+	// sends links to directories below the root as links rather than going into them.
+	followFileLinks linkPolicy = iota
+
+	// followAllLinks follows every link like cp -L, including links to directories.
+	followAllLinks
+
+	// followNoLinks sends every link as a link like cp -P.
+	followNoLinks
+)
+
+// follows returns how u sends symbolic links.
+func (u *UploadInfo) follows() linkPolicy {
+	switch {
+	case u.NoDereference:
+		return followNoLinks
+	case u.Dereference:
+		return followAllLinks
+	default:
+		return followFileLinks
+	}
+}
+
+// stat describes a file, following symbolic links as links says, where root is whether
+// it's what the walk started from. Links that don't lead anywhere are described as links
+// either way.
+func stat(filePath string, links linkPolicy, root bool) (fs.FileInfo, error) {
+	if links == followNoLinks {
+		return os.Lstat(filePath)
+	}
+
+	info, err := os.Stat(filePath)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return os.Lstat(filePath)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Directories below the root are only gone into if they really are directories.
+	if links == followFileLinks && !root && info.IsDir() {
+		return os.Lstat(filePath)
+	}
+
+	return info, nil
+}
+
+// walk calls fn for root and everything under it, parents first and in lexical order,
+// following symbolic links as links says. A directory that links back to one of its
+// parents is only visited once. If fn returns fs.SkipDir for a directory, what's in it
+// is skipped.
+func walk(root string, links linkPolicy, fn func(filePath string, info fs.FileInfo) error) error {
+	info, err := stat(root, links, true)
+
+	if err != nil {
+		return err
+	}
+
+	return walkInfo(root, info, links, nil, fn)
+}
+
+func walkInfo(filePath string, info fs.FileInfo, links linkPolicy, parents []fs.FileInfo, fn func(filePath string, info fs.FileInfo) error) error {
+	if err := fn(filePath, info); errors.Is(err, fs.SkipDir) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return nil
+	}
+
+	for _, parent := range parents {
+		if os.SameFile(parent, info) {
+			return nil
+		}
+	}
+
+	entries, err := os.ReadDir(filePath)
+
+	if err != nil {
+		return fmt.Errorf("read directory %s: %w", filePath, err)
+	}
+
+	parents = append(parents, info)
+
+	for _, entry := range entries {
+		entryPath := filepath.Join(filePath, entry.Name())
+		entryInfo, err := stat(entryPath, links, false)
+
+		if err != nil {
+			return err
+		}
+
+		if err := walkInfo(entryPath, entryInfo, links, parents, fn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package serve
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/l-donovan/qcp/protocol"
+)
+
+// addXattrs records the extended attributes of a file in its tar header if they're
+// being sent. Attributes that can't be read are left out with a warning.
+func (u *UploadInfo) addXattrs(header *tar.Header, filePath string) {
+	if !u.Xattrs {
+		return
+	}
+
+	xattrs, err := readXattrs(filePath, header.Typeflag != tar.TypeSymlink)
+
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "Skipping extended attributes of %s: %v\n", filePath, err)
+		return
+	}
+
+	if len(xattrs) == 0 {
+		return
+	}
+
+	if header.PAXRecords == nil {
+		header.PAXRecords = map[string]string{}
+	}
+
+	for name, value := range xattrs {
+		header.PAXRecords[protocol.PAXXattrPrefix+name] = value
+	}
+}
+
+// xattrWarnings remembers which attributes couldn't be set, so that a filesystem that
+// refuses one doesn't produce a warning for every file.
+type xattrWarnings map[string]bool
+
+// applyXattrs sets the extended attributes recorded in a tar header. Failures are only
+// warned about, as the target filesystem or user may not allow some of them.
+func (w xattrWarnings) applyXattrs(header *tar.Header, filePath string) {
+	for key, value := range header.PAXRecords {
+		name, found := strings.CutPrefix(key, protocol.PAXXattrPrefix)
+
+		if !found {
+			continue
+		}
+
+		err := writeXattr(filePath, name, value, header.Typeflag != tar.TypeSymlink)
+
+		if err == nil || w[name] {
+			continue
+		}
+
+		w[name] = true
+		_, _ = fmt.Fprintf(os.Stderr, "Couldn't set %s on %s: %v. Further failures to set it won't be reported.\n", name, filePath, err)
+	}
+}
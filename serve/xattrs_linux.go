@@ -0,0 +1,96 @@
+//go:build linux
+
+package serve
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// readXattrs returns the extended attributes of a file, or of a symbolic link itself
+// unless follow is set. Filesystems without them have none.
+func readXattrs(filePath string, follow bool) (map[string]string, error) {
+	list, get := unix.Llistxattr, unix.Lgetxattr
+
+	if follow {
+		list, get = unix.Listxattr, unix.Getxattr
+	}
+
+	names, err := readSized(func(dest []byte) (int, error) {
+		return list(filePath, dest)
+	})
+
+	if errors.Is(err, unix.ENOTSUP) {
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	xattrs := map[string]string{}
+
+	for _, name := range strings.Split(string(names), "\x00") {
+		if name == "" {
+			continue
+		}
+
+		value, err := readSized(func(dest []byte) (int, error) {
+			return get(filePath, name, dest)
+		})
+
+		// The attribute may have been removed since it was listed.
+		if errors.Is(err, unix.ENODATA) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		xattrs[name] = string(value)
+	}
+
+	return xattrs, nil
+}
+
+// readSized calls read once to size the buffer and again to fill it, trying again if
+// what's read grew in between.
+func readSized(read func(dest []byte) (int, error)) ([]byte, error) {
+	for {
+		size, err := read(nil)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if size == 0 {
+			return nil, nil
+		}
+
+		dest := make([]byte, size)
+		n, err := read(dest)
+
+		if errors.Is(err, unix.ERANGE) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return dest[:n], nil
+	}
+}
+
+// writeXattr sets an extended attribute of a file, or of a symbolic link itself unless
+// follow is set.
+func writeXattr(filePath string, name string, value string, follow bool) error {
+	if follow {
+		return unix.Setxattr(filePath, name, []byte(value), 0)
+	}
+
+	return unix.Lsetxattr(filePath, name, []byte(value), 0)
+}
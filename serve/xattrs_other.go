@@ -0,0 +1,14 @@
+//go:build !linux
+
+package serve
+
+import "errors"
+
+// readXattrs finds no extended attributes, as they're only supported on Linux.
+func readXattrs(_ string, _ bool) (map[string]string, error) {
+	return nil, nil
+}
+
+func writeXattr(_ string, _ string, _ string, _ bool) error {
+	return errors.ErrUnsupported
+}
@@ -22,19 +22,21 @@ type BrowseSession interface {
 
 type browseSession struct {
 	common.Session
-	path   string
-	client *ssh.Client
+	path     string
+	client   *ssh.Client
+	features protocol.Features
 }
 
 func Browse(client *ssh.Client, location string) (BrowseSession, error) {
-	executable, err := common.FindExecutable(client, "qcp")
+	executable, features, err := Handshake(client)
 
 	if err != nil {
-		return nil, fmt.Errorf("find executable: %w", err)
+		return nil, fmt.Errorf("handshake: %w", err)
 	}
 
 	cmd, err := protocol.Parser.Marshal(executable, map[string]any{
 		"mode":     "present",
+		"features": features.String(),
 		"location": location,
 	})
 
@@ -48,7 +50,31 @@ func Browse(client *ssh.Client, location string) (BrowseSession, error) {
 		return nil, fmt.Errorf("start session: %w", err)
 	}
 
-	return &browseSession{session, location, client}, nil
+	return &browseSession{session, location, client, features}, nil
+}
+
+// readResponse reads the remote's answer to a command, which is either terminated by
+// EndTransmission or is an error frame.
+func (s browseSession) readResponse() (string, error) {
+	srcReader := bufio.NewReader(s.Stdout)
+	result, err := srcReader.ReadString(protocol.EndTransmission)
+
+	// We don't expect an EOF here, so we treat it as a normal error
+	if err != nil {
+		return "", err
+	}
+
+	if protocol.IsErrorFrame(result) {
+		remoteErr, err := protocol.ParseErrorFrame(result)
+
+		if err != nil {
+			return "", fmt.Errorf("parse error frame: %w", err)
+		}
+
+		return "", remoteErr
+	}
+
+	return strings.TrimSuffix(result, string(protocol.EndTransmission)), nil
 }
 
 func (s *browseSession) EnterDirectory(name string) error {
@@ -56,29 +82,32 @@ func (s *browseSession) EnterDirectory(name string) error {
 		return err
 	}
 
+	if s.features.Has(protocol.CapErrorFrames) {
+		if _, err := s.readResponse(); err != nil {
+			return fmt.Errorf("enter %s: %w", name, err)
+		}
+	}
+
 	s.path = filepath.Join(s.path, name)
 
 	return nil
 }
 
 func (s browseSession) ListContents() ([]common.ThinDirEntry, error) {
-	srcReader := bufio.NewReader(s.Stdout)
-
 	// List files
 	if _, err := s.Stdin.Write([]byte{protocol.ListFiles}); err != nil {
 		return nil, fmt.Errorf("send list files command: %w", err)
 	}
 
 	// Get output
-	result, err := srcReader.ReadString(protocol.EndTransmission)
+	result, err := s.readResponse()
 
-	// We don't expect an EOF here, so we treat it as a normal error
 	if err != nil {
 		return nil, fmt.Errorf("read list files output: %w", err)
 	}
 
 	var entries []common.ThinDirEntry
-	serializedEntries := strings.Split(strings.TrimSuffix(result, string(protocol.EndTransmission)), string(protocol.FileSeparator))
+	serializedEntries := strings.Split(result, string(protocol.FileSeparator))
 
 	for _, rawEntry := range serializedEntries {
 		// This happens in empty directories because strings.Split("", "<separator>") returns []string{""}, not []string{}
@@ -101,7 +130,7 @@ func (s browseSession) ListContents() ([]common.ThinDirEntry, error) {
 func (s browseSession) DownloadFile(name string) (DownloadSession, error) {
 	srcFilePath := filepath.Join(s.path, name)
 
-	return StartDownload(s.client, []string{srcFilePath}, "", 0)
+	return StartDownload(s.client, []string{srcFilePath}, "", 0, TransferOptions{})
 }
 
 func (s browseSession) Stop() {
@@ -1,11 +1,11 @@
 package sessions
 
 import (
-	"errors"
+	"encoding/gob"
 	"fmt"
 	"io"
 	"os"
-	"strings"
+	"path/filepath"
 
 	"github.com/l-donovan/qcp/common"
 	"github.com/l-donovan/qcp/protocol"
@@ -15,33 +15,177 @@ import (
 
 type DownloadSession interface {
 	GetDownloadInfo(filename string) (serve.DownloadInfo, error)
+	RemoteError() error
+	SendSignatures(signatures serve.Signatures) error
 	Stop()
 }
 
 type downloadSession common.Session
 
-func StartDownload(client *ssh.Client, filepaths []string, offsetFile string, offsetPos int64) (DownloadSession, error) {
-	executable, err := common.FindExecutable(client, "qcp")
+func StartDownload(client *ssh.Client, filepaths []string, offsetFile string, offsetPos int64, options TransferOptions) (DownloadSession, error) {
+	executable, features, err := Handshake(client)
 
 	if err != nil {
-		return nil, fmt.Errorf("find executable: %w", err)
+		return nil, fmt.Errorf("handshake: %w", err)
 	}
 
-	cmd, err := protocol.Parser.Marshal(executable, map[string]any{
+	features, err = features.SelectCompression(options.Compression, options.Level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing checks the checksums a browser is sent, and tar warns about them.
+	if options.ForBrowser {
+		features = features.Without(protocol.CapSparse)
+		features.Checksums = nil
+	}
+
+	if options.Delta && !features.Has(protocol.CapDelta) {
+		return nil, fmt.Errorf("%w: remote qcp doesn't support deltas", protocol.ErrNoCommon)
+	}
+
+	if err := options.requirePreserve(features); err != nil {
+		return nil, err
+	}
+
+	if err := options.requireFilters(features); err != nil {
+		return nil, err
+	}
+
+	if err := options.requireLimit(features); err != nil {
+		return nil, err
+	}
+
+	flags := serveFlags{
+		delta:         options.Delta,
+		filters:       !options.Filters.Empty(),
+		limit:         !options.Limit.Empty(),
+		preserve:      options.Preserve,
+		noDereference: options.NoDereference,
+		dereference:   options.Dereference,
+		xattrs:        options.Xattrs,
+		verify:        options.Verify,
+	}
+
+	// Older remotes can only be told where to resume, and skip every file before it.
+	if !options.resume.Empty() {
+		if features.Has(protocol.CapJournal) {
+			flags.resume = true
+		} else if inFlight := options.resume.InFlight; inFlight != nil && offsetFile == "" {
+			offsetFile, offsetPos = inFlight.Path, inFlight.Offset
+		}
+	}
+
+	session, err := startServe(client, executable, features, filepaths, offsetFile, offsetPos, flags)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if flags.filters {
+		if err := serve.WriteFilters(session.Stdin, options.Filters); err != nil {
+			session.Stop()
+			return nil, err
+		}
+	}
+
+	if flags.limit {
+		if err := serve.WriteLimit(session.Stdin, options.Limit); err != nil {
+			session.Stop()
+			return nil, err
+		}
+	}
+
+	if flags.resume {
+		if err := serve.WriteResumeState(session.Stdin, options.resume); err != nil {
+			session.Stop()
+			return nil, err
+		}
+	}
+
+	return session, nil
+}
+
+// serveFlags are the optional flags of the serve mode. Delta, only, filters, limit and
+// resume ask the remote to read more from stdin before it serves anything. Paths to
+// serve come first, then filters, then the limit, then the resume state, then signatures.
+type serveFlags struct {
+	delta         bool
+	only          bool
+	filters       bool
+	limit         bool
+	resume        bool
+	preserve      bool
+	noDereference bool
+	dereference   bool
+	xattrs        bool
+	verify        bool
+}
+
+// startServe starts serving files on the remote host once the handshake is done.
+func startServe(client *ssh.Client, executable string, features protocol.Features, filepaths []string, offsetFile string, offsetPos int64, flags serveFlags) (downloadSession, error) {
+	values := map[string]any{
 		"mode":        "serve",
+		"features":    features.String(),
 		"sources":     filepaths,
 		"offset-file": offsetFile,
 		"offset-pos":  fmt.Sprintf("%d", offsetPos), // TODO: This is a goparse limitation. It calls Sprintf with %s internally, when it should use %v.
-	})
+	}
+
+	// Older remotes don't know about these, but then they're never asked for.
+	if flags.delta {
+		values["delta"] = true
+	}
+
+	if flags.only {
+		values["only"] = true
+	}
+
+	if flags.filters {
+		values["filters"] = true
+	}
+
+	if flags.limit {
+		values["limit"] = true
+	}
+
+	if flags.resume {
+		values["resume"] = true
+	}
+
+	if flags.preserve {
+		values["preserve"] = true
+	}
+
+	if flags.noDereference {
+		values["no-dereference"] = true
+	}
+
+	// Older remotes follow every link anyway.
+	if flags.dereference && features.Has(protocol.CapFollow) {
+		values["dereference"] = true
+	}
+
+	if flags.xattrs {
+		values["xattrs"] = true
+	}
+
+	// Older remotes always send checksums ahead of files.
+	if flags.verify && features.Has(protocol.CapTrailers) {
+		values["verify"] = true
+	}
+
+	cmd, err := protocol.Parser.Marshal(executable, values)
 
 	if err != nil {
-		return nil, fmt.Errorf("generate command: %w", err)
+		return downloadSession{}, fmt.Errorf("generate command: %w", err)
 	}
 
 	session, err := common.Start(client, cmd)
 
 	if err != nil {
-		return nil, fmt.Errorf("start session: %w", err)
+		return downloadSession{}, fmt.Errorf("start session: %w", err)
 	}
 
 	return downloadSession(session), nil
@@ -55,18 +199,72 @@ func GetDownloadInfo(filename string, src io.Reader) (serve.DownloadInfo, error)
 	}
 
 	shouldUnpack := f[0]&protocol.ShouldUnpack > 0
+	compression, err := protocol.CompressionFromFlags(f[0])
+
+	if err != nil {
+		return serve.DownloadInfo{}, err
+	}
 
 	downloadInfo := serve.DownloadInfo{
 		Filename:     filename,
 		Contents:     src,
 		ShouldUnpack: shouldUnpack,
+		Compression:  compression,
+	}
+
+	if f[0]&protocol.HasTotals > 0 {
+		downloadInfo.Totals, err = serve.ReadTotals(src)
+
+		if err != nil {
+			return downloadInfo, err
+		}
+	}
+
+	if f[0]&protocol.HasPlan > 0 {
+		downloadInfo.Plan, err = serve.ReadPlanDigest(src)
+
+		if err != nil {
+			return downloadInfo, err
+		}
 	}
 
 	return downloadInfo, nil
 }
 
 func (s downloadSession) GetDownloadInfo(filename string) (serve.DownloadInfo, error) {
-	return GetDownloadInfo(filename, s.Stdout)
+	downloadInfo, err := GetDownloadInfo(filename, s.Stdout)
+
+	// The remote process exits without writing anything if it can't serve the files.
+	if err != nil {
+		if remoteErr := s.RemoteError(); remoteErr != nil {
+			return downloadInfo, remoteErr
+		}
+	}
+
+	return downloadInfo, err
+}
+
+func (s downloadSession) RemoteError() error {
+	return common.Session(s).RemoteError()
+}
+
+// SendSignatures sends signatures of the files already at the destination, which the
+// remote sends deltas against.
+func (s downloadSession) SendSignatures(signatures serve.Signatures) error {
+	if err := gob.NewEncoder(s.Stdin).Encode(signatures); err != nil {
+		return fmt.Errorf("send signatures: %w", err)
+	}
+
+	return nil
+}
+
+// sendPaths sends the paths in the tarball to serve, see serveFlags.
+func (s downloadSession) sendPaths(paths []string) error {
+	if err := gob.NewEncoder(s.Stdin).Encode(paths); err != nil {
+		return fmt.Errorf("send paths: %w", err)
+	}
+
+	return nil
 }
 
 func (s downloadSession) Stop() {
@@ -74,44 +272,62 @@ func (s downloadSession) Stop() {
 	s.Session.Close()
 }
 
-func Download(client *ssh.Client, srcFilePaths []string, dstFilePath string) error {
-	var offsetFile string
-	var offsetPos int64
+func Download(client *ssh.Client, srcFilePaths []string, dstFilePath string, options TransferOptions) error {
+	if options.Streams > 1 {
+		return downloadStreams(client, srcFilePaths, dstFilePath, options)
+	}
 
-	// Check for a partially downloaded directory.
-	progressFilename := common.CreateIdentifier(srcFilePaths) + ".progress"
+	// The journal of an interrupted download is kept in the destination.
+	if dstFilePath != "" {
+		if err := os.MkdirAll(dstFilePath, 0o775); err != nil {
+			return fmt.Errorf("create directory %s: %w", dstFilePath, err)
+		}
+	}
 
-	progressFile, err := os.OpenFile(progressFilename, os.O_RDWR|os.O_CREATE, 0o644)
+	journal, err := serve.OpenJournal(filepath.Join(dstFilePath, serve.DownloadJournalName))
 
 	if err != nil {
-		return fmt.Errorf("open %s: %w", progressFilename, err)
+		return err
 	}
 
 	defer func() {
-		_ = progressFile.Close()
+		_ = journal.Close()
 	}()
 
-	contents, err := io.ReadAll(progressFile)
+	options.resume = journal.ResumeState(dstFilePath)
+
+	// Files received before are rehashed rather than skipped when verifying.
+	if options.Verify {
+		options.resume.Completed = nil
+	}
+
+	if inFlight := options.resume.InFlight; inFlight != nil {
+		fmt.Printf("Resuming download at %s (already downloaded %s)\n", inFlight.Path, common.PrettifySize(inFlight.Offset))
+	}
+
+	var signatures serve.Signatures
 
-	if err == nil {
-		if len(contents) > 0 {
-			offsetFile = strings.TrimSpace(string(contents))
+	if options.Delta {
+		var names []string
 
-			fileInfo, err := os.Stat(offsetFile)
+		for _, srcFilePath := range srcFilePaths {
+			roots, err := serve.ArchiveRoots(dstFilePath, srcFilePath)
 
 			if err != nil {
-				return fmt.Errorf("get current file info: %w", err)
+				return err
 			}
 
-			offsetPos = fileInfo.Size()
+			names = append(names, roots...)
+		}
 
-			fmt.Printf("Resuming download at %s (already downloaded %s)\n", offsetFile, common.PrettifySize(offsetPos))
+		signatures, err = serve.ComputeSignatures(dstFilePath, names)
+
+		if err != nil {
+			return fmt.Errorf("compute signatures: %w", err)
 		}
-	} else if !errors.Is(err, os.ErrNotExist) {
-		return fmt.Errorf("read %s: %w", progressFilename, err)
 	}
 
-	session, err := StartDownload(client, srcFilePaths, offsetFile, offsetPos)
+	session, err := StartDownload(client, srcFilePaths, "", 0, options)
 
 	if err != nil {
 		return fmt.Errorf("start download: %w", err)
@@ -119,23 +335,48 @@ func Download(client *ssh.Client, srcFilePaths []string, dstFilePath string) err
 
 	defer session.Stop()
 
+	if options.Delta {
+		if err := session.SendSignatures(signatures); err != nil {
+			return err
+		}
+	}
+
 	downloadInfo, err := session.GetDownloadInfo(dstFilePath)
 
 	if err != nil {
 		return fmt.Errorf("get download info: %w", err)
 	}
 
-	if err := downloadInfo.Receive(progressFile); err != nil {
-		return fmt.Errorf("receive %v: %w", srcFilePaths, err)
-	}
+	downloadInfo.Verify = options.Verify
+	downloadInfo.Preserve = options.Preserve
+	downloadInfo.Links = options.NoDereference
+	downloadInfo.Xattrs = options.Xattrs
+	downloadInfo.Atomic = options.Atomic
+	downloadInfo.OnConflict = options.OnConflict
+	downloadInfo.Prompter = common.DefaultPrompter(true)
+	downloadInfo.Throttle = serve.NewThrottle(options.Limit)
+	downloadInfo.Progress = serve.NewProgress("received")
+	downloadInfo.Progress.Expect(downloadInfo.Totals)
+
+	// Errors are printed where the progress bar would be.
+	defer downloadInfo.Progress.Clear()
+
+	if err := downloadInfo.Receive(journal); err != nil {
+		// A failure on the remote side cuts the stream short, in which case its error is
+		// the one worth reporting.
+		session.Stop()
+
+		if remoteErr := session.RemoteError(); remoteErr != nil {
+			err = remoteErr
+		}
 
-	if err := progressFile.Close(); err != nil {
-		return fmt.Errorf("close progress file: %w", err)
+		return fmt.Errorf("receive %v: %w", srcFilePaths, err)
 	}
 
-	if err := os.Remove(progressFilename); err != nil {
-		return fmt.Errorf("remove progress file: %w", err)
+	// The remote side may also fail after it has cleanly ended the stream.
+	if err := session.RemoteError(); err != nil {
+		return fmt.Errorf("serve %v: %w", srcFilePaths, err)
 	}
 
-	return nil
+	return journal.Remove()
 }
@@ -0,0 +1,61 @@
+package sessions
+
+import (
+	"fmt"
+
+	"github.com/l-donovan/qcp/common"
+	"github.com/l-donovan/qcp/protocol"
+	"golang.org/x/crypto/ssh"
+)
+
+// Handshake finds the qcp executable on the remote host and agrees on the features
+// both sides will use. Remote hosts running a qcp that predates the handshake are
+// reported as too old.
+func Handshake(client *ssh.Client) (string, protocol.Features, error) {
+	executable, err := common.FindExecutable(client, "qcp")
+
+	if err != nil {
+		return "", protocol.Features{}, fmt.Errorf("find executable: %w", err)
+	}
+
+	local := protocol.LocalFeatures()
+
+	cmd, err := protocol.Parser.Marshal(executable, map[string]any{
+		"mode":     "hello",
+		"features": local.String(),
+	})
+
+	if err != nil {
+		return "", protocol.Features{}, fmt.Errorf("generate command: %w", err)
+	}
+
+	session, err := client.NewSession()
+
+	if err != nil {
+		return "", protocol.Features{}, fmt.Errorf("create session: %w", err)
+	}
+
+	defer func() {
+		_ = session.Close()
+	}()
+
+	remote := protocol.LegacyFeatures()
+
+	// Versions of qcp without the handshake exit with a usage error, so a failure here
+	// just means we are talking to one of those.
+	if out, err := session.Output(cmd); err == nil {
+		remote, err = protocol.ParseFeatures(string(out))
+
+		if err != nil {
+			return "", protocol.Features{}, fmt.Errorf("parse remote features: %w", err)
+		}
+	}
+
+	features, err := protocol.Negotiate(local, remote)
+
+	if err != nil {
+		return "", protocol.Features{}, err
+	}
+
+	return executable, features, nil
+}
@@ -0,0 +1,100 @@
+package sessions
+
+import (
+	"fmt"
+
+	"github.com/l-donovan/qcp/protocol"
+	"github.com/l-donovan/qcp/serve"
+)
+
+// TransferOptions tweak how files are downloaded and uploaded.
+type TransferOptions struct {
+	// Verify rehashes files that are resumed or skipped because they already exist, so
+	// that corruption in files received earlier is caught too.
+	Verify bool
+
+	// Compression is an algorithm or protocol.CompressionAuto, which is also what an
+	// empty string means. Level 0 is the algorithm's default.
+	Compression string
+	Level       int
+
+	// Streams is how many sessions to split the transfer across. Resuming isn't
+	// supported with more than one.
+	Streams int
+
+	// Delta sends only the parts of files that differ from the copies already at the
+	// destination. It can't be combined with more than one stream.
+	Delta bool
+
+	// PreserveTimes sets the modification times of received files to the sender's.
+	PreserveTimes bool
+
+	// Preserve keeps times, owners, hard links, FIFOs and device nodes. It can't be
+	// combined with more than one stream. NoDereference sends symbolic links as links,
+	// and Dereference follows links to directories as well as links to files.
+	Preserve      bool
+	NoDereference bool
+	Dereference   bool
+
+	// Xattrs keeps extended attributes, including POSIX ACLs and file capabilities.
+	Xattrs bool
+
+	// Atomic writes files under a temporary name and moves them into place once they're
+	// complete. It can't be combined with more than one stream.
+	Atomic bool
+
+	// OnConflict is what to do with files that already exist, see serve.ConflictPolicies.
+	// It can't be combined with deltas or more than one stream.
+	OnConflict string
+
+	// Filters leave out files under the sources.
+	Filters serve.Filters
+
+	// Limit caps the bandwidth of the transfer, which both sides keep to.
+	Limit serve.Limit
+
+	// ForBrowser downloads a tarball to be passed on to a browser as it is, so it mustn't
+	// hold anything only qcp understands, such as sparse files without their holes or
+	// checksums.
+	ForBrowser bool
+
+	// resumable asks the remote to keep a journal so that an interrupted upload can be
+	// resumed, see Upload. resume is what the receiver has from an interrupted download.
+	resumable bool
+	resume    serve.ResumeState
+}
+
+// requirePreserve checks that the remote can preserve what options ask for.
+func (o TransferOptions) requirePreserve(features protocol.Features) error {
+	if (o.Preserve || o.NoDereference) && !features.Has(protocol.CapPreserve) {
+		return fmt.Errorf("%w: remote qcp can't preserve links or metadata", protocol.ErrNoCommon)
+	}
+
+	if o.Xattrs && !features.Has(protocol.CapXattrs) {
+		return fmt.Errorf("%w: remote qcp can't preserve extended attributes", protocol.ErrNoCommon)
+	}
+
+	return nil
+}
+
+// requireFilters checks that the remote can filter the files it sends.
+func (o TransferOptions) requireFilters(features protocol.Features) error {
+	if !o.Filters.Empty() && !features.Has(protocol.CapFilters) {
+		return fmt.Errorf("%w: remote qcp can't filter files", protocol.ErrNoCommon)
+	}
+
+	if o.Filters.Limited() && !features.Has(protocol.CapLimits) {
+		return fmt.Errorf("%w: remote qcp can't limit files by size, age or depth", protocol.ErrNoCommon)
+	}
+
+	return nil
+}
+
+// requireLimit checks that the remote can keep to a bandwidth limit.
+func (o TransferOptions) requireLimit(features protocol.Features) error {
+	if !o.Limit.Empty() && !features.Has(protocol.CapThrottle) {
+		return fmt.Errorf("%w: remote qcp can't limit bandwidth", protocol.ErrNoCommon)
+	}
+
+	return nil
+}
@@ -2,12 +2,14 @@ package sessions
 
 import (
 	"fmt"
+	"io"
 
 	"github.com/charmbracelet/bubbles/key"
 	"github.com/charmbracelet/bubbles/list"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/lipgloss"
 	"github.com/l-donovan/qcp/common"
+	"github.com/l-donovan/qcp/serve"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -34,9 +36,7 @@ func newItemDelegate(keys *delegateKeyMap, app *pickSession) list.ItemDelegate {
 		case tea.KeyMsg:
 			switch {
 			case key.Matches(msg, keys.choose):
-				if err := app.SelectFile(entry); err != nil {
-					return m.NewStatusMessage(fmt.Sprintf("Failed to select %s: %v", entry.Name, err))
-				}
+				return app.SelectFile(entry)
 			case key.Matches(msg, keys.enter):
 				if !entry.Mode.IsDir() {
 					return m.NewStatusMessage(fmt.Sprintf("Can't enter non-directory %s", entry.Name))
@@ -163,9 +163,10 @@ type pickSession struct {
 	keys          *listKeyMap
 	delegateKeys  *delegateKeyMap
 	browseSession BrowseSession
+	onConflict    string
 }
 
-func newPickSession(session BrowseSession, location string) (pickSession, error) {
+func newPickSession(session BrowseSession, location string, onConflict string) (pickSession, error) {
 	var (
 		delegateKeys = newDelegateKeyMap()
 		listKeys     = newListKeyMap()
@@ -176,6 +177,7 @@ func newPickSession(session BrowseSession, location string) (pickSession, error)
 		browseSession: session,
 		delegateKeys:  delegateKeys,
 		keys:          listKeys,
+		onConflict:    onConflict,
 	}
 
 	entries, err := m.GetFiles()
@@ -212,6 +214,12 @@ func (m pickSession) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
 	switch msg := msg.(type) {
+	case pickedMsg:
+		if msg.err != nil {
+			return m, m.list.NewStatusMessage(fmt.Sprintf("Failed to select %s: %v", msg.name, msg.err))
+		}
+
+		return m, nil
 	case tea.WindowSizeMsg:
 		h, v := appStyle.GetFrameSize()
 		m.list.SetSize(msg.Width-h, msg.Height-v)
@@ -272,7 +280,47 @@ func (m pickSession) GetFiles() ([]list.Item, error) {
 	return entries, nil
 }
 
-func (m pickSession) SelectFile(entry common.ThinDirEntry) error {
+// pickedMsg tells the picker how downloading a chosen file went.
+type pickedMsg struct {
+	name string
+	err  error
+}
+
+// pickDownload downloads a chosen file as a command the picker gives up the terminal
+// for, see tea.Exec.
+type pickDownload struct {
+	session pickSession
+	entry   common.ThinDirEntry
+}
+
+func (d pickDownload) Run() error {
+	return d.session.download(d.entry)
+}
+
+func (pickDownload) SetStdin(io.Reader)  {}
+func (pickDownload) SetStdout(io.Writer) {}
+func (pickDownload) SetStderr(io.Writer) {}
+
+// SelectFile downloads the chosen file and reports how that went with a pickedMsg.
+func (m pickSession) SelectFile(entry common.ThinDirEntry) tea.Cmd {
+	done := func(err error) tea.Msg {
+		return pickedMsg{entry.Name, err}
+	}
+
+	// Asking about a file that already exists needs the terminal, which the picker has
+	// to itself otherwise.
+	if m.onConflict == serve.ConflictAsk {
+		return tea.Exec(pickDownload{m, entry}, done)
+	}
+
+	err := m.download(entry)
+
+	return func() tea.Msg {
+		return done(err)
+	}
+}
+
+func (m pickSession) download(entry common.ThinDirEntry) error {
 	downloadSession, err := m.browseSession.DownloadFile(entry.Name)
 
 	if err != nil {
@@ -287,6 +335,9 @@ func (m pickSession) SelectFile(entry common.ThinDirEntry) error {
 		return fmt.Errorf("select file: %w", err)
 	}
 
+	downloadInfo.OnConflict = m.onConflict
+	downloadInfo.Prompter = common.DefaultPrompter(true)
+
 	if err := downloadInfo.Receive(nil); err != nil {
 		return fmt.Errorf("receive %s: %w", entry.Name, err)
 	}
@@ -298,7 +349,9 @@ func (m *pickSession) EnterDirectory(location string) error {
 	return m.browseSession.EnterDirectory(location)
 }
 
-func Pick(client *ssh.Client, location string) error {
+// Pick lets the user browse location and download what they choose, handling files
+// that already exist according to onConflict.
+func Pick(client *ssh.Client, location string, onConflict string) error {
 	browseSession, err := Browse(client, location)
 
 	if err != nil {
@@ -307,7 +360,7 @@ func Pick(client *ssh.Client, location string) error {
 
 	defer browseSession.Stop()
 
-	pickSession, err := newPickSession(browseSession, location)
+	pickSession, err := newPickSession(browseSession, location, onConflict)
 
 	if err != nil {
 		return err
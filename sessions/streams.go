@@ -0,0 +1,241 @@
+package sessions
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/l-donovan/qcp/protocol"
+	"github.com/l-donovan/qcp/serve"
+	"golang.org/x/crypto/ssh"
+)
+
+var errPlansDiffer = errors.New("the streams found different files, which changed while they were being listed")
+
+// runStreams runs fn for every stream at once and returns the first error. Once a
+// stream fails, stop is called so that the others give up rather than finish.
+func runStreams(streams int, fn func(stream int) error, stop func()) error {
+	errs := make(chan error, streams)
+
+	for i := 0; i < streams; i++ {
+		go func() {
+			errs <- fn(i)
+		}()
+	}
+
+	var firstErr error
+
+	for i := 0; i < streams; i++ {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+			stop()
+		}
+	}
+
+	return firstErr
+}
+
+// streamFeatures negotiates the features for a transfer split into several streams.
+func streamFeatures(client *ssh.Client, options TransferOptions) (string, protocol.Features, error) {
+	executable, features, err := Handshake(client)
+
+	if err != nil {
+		return "", features, fmt.Errorf("handshake: %w", err)
+	}
+
+	features, err = features.SelectCompression(options.Compression, options.Level)
+
+	if err != nil {
+		return "", features, err
+	}
+
+	if !features.Has(protocol.CapStreams) {
+		return "", features, fmt.Errorf("%w: remote qcp doesn't support multiple streams", protocol.ErrNoCommon)
+	}
+
+	if err := options.requirePreserve(features); err != nil {
+		return "", features, err
+	}
+
+	features.Streams = options.Streams
+
+	return executable, features, nil
+}
+
+func downloadStreams(client *ssh.Client, srcFilePaths []string, dstFilePath string, options TransferOptions) error {
+	executable, features, err := streamFeatures(client, options)
+
+	if err != nil {
+		return fmt.Errorf("start download: %w", err)
+	}
+
+	if err := options.requireFilters(features); err != nil {
+		return fmt.Errorf("start download: %w", err)
+	}
+
+	if err := options.requireLimit(features); err != nil {
+		return fmt.Errorf("start download: %w", err)
+	}
+
+	var sessions []DownloadSession
+
+	stop := func() {
+		for _, session := range sessions {
+			session.Stop()
+		}
+	}
+
+	defer stop()
+
+	for i := 0; i < options.Streams; i++ {
+		features.Stream = i
+
+		session, err := startServe(client, executable, features, srcFilePaths, "", 0, serveFlags{
+			filters:       !options.Filters.Empty(),
+			limit:         !options.Limit.Empty(),
+			noDereference: options.NoDereference,
+			dereference:   options.Dereference,
+			xattrs:        options.Xattrs,
+			verify:        options.Verify,
+		})
+
+		if err != nil {
+			return fmt.Errorf("start download stream %d: %w", i, err)
+		}
+
+		sessions = append(sessions, session)
+
+		if !options.Filters.Empty() {
+			if err := serve.WriteFilters(session.Stdin, options.Filters); err != nil {
+				return fmt.Errorf("start download stream %d: %w", i, err)
+			}
+		}
+
+		// Each remote stream keeps to its share of the limit.
+		if !options.Limit.Empty() {
+			if err := serve.WriteLimit(session.Stdin, options.Limit.Split(options.Streams)); err != nil {
+				return fmt.Errorf("start download stream %d: %w", i, err)
+			}
+		}
+	}
+
+	// Every remote stream plans on its own, and nothing would notice files it left out
+	// or sent twice if the plans differed.
+	downloadInfos := make([]serve.DownloadInfo, len(sessions))
+
+	for i, session := range sessions {
+		downloadInfos[i], err = session.GetDownloadInfo(dstFilePath)
+
+		if err != nil {
+			return fmt.Errorf("get download info of stream %d: %w", i, err)
+		}
+
+		if downloadInfos[i].Plan != downloadInfos[0].Plan {
+			return fmt.Errorf("start download stream %d: %w", i, errPlansDiffer)
+		}
+	}
+
+	// The streams share the limit on this side.
+	throttle := serve.NewThrottle(options.Limit)
+	progress := serve.NewProgress("received")
+
+	defer progress.Clear()
+
+	err = runStreams(len(sessions), func(stream int) error {
+		session := sessions[stream]
+		downloadInfo := downloadInfos[stream]
+
+		downloadInfo.Verify = options.Verify
+		downloadInfo.Links = options.NoDereference
+		downloadInfo.Xattrs = options.Xattrs
+		downloadInfo.Throttle = throttle
+		downloadInfo.Progress = progress
+		progress.Expect(downloadInfo.Totals)
+
+		if err := downloadInfo.ReceiveStream(); err != nil {
+			session.Stop()
+
+			if remoteErr := session.RemoteError(); remoteErr != nil {
+				err = remoteErr
+			}
+
+			return fmt.Errorf("receive %v: %w", srcFilePaths, err)
+		}
+
+		if err := session.RemoteError(); err != nil {
+			return fmt.Errorf("serve %v: %w", srcFilePaths, err)
+		}
+
+		return nil
+	}, stop)
+
+	if err != nil {
+		return err
+	}
+
+	progress.Finish()
+
+	return nil
+}
+
+func uploadStreams(client *ssh.Client, srcFilePath, dstFilePath string, options TransferOptions) error {
+	executable, features, err := streamFeatures(client, options)
+
+	if err != nil {
+		return fmt.Errorf("receive %s: %w", dstFilePath, err)
+	}
+
+	var sessions []UploadSession
+
+	stop := func() {
+		for _, session := range sessions {
+			session.Stop()
+		}
+	}
+
+	streamOptions := options
+	streamOptions.Limit = options.Limit.Split(options.Streams)
+
+	for i := 0; i < options.Streams; i++ {
+		features.Stream = i
+
+		session, err := startReceive(client, executable, features, dstFilePath, streamOptions)
+
+		if err != nil {
+			stop()
+			return fmt.Errorf("receive %s: %w", dstFilePath, err)
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	// The streams share one plan, so that they can't disagree on what to send.
+	plan, err := sessions[0].GetUploadInfo(srcFilePath).PlanStreams()
+
+	if err != nil {
+		stop()
+		return fmt.Errorf("serve %s: %w", srcFilePath, err)
+	}
+
+	throttle := serve.NewThrottle(options.Limit)
+	progress := serve.NewProgress("sent")
+
+	defer progress.Clear()
+
+	err = runStreams(len(sessions), func(stream int) error {
+		session := sessions[stream]
+		uploadInfo := session.GetUploadInfo(srcFilePath)
+		uploadInfo.Plan = plan
+		uploadInfo.Throttle = throttle
+		uploadInfo.Progress = progress
+
+		return sendUpload(session, uploadInfo, srcFilePath, dstFilePath)
+	}, stop)
+
+	if err != nil {
+		return err
+	}
+
+	progress.Finish()
+
+	return nil
+}
@@ -0,0 +1,394 @@
+package sessions
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"strings"
+
+	"github.com/l-donovan/qcp/common"
+	"github.com/l-donovan/qcp/protocol"
+	"github.com/l-donovan/qcp/serve"
+	"golang.org/x/crypto/ssh"
+)
+
+// SyncOptions tweak how a directory is synced.
+type SyncOptions struct {
+	// Push makes the remote directory match the local one, rather than the reverse.
+	Push bool
+
+	// Delete removes files that aren't in the source directory.
+	Delete bool
+
+	// DryRun prints what would be transferred and deleted without doing it.
+	DryRun bool
+
+	// Checksum compares the contents of files of the same size rather than their
+	// modification times.
+	Checksum bool
+
+	Compression string
+	Level       int
+
+	// Filters leave out files on both sides, so excluded files are neither transferred
+	// nor deleted.
+	Filters serve.Filters
+}
+
+type syncAction struct {
+	path   string
+	reason string
+}
+
+// syncPlan is what it takes to make the destination match the source. Removals come
+// first, so that files can replace directories and the other way around.
+type syncPlan struct {
+	transfer []syncAction
+	remove   []syncAction
+}
+
+// transferReason returns why a file needs to be transferred, or an empty string if the
+// destination already has it.
+func transferReason(src, dst serve.ManifestEntry, checksum bool) string {
+	if src.Mode.IsDir() {
+		return ""
+	}
+
+	if src.Size != dst.Size {
+		return "size differs"
+	}
+
+	if checksum {
+		if src.Digest != dst.Digest {
+			return "contents differ"
+		}
+
+		return ""
+	}
+
+	if src.ModTime != dst.ModTime {
+		return "modified"
+	}
+
+	return ""
+}
+
+func planSync(src, dst serve.Manifest, options SyncOptions) syncPlan {
+	var plan syncPlan
+
+	srcEntries := map[string]serve.ManifestEntry{}
+	dstEntries := map[string]serve.ManifestEntry{}
+
+	for _, entry := range src {
+		srcEntries[entry.Path] = entry
+	}
+
+	for _, entry := range dst {
+		dstEntries[entry.Path] = entry
+	}
+
+	// Anything inside a removed directory goes with it.
+	var removed []string
+
+	for _, entry := range dst {
+		if withinAny(removed, entry.Path) {
+			continue
+		}
+
+		srcEntry, ok := srcEntries[entry.Path]
+
+		if !ok && options.Delete {
+			plan.remove = append(plan.remove, syncAction{entry.Path, "not in the source directory"})
+		} else if ok && srcEntry.Mode.IsDir() != entry.Mode.IsDir() {
+			plan.remove = append(plan.remove, syncAction{entry.Path, "replaced"})
+		} else {
+			continue
+		}
+
+		if entry.Mode.IsDir() {
+			removed = append(removed, entry.Path+"/")
+		}
+	}
+
+	for _, entry := range src {
+		dstEntry, ok := dstEntries[entry.Path]
+
+		if !ok {
+			plan.transfer = append(plan.transfer, syncAction{entry.Path, "new"})
+		} else if entry.Mode.IsDir() != dstEntry.Mode.IsDir() {
+			plan.transfer = append(plan.transfer, syncAction{entry.Path, "type differs"})
+		} else if reason := transferReason(entry, dstEntry, options.Checksum); reason != "" {
+			plan.transfer = append(plan.transfer, syncAction{entry.Path, reason})
+		}
+	}
+
+	return plan
+}
+
+// withinAny reports whether p is inside any of the directories, which end in a slash.
+func withinAny(directories []string, p string) bool {
+	for _, directory := range directories {
+		if strings.HasPrefix(p, directory) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func paths(actions []syncAction) []string {
+	var out []string
+
+	for _, action := range actions {
+		out = append(out, action.path)
+	}
+
+	return out
+}
+
+// remoteManifest lists the remote directory, leaving out what filters exclude.
+func remoteManifest(client *ssh.Client, executable string, features protocol.Features, location string, checksum bool, filters serve.Filters) (serve.Manifest, error) {
+	cmd, err := protocol.Parser.Marshal(executable, map[string]any{
+		"mode":     "manifest",
+		"features": features.String(),
+		"location": location,
+		"checksum": checksum,
+		"filters":  !filters.Empty(),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("generate command: %w", err)
+	}
+
+	session, err := common.Start(client, cmd)
+
+	if err != nil {
+		return nil, fmt.Errorf("start session: %w", err)
+	}
+
+	defer session.Session.Close()
+
+	if !filters.Empty() {
+		if err := serve.WriteFilters(session.Stdin, filters); err != nil {
+			return nil, err
+		}
+	}
+
+	manifest, err := serve.ReadManifest(session.Stdout)
+
+	if err != nil {
+		if remoteErr := session.RemoteError(); remoteErr != nil {
+			return nil, remoteErr
+		}
+
+		return nil, err
+	}
+
+	return manifest, nil
+}
+
+// removeRemote removes paths under the remote directory.
+func removeRemote(client *ssh.Client, executable string, features protocol.Features, location string, paths []string) error {
+	cmd, err := protocol.Parser.Marshal(executable, map[string]any{
+		"mode":     "remove",
+		"features": features.String(),
+		"location": location,
+	})
+
+	if err != nil {
+		return fmt.Errorf("generate command: %w", err)
+	}
+
+	session, err := common.Start(client, cmd)
+
+	if err != nil {
+		return fmt.Errorf("start session: %w", err)
+	}
+
+	defer session.Session.Close()
+
+	if err := gob.NewEncoder(session.Stdin).Encode(paths); err != nil {
+		return fmt.Errorf("send paths: %w", err)
+	}
+
+	_ = session.Stdin.Close()
+
+	if _, err := io.Copy(os.Stdout, session.Stdout); err != nil {
+		return fmt.Errorf("read output: %w", err)
+	}
+
+	if err := session.Session.Wait(); err != nil {
+		if remoteErr := session.RemoteError(); remoteErr != nil {
+			return remoteErr
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// Sync makes localDir match remoteDir, or the reverse with options.Push, transferring
+// only the files that differ.
+func Sync(client *ssh.Client, remoteDir, localDir string, options SyncOptions) error {
+	executable, features, err := Handshake(client)
+
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	features, err = features.SelectCompression(options.Compression, options.Level)
+
+	if err != nil {
+		return err
+	}
+
+	if !features.Has(protocol.CapSync) {
+		return fmt.Errorf("%w: remote qcp doesn't support sync", protocol.ErrNoCommon)
+	}
+
+	if err := (TransferOptions{Filters: options.Filters}).requireFilters(features); err != nil {
+		return err
+	}
+
+	checksum := ""
+
+	if options.Checksum {
+		checksum = features.Checksum()
+
+		if checksum == "" {
+			return fmt.Errorf("%w: checksum", protocol.ErrNoCommon)
+		}
+	}
+
+	// The destination directory doesn't have to exist yet.
+	localManifest, err := serve.BuildManifest(localDir, checksum, options.Filters)
+
+	if errors.Is(err, fs.ErrNotExist) && !options.Push {
+		localManifest, err = serve.Manifest{}, nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("list %s: %w", localDir, err)
+	}
+
+	remoteManifest, err := remoteManifest(client, executable, features, remoteDir, options.Checksum, options.Filters)
+
+	if errors.Is(err, fs.ErrNotExist) && options.Push {
+		remoteManifest, err = serve.Manifest{}, nil
+	}
+
+	if err != nil {
+		return fmt.Errorf("list %s: %w", remoteDir, err)
+	}
+
+	var plan syncPlan
+	transferVerb := "receive"
+
+	if options.Push {
+		plan = planSync(localManifest, remoteManifest, options)
+		transferVerb = "send"
+	} else {
+		plan = planSync(remoteManifest, localManifest, options)
+	}
+
+	if options.DryRun {
+		for _, action := range plan.remove {
+			fmt.Printf("Would delete %s (%s)\n", action.path, action.reason)
+		}
+
+		for _, action := range plan.transfer {
+			fmt.Printf("Would %s %s (%s)\n", transferVerb, action.path, action.reason)
+		}
+
+		fmt.Printf("%d to %s, %d to delete\n", len(plan.transfer), transferVerb, len(plan.remove))
+
+		return nil
+	}
+
+	if len(plan.remove) > 0 {
+		if options.Push {
+			err = removeRemote(client, executable, features, remoteDir, paths(plan.remove))
+		} else {
+			err = serve.RemovePaths(localDir, paths(plan.remove))
+		}
+
+		if err != nil {
+			return fmt.Errorf("delete: %w", err)
+		}
+	}
+
+	if len(plan.transfer) == 0 {
+		fmt.Println("Already in sync")
+		return nil
+	}
+
+	only := map[string]bool{}
+
+	for _, p := range paths(plan.transfer) {
+		only[p] = true
+	}
+
+	// Files of the same size are only skipped if their contents match, and the times
+	// are kept so that the next sync can tell the files apart by them.
+	if options.Push {
+		session, err := startReceive(client, executable, features, remoteDir, TransferOptions{
+			Verify:        true,
+			PreserveTimes: true,
+			Dereference:   true,
+		})
+
+		if err != nil {
+			return fmt.Errorf("receive %s: %w", remoteDir, err)
+		}
+
+		uploadInfo := session.GetUploadInfo(serve.ContentsOf(localDir))
+		uploadInfo.Only = only
+
+		return sendUpload(session, uploadInfo, localDir, remoteDir)
+	}
+
+	if err := os.MkdirAll(localDir, 0o775); err != nil {
+		return fmt.Errorf("create directory %s: %w", localDir, err)
+	}
+
+	session, err := startServe(client, executable, features, []string{serve.ContentsOf(remoteDir)}, "", 0, serveFlags{only: true, dereference: true, verify: true})
+
+	if err != nil {
+		return fmt.Errorf("start download: %w", err)
+	}
+
+	defer session.Stop()
+
+	if err := session.sendPaths(paths(plan.transfer)); err != nil {
+		return err
+	}
+
+	downloadInfo, err := session.GetDownloadInfo(localDir)
+
+	if err != nil {
+		return fmt.Errorf("get download info: %w", err)
+	}
+
+	downloadInfo.Verify = true
+	downloadInfo.PreserveTimes = true
+
+	if err := downloadInfo.Receive(nil); err != nil {
+		session.Stop()
+
+		if remoteErr := session.RemoteError(); remoteErr != nil {
+			err = remoteErr
+		}
+
+		return fmt.Errorf("receive %s: %w", remoteDir, err)
+	}
+
+	if err := session.RemoteError(); err != nil {
+		return fmt.Errorf("serve %s: %w", remoteDir, err)
+	}
+
+	return nil
+}
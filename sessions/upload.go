@@ -1,7 +1,10 @@
 package sessions
 
 import (
+	"encoding/gob"
+	"errors"
 	"fmt"
+	"io"
 
 	"github.com/l-donovan/qcp/common"
 	"github.com/l-donovan/qcp/protocol"
@@ -11,22 +14,119 @@ import (
 
 type UploadSession interface {
 	GetUploadInfo(filename string) serve.UploadInfo
-	Wait()
+	Signatures(names []string) (serve.Signatures, error)
+	Existing(names []string) (map[string]bool, error)
+	Wait() error
+	Stop()
 }
 
-type uploadSession common.Session
+type uploadSession struct {
+	common.Session
+	features protocol.Features
+	options  TransferOptions
+}
 
-func StartUpload(client *ssh.Client, filepath string) (UploadSession, error) {
-	executable, err := common.FindExecutable(client, "qcp")
+func StartUpload(client *ssh.Client, filepath string, options TransferOptions) (UploadSession, error) {
+	executable, features, err := Handshake(client)
 
 	if err != nil {
-		return nil, fmt.Errorf("find executable: %w", err)
+		return nil, fmt.Errorf("handshake: %w", err)
 	}
 
-	cmd, err := protocol.Parser.Marshal(executable, map[string]any{
+	features, err = features.SelectCompression(options.Compression, options.Level)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return startReceive(client, executable, features, filepath, options)
+}
+
+// startReceive starts receiving files on the remote host once the handshake is done.
+func startReceive(client *ssh.Client, executable string, features protocol.Features, filepath string, options TransferOptions) (UploadSession, error) {
+	values := map[string]any{
 		"mode":        "receive",
+		"features":    features.String(),
 		"destination": filepath,
-	})
+	}
+
+	// Remotes without checksums don't know about --verify either.
+	if features.Checksum() != "" {
+		values["verify"] = options.Verify
+	}
+
+	if options.Delta {
+		if !features.Has(protocol.CapDelta) {
+			return nil, fmt.Errorf("%w: remote qcp doesn't support deltas", protocol.ErrNoCommon)
+		}
+
+		values["delta"] = true
+	}
+
+	if err := options.requirePreserve(features); err != nil {
+		return nil, err
+	}
+
+	if options.Preserve {
+		values["preserve"] = true
+	}
+
+	// Older remotes recreate whatever they're sent.
+	if options.NoDereference && features.Has(protocol.CapFollow) {
+		values["links"] = true
+	}
+
+	if options.Xattrs {
+		values["xattrs"] = true
+	}
+
+	if options.Atomic {
+		if !features.Has(protocol.CapAtomic) {
+			return nil, fmt.Errorf("%w: remote qcp can't write files atomically", protocol.ErrNoCommon)
+		}
+
+		values["atomic"] = true
+	}
+
+	if options.OnConflict != "" {
+		if !features.Has(protocol.CapConflicts) {
+			return nil, fmt.Errorf("%w: remote qcp doesn't support conflict policies", protocol.ErrNoCommon)
+		}
+
+		// Nobody is there to answer on the remote side, so the remote lists what's in
+		// the way and we ask about it here, see Existing.
+		if options.OnConflict == serve.ConflictAsk {
+			if !features.Has(protocol.CapAnswers) {
+				return nil, fmt.Errorf("%w: remote qcp can't ask about files that already exist", protocol.ErrNoCommon)
+			}
+
+			values["existing"] = true
+		}
+
+		values["conflicts"] = true
+	}
+
+	if options.resumable {
+		values["resumable"] = true
+	}
+
+	if options.PreserveTimes {
+		if !features.Has(protocol.CapSync) {
+			return nil, fmt.Errorf("%w: remote qcp can't preserve times", protocol.ErrNoCommon)
+		}
+
+		values["times"] = true
+	}
+
+	if err := options.requireLimit(features); err != nil {
+		return nil, err
+	}
+
+	if !options.Limit.Empty() {
+		values["limit"] = true
+	}
+
+	cmd, err := protocol.Parser.Marshal(executable, values)
 
 	if err != nil {
 		return nil, fmt.Errorf("generate command: %w", err)
@@ -38,35 +138,257 @@ func StartUpload(client *ssh.Client, filepath string) (UploadSession, error) {
 		return nil, fmt.Errorf("start session: %w", err)
 	}
 
-	return uploadSession(session), nil
+	if options.OnConflict != "" {
+		if err := serve.WriteConflictPolicy(session.Stdin, options.OnConflict); err != nil {
+			return nil, err
+		}
+	}
+
+	if !options.Limit.Empty() {
+		if err := serve.WriteLimit(session.Stdin, options.Limit); err != nil {
+			return nil, err
+		}
+	}
+
+	// Nobody reads what the remote prints, but it mustn't block on it either. With
+	// delta, signatures come first, see Signatures, and with ask, existing files do, see
+	// Existing.
+	if !options.Delta && options.OnConflict != serve.ConflictAsk {
+		go discard(session.Stdout)
+	}
+
+	return uploadSession{session, features, options}, nil
+}
+
+func discard(r io.Reader) {
+	_, _ = io.Copy(io.Discard, r)
 }
 
 func (s uploadSession) GetUploadInfo(filename string) serve.UploadInfo {
+	compression, autoCompression := s.features.SelectedCompression()
+
+	// Links to directories are followed for older remotes, which follow every link.
+	// Checksums go ahead of files when the remote is to verify what it already has.
 	return serve.UploadInfo{
 		Filenames:   []string{filename},
 		Destination: s.Stdin,
+		Checksum:    s.features.Checksum(),
+
+		Compression:     compression,
+		Level:           s.features.CompressionLevel,
+		AutoCompression: autoCompression,
+
+		Stream:  s.features.Stream,
+		Streams: s.features.Streams,
+
+		NoDereference: s.options.NoDereference,
+		Dereference:   s.options.Dereference || !s.features.Has(protocol.CapFollow),
+		Preserve:      s.options.Preserve,
+		Xattrs:        s.options.Xattrs,
+		Sparse:        s.features.Has(protocol.CapSparse),
+		Filters:       s.options.Filters,
+		SendTotals:    s.features.Has(protocol.CapTotals),
+		OnConflict:    s.options.OnConflict,
+
+		TrailingChecksums: s.features.Has(protocol.CapTrailers) && !s.options.Verify,
 	}
 }
 
-func (s uploadSession) Wait() {
-	s.Stdin.Close()
-	s.Session.Wait()
+// Signatures sends the roots of the tarball that's about to be sent and returns the
+// remote's signatures of the files already under them.
+func (s uploadSession) Signatures(names []string) (serve.Signatures, error) {
+	if err := gob.NewEncoder(s.Stdin).Encode(names); err != nil {
+		return nil, fmt.Errorf("send roots: %w", err)
+	}
+
+	signatures, err := serve.ReadSignatures(s.Stdout)
+
+	if err != nil {
+		if remoteErr := s.RemoteError(); remoteErr != nil {
+			return nil, remoteErr
+		}
+
+		return nil, err
+	}
+
+	go discard(s.Stdout)
+
+	return signatures, nil
 }
 
-func Upload(client *ssh.Client, srcFilePath, dstFilePath string) error {
-	session, err := StartUpload(client, dstFilePath)
+// Existing sends the roots of the tarball that's about to be sent and returns which
+// files under them are already at the remote destination.
+func (s uploadSession) Existing(names []string) (map[string]bool, error) {
+	if err := gob.NewEncoder(s.Stdin).Encode(names); err != nil {
+		return nil, fmt.Errorf("send roots: %w", err)
+	}
+
+	existing, err := serve.ReadExisting(s.Stdout)
 
 	if err != nil {
-		return fmt.Errorf("receive %s: %w", dstFilePath, err)
+		if remoteErr := s.RemoteError(); remoteErr != nil {
+			return nil, remoteErr
+		}
+
+		return nil, err
 	}
 
-	defer session.Wait()
+	go discard(s.Stdout)
 
-	uploadInfo := session.GetUploadInfo(srcFilePath)
+	return existing, nil
+}
+
+func (s uploadSession) Wait() error {
+	s.Stdin.Close()
+
+	if err := s.Session.Session.Wait(); err != nil {
+		if remoteErr := s.RemoteError(); remoteErr != nil {
+			return remoteErr
+		}
 
+		return err
+	}
+
+	return nil
+}
+
+func (s uploadSession) Stop() {
+	s.Session.Session.Close()
+}
+
+// sendUpload serves uploadInfo to a session and waits for the remote side to finish.
+func sendUpload(session UploadSession, uploadInfo serve.UploadInfo, srcFilePath, dstFilePath string) error {
 	if err := uploadInfo.Serve(); err != nil {
+		// If the remote side failed, we were most likely cut off because of it.
+		if waitErr := session.Wait(); errors.As(waitErr, new(*protocol.RemoteError)) {
+			return fmt.Errorf("receive %s: %w", dstFilePath, waitErr)
+		}
+
 		return fmt.Errorf("serve %s: %w", srcFilePath, err)
 	}
 
+	if err := session.Wait(); err != nil {
+		return fmt.Errorf("receive %s: %w", dstFilePath, err)
+	}
+
+	return nil
+}
+
+// uploadResumeState asks the remote what it already has from the last upload to
+// dstFilePath, if that was interrupted.
+func uploadResumeState(client *ssh.Client, executable string, features protocol.Features, dstFilePath string) (serve.ResumeState, error) {
+	cmd, err := protocol.Parser.Marshal(executable, map[string]any{
+		"mode":        "resume",
+		"features":    features.String(),
+		"destination": dstFilePath,
+	})
+
+	if err != nil {
+		return serve.ResumeState{}, fmt.Errorf("generate command: %w", err)
+	}
+
+	session, err := common.Start(client, cmd)
+
+	if err != nil {
+		return serve.ResumeState{}, fmt.Errorf("start session: %w", err)
+	}
+
+	defer session.Session.Close()
+
+	state, err := serve.ReadResumeState(session.Stdout)
+
+	if err != nil {
+		if remoteErr := session.RemoteError(); remoteErr != nil {
+			return serve.ResumeState{}, remoteErr
+		}
+
+		return serve.ResumeState{}, err
+	}
+
+	return state, nil
+}
+
+func Upload(client *ssh.Client, srcFilePath, dstFilePath string, options TransferOptions) error {
+	if options.Streams > 1 {
+		return uploadStreams(client, srcFilePath, dstFilePath, options)
+	}
+
+	executable, features, err := Handshake(client)
+
+	if err != nil {
+		return fmt.Errorf("handshake: %w", err)
+	}
+
+	features, err = features.SelectCompression(options.Compression, options.Level)
+
+	if err != nil {
+		return err
+	}
+
+	var state serve.ResumeState
+
+	// Older remotes don't keep a journal, so their uploads always start over.
+	if features.Has(protocol.CapResumeUpload) {
+		state, err = uploadResumeState(client, executable, features, dstFilePath)
+
+		if err != nil {
+			return fmt.Errorf("find where the last upload stopped: %w", err)
+		}
+
+		options.resumable = true
+	}
+
+	// Files received before are rehashed rather than skipped when verifying.
+	if options.Verify {
+		state.Completed = nil
+	}
+
+	session, err := startReceive(client, executable, features, dstFilePath, options)
+
+	if err != nil {
+		return fmt.Errorf("receive %s: %w", dstFilePath, err)
+	}
+
+	uploadInfo := session.GetUploadInfo(srcFilePath)
+
+	uploadInfo.Resume = state
+	uploadInfo.Throttle = serve.NewThrottle(options.Limit)
+	uploadInfo.Progress = serve.NewProgress("sent")
+
+	defer uploadInfo.Progress.Clear()
+
+	if state.InFlight != nil {
+		fmt.Printf("Resuming upload at %s (already uploaded %s)\n", state.InFlight.Path, common.PrettifySize(state.InFlight.Offset))
+	}
+
+	if options.Delta {
+		signatures, err := session.Signatures([]string{serve.ArchiveRoot(srcFilePath)})
+
+		if err != nil {
+			session.Stop()
+			return fmt.Errorf("receive %s: %w", dstFilePath, err)
+		}
+
+		uploadInfo.Signatures = signatures
+	}
+
+	if options.OnConflict == serve.ConflictAsk {
+		existing, err := session.Existing([]string{serve.ArchiveRoot(srcFilePath)})
+
+		if err != nil {
+			session.Stop()
+			return fmt.Errorf("receive %s: %w", dstFilePath, err)
+		}
+
+		uploadInfo.Existing = existing
+		uploadInfo.Prompter = common.DefaultPrompter(true)
+	}
+
+	if err := sendUpload(session, uploadInfo, srcFilePath, dstFilePath); err != nil {
+		return err
+	}
+
+	uploadInfo.Progress.Finish()
+
 	return nil
 }
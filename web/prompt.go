@@ -0,0 +1,49 @@
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/gorilla/websocket"
+	"github.com/l-donovan/qcp/common"
+)
+
+// Prompter asks the browser on the other end of a websocket session for input.
+// It must only be used from the goroutine reading the websocket.
+type Prompter struct {
+	conn *websocket.Conn
+}
+
+func (p Prompter) Prompt(message string, echo bool) (string, error) {
+	body, err := json.Marshal(RequestPrompt{
+		Message: message,
+		Echo:    echo,
+	})
+
+	if err != nil {
+		return "", fmt.Errorf("marshal prompt: %w", err)
+	}
+
+	if err := p.conn.WriteMessage(websocket.TextMessage, append([]byte("prompt "), body...)); err != nil {
+		return "", fmt.Errorf("send prompt: %w", err)
+	}
+
+	_, messageRaw, err := p.conn.ReadMessage()
+
+	if err != nil {
+		return "", fmt.Errorf("read answer: %w", err)
+	}
+
+	commandRaw, answerRaw, _ := bytes.Cut(messageRaw, []byte(" "))
+
+	switch string(commandRaw) {
+	case "answer":
+		return string(answerRaw), nil
+	case "cancel":
+		return "", errors.New("prompt cancelled")
+	}
+
+	return "", fmt.Errorf("expected answer to prompt but got %q: %w", commandRaw, common.ErrNoPrompter)
+}
@@ -4,6 +4,12 @@ type RequestConnection struct {
 	Hostname   string `json:"hostname"`
 	Location   string `json:"location"`
 	Executable string `json:"executable"`
+	Jump       string `json:"jump"`
+}
+
+type RequestPrompt struct {
+	Message string `json:"message"`
+	Echo    bool   `json:"echo"`
 }
 
 type HomeInput struct {
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/l-donovan/qcp/protocol"
 	"github.com/l-donovan/qcp/serve"
 	"github.com/l-donovan/qcp/sessions"
 
@@ -30,17 +31,19 @@ var (
 )
 
 type Handler struct {
-	mux   *http.ServeMux
-	files *sync.Map
+	mux       *http.ServeMux
+	files     *sync.Map
+	jumpHosts string
 }
 
 func init() {
 	tmpl = template.Must(template.New("index").Parse(indexHTML))
 }
 
-func NewHandler() Handler {
+func NewHandler(jumpHosts string) Handler {
 	h := Handler{
-		files: new(sync.Map),
+		files:     new(sync.Map),
+		jumpHosts: jumpHosts,
 	}
 
 	mux := http.NewServeMux()
@@ -107,7 +110,11 @@ func (h Handler) ServeSession(w http.ResponseWriter, r *http.Request) {
 
 				// New connection means new SSH client.
 
-				client, err = createClient(request)
+				if request.Jump == "" {
+					request.Jump = h.jumpHosts
+				}
+
+				client, err = createClient(request, Prompter{conn})
 
 				if err != nil {
 					return []byte(err.Error())
@@ -164,7 +171,11 @@ func (h Handler) ServeSession(w http.ResponseWriter, r *http.Request) {
 
 				fmt.Printf("Downloading %s\n", strings.Join(filepaths, ", "))
 
-				downloadSession, err := sessions.StartDownload(client, filepaths, "", 0)
+				downloadSession, err := sessions.StartDownload(client, filepaths, "", 0, sessions.TransferOptions{
+					// Browsers can open gzipped tarballs but not the alternatives.
+					Compression: protocol.CompressionGzip,
+					ForBrowser:  true,
+				})
 
 				if err != nil {
 					return []byte(err.Error())
@@ -216,13 +227,19 @@ func (h Handler) ServeSession(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func createClient(request RequestConnection) (*ssh.Client, error) {
+func createClient(request RequestConnection, prompter common.Prompter) (*ssh.Client, error) {
 	info, err := common.ParseConnectionString(request.Hostname)
 
 	if err != nil {
 		return nil, fmt.Errorf("parse connection string: %w", err)
 	}
 
+	if request.Jump != "" {
+		info.ProxyJump = common.ParseJumpHosts(request.Jump)
+	}
+
+	info.Prompter = prompter
+
 	remoteClient, err := common.CreateClient(*info)
 
 	if err != nil {
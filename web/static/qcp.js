@@ -160,6 +160,9 @@ function openConnection() {
             let components = evt.data.split(" ");
             let link = components[1];
             window.open(link);
+        } else if (evt.data.startsWith("prompt ")) {
+            const payload = JSON.parse(evt.data.slice(evt.data.indexOf(" ") + 1));
+            showPrompt(payload);
         }
     }
 
@@ -171,13 +174,40 @@ function openConnection() {
     return false;
 }
 
+// Answers to prompts without echo, such as passwords, are typed into a password field
+// so that they aren't shown.
+function showPrompt(payload) {
+    const dialog = document.getElementById("prompt");
+    const answer = document.getElementById("prompt-answer");
+
+    document.getElementById("prompt-message").textContent = payload.message;
+    answer.type = payload.echo ? "text" : "password";
+    answer.value = "";
+
+    dialog.onclose = () => {
+        if (dialog.returnValue === "ok") {
+            ws.send("answer " + answer.value);
+        } else {
+            ws.send("cancel");
+        }
+
+        answer.value = "";
+    };
+
+    dialog.returnValue = "";
+    dialog.showModal();
+    answer.focus();
+}
+
 function connect() {
     const hostname = document.getElementById("hostname").value
     const location = document.getElementById("location").value
+    const jump = document.getElementById("jump").value
 
     const payload = "connect " + JSON.stringify({
         "hostname": hostname,
         "location": location,
+        "jump": jump,
     });
 
     console.log("> " + payload);